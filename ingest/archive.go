@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sourceSuffixes are the file names the spoolers pick up. How a file is read
+// is decided by its leading bytes, not by its name.
+var sourceSuffixes = []string{".db.zip", ".db.gz", ".db.zst", ".tar.zst", ".db"}
+
+// isSourceFile reports whether name looks like a Megastream dump
+func isSourceFile(name string) bool {
+	for _, suffix := range sourceSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveFormat is the container format of a source file
+type archiveFormat int
+
+const (
+	formatUnknown archiveFormat = iota
+	formatSQLite
+	formatZip
+	formatGzip
+	formatZstd
+	formatTar
+)
+
+func (f archiveFormat) String() string {
+	switch f {
+	case formatSQLite:
+		return "sqlite"
+	case formatZip:
+		return "zip"
+	case formatGzip:
+		return "gzip"
+	case formatZstd:
+		return "zstd"
+	case formatTar:
+		return "tar"
+	}
+	return "unknown"
+}
+
+var (
+	sqliteMagic   = []byte("SQLite format 3\x00")
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+)
+
+// sniffLen is the number of leading bytes needed to detect every format; the
+// tar magic sits at offset 257
+const sniffLen = 512
+
+// detectFormat identifies a file from its first sniffLen bytes
+func detectFormat(header []byte) archiveFormat {
+	switch {
+	case bytes.HasPrefix(header, sqliteMagic):
+		return formatSQLite
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmptyMagic):
+		return formatZip
+	case bytes.HasPrefix(header, gzipMagic):
+		return formatGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return formatZstd
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return formatTar
+	}
+	return formatUnknown
+}
+
+// sniffFile detects the format of the file at path
+func sniffFile(path string) (archiveFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return formatUnknown, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return formatUnknown, fmt.Errorf("failed to read file header: %w", err)
+	}
+	return detectFormat(header[:n]), nil
+}
+
+// databasePath returns where the i-th database of a file is extracted to.
+// The index keeps entries with the same base name in different archive
+// directories apart.
+func databasePath(dir string, i int, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(name)))
+}
+
+// databaseEntries returns every .db file in a zip archive
+func databaseEntries(r *zip.Reader) ([]*zip.File, error) {
+	if len(r.File) == 0 {
+		return nil, permanent(fmt.Errorf("zip file is empty"))
+	}
+
+	var entries []*zip.File
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() && strings.HasSuffix(f.Name, ".db") {
+			entries = append(entries, f)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, permanent(fmt.Errorf("no .db file found in zip archive"))
+	}
+	return entries, nil
+}
+
+// uncompressedSize returns the total extracted size of entries
+func uncompressedSize(entries []*zip.File) int64 {
+	var total int64
+	for _, f := range entries {
+		total += int64(f.UncompressedSize64)
+	}
+	return total
+}
+
+// extractEntry writes the uncompressed content of f to destPath, recording
+// the bytes written with res
+func extractEntry(f *zip.File, destPath string, res *reservation) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file in zip: %w", err)
+	}
+	defer rc.Close()
+
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(res.writer(outFile), rc); err != nil {
+		return fmt.Errorf("failed to extract file: %w", err)
+	}
+
+	return nil
+}
+
+// extractZip extracts every database in the zip archive at path into dir
+func extractZip(path, dir string, res *reservation) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unzip file: %w", err)
+	}
+	defer r.Close()
+
+	entries, err := databaseEntries(&r.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unzip file: %w", err)
+	}
+	return extractEntries(entries, dir, res)
+}
+
+// extractEntries extracts zip entries into dir, whose space res holds, and
+// returns their paths
+func extractEntries(entries []*zip.File, dir string, res *reservation) ([]string, error) {
+	var dbPaths []string
+	for i, entry := range entries {
+		dbPath := databasePath(dir, i, entry.Name)
+		if err := extractEntry(entry, dbPath, res); err != nil {
+			return nil, fmt.Errorf("failed to unzip %s: %w", entry.Name, err)
+		}
+		dbPaths = append(dbPaths, dbPath)
+	}
+	return dbPaths, nil
+}
+
+// extractStream writes the databases read from r into dir and returns their
+// paths. r may hold a bare database or a tar bundle of databases, either of
+// them optionally compressed with gzip or zstd. name is the source file name,
+// used to name a bare database. Every byte written is charged to res, since
+// the extracted size is not known in advance.
+func extractStream(r io.Reader, name, dir string, res *reservation) ([]string, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	switch detectFormat(header) {
+	case formatGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		return extractStream(gz, trimCompression(name), dir, res)
+
+	case formatZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		defer zr.Close()
+		return extractStream(zr, trimCompression(name), dir, res)
+
+	case formatTar:
+		return extractTar(tar.NewReader(br), dir, res)
+
+	case formatSQLite:
+		dbPath := databasePath(dir, 0, name)
+		if err := writeReserved(dbPath, br, res); err != nil {
+			return nil, err
+		}
+		return []string{dbPath}, nil
+
+	case formatZip:
+		return nil, permanent(fmt.Errorf("zip archives cannot be read as a stream"))
+
+	default:
+		return nil, permanent(fmt.Errorf("unrecognized file format"))
+	}
+}
+
+// trimCompression removes a compression suffix from name, whichever codec
+// the content actually turned out to use
+func trimCompression(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+}
+
+// extractTar extracts every .db member of a tar bundle into dir
+func extractTar(tr *tar.Reader, dir string, res *reservation) ([]string, error) {
+	var dbPaths []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar bundle: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".db") {
+			continue
+		}
+
+		dbPath := databasePath(dir, len(dbPaths), hdr.Name)
+		if err := writeReserved(dbPath, tr, res); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		dbPaths = append(dbPaths, dbPath)
+	}
+
+	if len(dbPaths) == 0 {
+		return nil, permanent(fmt.Errorf("no .db file found in tar bundle"))
+	}
+	return dbPaths, nil
+}
+
+// writeReserved copies r to a new file at path, charging every write to res
+func writeReserved(path string, r io.Reader, res *reservation) error {
+	outFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(reservingWriter{w: outFile, res: res}, r); err != nil {
+		return fmt.Errorf("failed to extract file: %w", err)
+	}
+	return nil
+}
+
+// reservingWriter charges every write to a reservation before passing it on
+type reservingWriter struct {
+	w   io.Writer
+	res *reservation
+}
+
+func (rw reservingWriter) Write(p []byte) (int, error) {
+	if err := rw.res.use(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := rw.w.Write(p)
+	rw.res.wrote(int64(n))
+	return n, err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testBundle builds a tar bundle holding one test database per row count
+func testBundle(t *testing.T, rowCounts ...int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, rows := range rowCounts {
+		dbPath := filepath.Join(t.TempDir(), "test.db")
+		createTestDatabase(t, dbPath, rows)
+		data, err := os.ReadFile(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to read test database: %v", err)
+		}
+
+		// Every member has the same base name in a different directory
+		hdr := &tar.Header{Name: filepath.Join(string(rune('a'+i)), "test.db"), Mode: 0644, Size: int64(len(data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatalf("Failed to write tar member: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatalf("Failed to gzip data: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil)
+}
+
+func testDatabaseBytes(t *testing.T, rowCount int) []byte {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	createTestDatabase(t, dbPath, rowCount)
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read test database: %v", err)
+	}
+	return data
+}
+
+func TestDetectFormat(t *testing.T) {
+	db := testDatabaseBytes(t, 1)
+	bundle := testBundle(t, 1)
+
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 1)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want archiveFormat
+	}{
+		{"sqlite", db, formatSQLite},
+		{"zip", zipData, formatZip},
+		{"gzip", gzipBytes(t, db), formatGzip},
+		{"zstd", zstdBytes(t, db), formatZstd},
+		{"tar", bundle, formatTar},
+		{"text", []byte("not a database"), formatUnknown},
+		{"empty", nil, formatUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectFormat(tt.data[:min(len(tt.data), sniffLen)]); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIsSourceFile(t *testing.T) {
+	for _, name := range []string{"a.db.zip", "a.db.gz", "a.db.zst", "a.tar.zst", "a.db"} {
+		if !isSourceFile(name) {
+			t.Errorf("Expected %s to be picked up", name)
+		}
+	}
+	for _, name := range []string{"a.zip", "a.tar.gz", "a.db-journal", "state.json"} {
+		if isSourceFile(name) {
+			t.Errorf("Expected %s to be ignored", name)
+		}
+	}
+}
+
+func TestExtractStream(t *testing.T) {
+	db := testDatabaseBytes(t, 2)
+
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{"gzip", "mega.db.gz", gzipBytes(t, db), []string{"0-mega.db"}, false},
+		{"zstd", "mega.db.zst", zstdBytes(t, db), []string{"0-mega.db"}, false},
+		{"tar zstd", "mega.tar.zst", zstdBytes(t, testBundle(t, 1, 2, 3)), []string{"0-test.db", "1-test.db", "2-test.db"}, false},
+		{"misnamed gzip", "mega.db.zst", gzipBytes(t, db), []string{"0-mega.db"}, false},
+		{"garbage", "mega.db.gz", []byte("not a database"), nil, true},
+		{"empty bundle", "mega.tar.zst", zstdBytes(t, testBundle(t)), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := newDiskBudget(0)
+			res, err := budget.reserve(context.Background(), 0, 1)
+			if err != nil {
+				t.Fatalf("Failed to reserve: %v", err)
+			}
+
+			dir := t.TempDir()
+			paths, err := extractStream(bytes.NewReader(tt.data), tt.file, dir, res)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected extraction to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to extract stream: %v", err)
+			}
+
+			if len(paths) != len(tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, paths)
+			}
+			var written int64
+			for i, path := range paths {
+				if filepath.Base(path) != tt.want[i] {
+					t.Errorf("Expected %s, got %s", tt.want[i], filepath.Base(path))
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatalf("Expected extracted database on disk: %v", err)
+				}
+				written += info.Size()
+			}
+
+			// The reservation grew to cover everything written
+			if res.held < written {
+				t.Errorf("Expected at least %d bytes reserved, got %d", written, res.held)
+			}
+			res.release()
+			if budget.used != 0 {
+				t.Errorf("Expected budget to be empty after release, got %d", budget.used)
+			}
+		})
+	}
+}
+
+func TestLocalSpooler_ProcessesEveryFormat(t *testing.T) {
+	db := testDatabaseBytes(t, 2)
+
+	var multiZip bytes.Buffer
+	zw := zip.NewWriter(&multiZip)
+	for _, name := range []string{"a/test.db", "b/test.db", "README"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		if _, err := w.Write(db); err != nil {
+			t.Fatalf("Failed to write zip entry: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zip writer: %v", err)
+	}
+
+	files := map[string][]byte{
+		"mega_1.db":      db,
+		"mega_2.db.gz":   gzipBytes(t, db),
+		"mega_3.db.zst":  zstdBytes(t, db),
+		"mega_4.tar.zst": zstdBytes(t, testBundle(t, 1, 2, 3)),
+		"mega_5.db.zip":  multiZip.Bytes(),
+		"notes.txt":      []byte("ignored"),
+	}
+
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	logger := NewLogger(false)
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	// 2 + 2 + 2 + (1+2+3) + (2+2)
+	if count := drainAndAck(t, spooler, nil); count != 16 {
+		t.Errorf("Expected 16 rows, got %d", count)
+	}
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	for name := range files {
+		if name == "notes.txt" {
+			continue
+		}
+		if !sm.IsProcessed(name) {
+			t.Errorf("Expected %s to be processed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Expected unrelated file to be left alone: %v", err)
+	}
+}
+
+func TestS3Spooler_StreamsCompressedBundle(t *testing.T) {
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.tar.zst", zstdBytes(t, testBundle(t, 1, 2)))
+	server.put("megastream/mega_20250101_000001.db.gz", gzipBytes(t, testDatabaseBytes(t, 3)))
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	spooler.scratch = &scratchSpace{dir: t.TempDir(), budget: newDiskBudget(0)}
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 6 {
+		t.Errorf("Expected 6 rows, got %d", count)
+	}
+	spooler.Stop()
+
+	for _, name := range []string{"megastream/mega_20250101_000000.tar.zst", "megastream/mega_20250101_000001.db.gz"} {
+		if !sm.IsProcessed(name) {
+			t.Errorf("Expected %s to be processed", name)
+		}
+	}
+
+	entries, err := os.ReadDir(spooler.scratch.dir)
+	if err != nil {
+		t.Fatalf("Failed to read scratch directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected scratch directory to be empty, got %d entries", len(entries))
+	}
+	if spooler.scratch.budget.used != 0 {
+		t.Errorf("Expected disk budget to be released, got %d bytes", spooler.scratch.budget.used)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// checkpointRows is the number of consecutive rows of a database that share an
+// ack token. The checkpoint of a file advances over every leading chunk whose
+// rows have all been acknowledged, since acks arrive out of row order.
+const checkpointRows = 1000
+
+// rowChunk is a run of rows from one database acknowledged under one token
+type rowChunk struct {
+	token     AckToken
+	fileToken AckToken
+	database  int
+	lastRowid int64
+	queued    int
+	acked     int
+	closed    bool
+}
+
+// rowToken returns the ack token for a row about to be queued from the
+// database-th database of the file, starting a new chunk when needed
+func (bs *baseSpooler) rowToken(fileToken AckToken, database int, rowid int64) AckToken {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	pf, ok := bs.pending[fileToken]
+	if !ok {
+		return fileToken
+	}
+
+	var chunk *rowChunk
+	if n := len(pf.chunks); n > 0 {
+		chunk = pf.chunks[n-1]
+		if chunk.closed || chunk.database != database || chunk.queued >= checkpointRows {
+			chunk.closed = true
+			chunk = nil
+		}
+	}
+	if chunk == nil {
+		bs.nextToken++
+		chunk = &rowChunk{token: bs.nextToken, fileToken: fileToken, database: database}
+		pf.chunks = append(pf.chunks, chunk)
+		bs.chunks[chunk.token] = chunk
+	}
+
+	chunk.queued++
+	chunk.lastRowid = rowid
+	return chunk.token
+}
+
+// resumePoint returns where the previous attempt at the file stopped, if it
+// left a checkpoint
+func (bs *baseSpooler) resumePoint(fileToken AckToken) (FileProgress, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	pf, ok := bs.pending[fileToken]
+	if !ok || pf.progress.RowsAcked == 0 {
+		return FileProgress{}, false
+	}
+	return pf.progress, true
+}
+
+// advanceCheckpointUnsafe moves the checkpoint of the file over its leading
+// fully acknowledged chunks and adds the write saving it, unless the file is
+// about to be marked processed anyway. Nothing advances past a failed row.
+func (bs *baseSpooler) advanceCheckpointUnsafe(pf *pendingFile, writes *stateWrites) {
+	if pf.err != nil {
+		return
+	}
+
+	advanced := false
+	for len(pf.chunks) > 0 {
+		chunk := pf.chunks[0]
+		if !chunk.closed || chunk.acked < chunk.queued {
+			break
+		}
+
+		pf.progress = FileProgress{
+			Database:  chunk.database,
+			LastRowid: chunk.lastRowid,
+			RowsAcked: pf.progress.RowsAcked + chunk.acked,
+		}
+		delete(bs.chunks, chunk.token)
+		pf.chunks = pf.chunks[1:]
+		advanced = true
+	}
+
+	if advanced && !(pf.sealed && pf.acked >= pf.queued) {
+		filename, progress := pf.filename, pf.progress
+		writes.add(func() {
+			if err := bs.stateManager.SetProgress(filename, progress); err != nil {
+				bs.logger.Error("Failed to save checkpoint of %s: %v", filename, err)
+			}
+		})
+	}
+}
+
+// dropChunksUnsafe forgets the chunks of a file that is no longer pending, so
+// late acks for them are ignored
+func (bs *baseSpooler) dropChunksUnsafe(pf *pendingFile) {
+	for _, chunk := range pf.chunks {
+		delete(bs.chunks, chunk.token)
+	}
+	pf.chunks = nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBaseSpooler_CheckpointWaitsForEarlierChunks(t *testing.T) {
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	bs := newBaseSpooler("once", time.Second, sm, NewLogger(false))
+	defer bs.stopAcks()
+
+	filename := "mega_1.db"
+	token := bs.beginFile(filename, nil, nil)
+	acks := make(map[AckToken]int)
+	var order []AckToken
+	for rowid := int64(1); rowid <= 2500; rowid++ {
+		rowToken := bs.rowToken(token, 0, rowid)
+		if acks[rowToken] == 0 {
+			order = append(order, rowToken)
+		}
+		acks[rowToken]++
+	}
+	if len(order) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(order))
+	}
+
+	bs.handleAck(Ack{Token: order[1], Count: acks[order[1]]})
+	if _, ok := sm.Progress(filename); ok {
+		t.Error("Expected no checkpoint while the first chunk is unacknowledged")
+	}
+
+	bs.handleAck(Ack{Token: order[0], Count: acks[order[0]]})
+	want := FileProgress{Database: 0, LastRowid: 2000, RowsAcked: 2000}
+	if got, ok := sm.Progress(filename); !ok || got != want {
+		t.Errorf("Expected checkpoint %+v, got %+v (%v)", want, got, ok)
+	}
+
+	// The last chunk is only complete once the file is sealed
+	bs.handleAck(Ack{Token: order[2], Count: acks[order[2]]})
+	if got, _ := sm.Progress(filename); got != want {
+		t.Errorf("Expected checkpoint to stay at %+v, got %+v", want, got)
+	}
+
+	bs.sealFile(token, 2500)
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected file to be processed once every row is acknowledged")
+	}
+	if len(bs.chunks) != 0 {
+		t.Errorf("Expected chunks to be released, %d left", len(bs.chunks))
+	}
+}
+
+func TestLocalSpooler_ResumesAfterCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	filename := "mega_1.db"
+	createTestDatabase(t, filepath.Join(dir, filename), 2500)
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	sm, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	// The first run is stopped after acknowledging 1200 rows
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	received := 0
+	for row := range spooler.Records() {
+		if received < 1200 {
+			spooler.Ack(Ack{Token: row.Token, Count: 1})
+		}
+		received++
+	}
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+	if received != 2500 {
+		t.Fatalf("Expected 2500 rows, got %d", received)
+	}
+
+	sm, err = NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to reload state: %v", err)
+	}
+	entry := sm.state[filename]
+	if entry.Status != FileStatusInProgress || entry.LastRowid != 1000 || entry.RowsAcked != 1000 {
+		t.Fatalf("Expected file in progress at row 1000, got %+v", entry)
+	}
+
+	// The second run starts after the checkpoint
+	spooler = NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	first := <-spooler.Records()
+	if want := fmt.Sprintf("at://did:plc:test/app.bsky.feed.post/%d", 1000); first.AtURI != want {
+		t.Errorf("Expected to resume at %s, got %s", want, first.AtURI)
+	}
+	spooler.Ack(Ack{Token: first.Token, Count: 1})
+	if count := drainAndAck(t, spooler, nil) + 1; count != 1500 {
+		t.Errorf("Expected 1500 remaining rows, got %d", count)
+	}
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected resumed file to be processed")
+	}
+}
+
+func TestBaseSpooler_StateWritesDoNotHoldSpoolerLock(t *testing.T) {
+	server, client := newStateTestServer(t)
+	sm := newReplicaStateManager(t, client, "replica-a", nil)
+	bs := newBaseSpooler("once", time.Second, sm, NewLogger(false))
+
+	filename := "mega_1.db.zip"
+	if !sm.Claim(filename) {
+		t.Fatal("Expected to claim the file")
+	}
+	token := bs.beginFile(filename, nil, nil)
+	rowToken := bs.rowToken(token, 0, 1)
+	bs.sealFile(token, 1)
+
+	// Marking the file processed stalls in the state backend
+	arrived, release := server.stallWrites(docID(fileKey(filename)))
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(release)
+	bs.Ack(Ack{Token: rowToken, Count: 1})
+	<-arrived
+
+	checked := make(chan struct{})
+	go func() {
+		bs.isPending("mega_2.db.zip")
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the spooler not to wait for the state backend")
+	}
+
+	releaseOnce.Do(release)
+	bs.stopAcks()
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected file to be processed once the write completes")
+	}
+}
@@ -11,17 +11,18 @@ type Config struct {
 	// SQLite configuration
 	SQLiteDBPath string
 
-	// WebSocket configuration (for future use)
+	// WebSocket configuration
 	TurboStreamURL string
 
 	// Elasticsearch configuration
 	ElasticsearchURL    string
 	ElasticsearchAPIKey string
 
-	// Worker configuration (for future use)
-	WebSocketWorkers     int
-	ElasticsearchWorkers int
-	WorkerTimeout        time.Duration
+	// Worker configuration (WebSocketWorkers is reserved for future use)
+	WebSocketWorkers       int
+	ElasticsearchWorkers   int
+	ElasticsearchQueueSize int
+	WorkerTimeout          time.Duration
 
 	// Spooler configuration
 	LocalSQLiteDBPath string
@@ -29,7 +30,82 @@ type Config struct {
 	S3SQLiteDBPrefix  string
 	SpoolIntervalSec  int
 	SpoolStateFile    string
+	SpoolStateBackend string
+	SpoolStateDB      string
+	SpoolStateESIndex string
+	SpoolReplicaID    string
+	SpoolLeaseTTL     time.Duration
 	AWSRegion         string
+	AWSEndpointURL    string
+	AWSProfile        string
+	S3EndpointURL     string
+	S3UsePathStyle    bool
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string
+	S3RequesterPays   bool
+	S3SQSQueueURL     string
+
+	// Polls list the keys behind the watermark too, at most once per
+	// S3FullListingInterval, to notice re-uploads of processed keys; 0
+	// disables full listings
+	S3FullListingInterval time.Duration
+
+	// Local watch mode: a file is processed once it has not changed for
+	// LocalStableSec seconds, or once its .done marker exists
+	LocalStableSec         int
+	LocalRequireDoneMarker bool
+
+	// What happens to local files once processed or failed: delete, move
+	// (into dated subdirectories of the archive and failed directories,
+	// which default to archive/ and failed/ in LocalSQLiteDBPath) or keep
+	LocalProcessedAction   string
+	LocalFailedAction      string
+	LocalArchiveDir        string
+	LocalFailedDir         string
+	LocalArchiveCompress   bool
+	LocalArchiveMaxAgeDays int
+
+	// Failed files are retried with exponential backoff from
+	// FileRetryBaseDelay up to FileRetryMaxDelay, and quarantined after
+	// FileRetryMaxAttempts attempts
+	FileRetryMaxAttempts int
+	FileRetryBaseDelay   time.Duration
+	FileRetryMaxDelay    time.Duration
+
+	// Processed entries older than StateRetentionDays are pruned once the
+	// file can no longer be listed again, and counted in per-day summaries;
+	// 0 keeps every entry
+	StateRetentionDays int
+
+	// A file found with other content than its entry was written for is
+	// processed again (reprocess) or flagged as changed (flag)
+	ChangedFilePolicy string
+
+	// S3 download pipeline
+	S3PrefetchFiles        int
+	S3StreamExtract        bool
+	S3MultipartThreshold   int
+	S3MultipartPartSize    int
+	S3MultipartConcurrency int
+
+	// Scratch space for downloaded archives and extracted databases. An
+	// empty ScratchDir uses the system temp directory without cleanup.
+	ScratchDir          string
+	ScratchMaxBytes     int
+	ScratchMinFreeBytes int
+
+	// Bulk indexing configuration. A batch is flushed when it reaches
+	// BulkBatchSize actions or BulkBatchBytes, or is BulkFlushInterval old.
+	BulkBatchSize     int
+	BulkBatchBytes    int
+	BulkFlushInterval time.Duration
+	BulkMaxRetries    int
+	BulkRetryBackoff  time.Duration
+	DeadLetterPath    string
+
+	// Embedding configuration (source_key:field_name:dims[:similarity], comma-separated)
+	EmbeddingModels string
 
 	// Logging configuration
 	LoggingEnabled bool
@@ -38,21 +114,75 @@ type Config struct {
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() *Config {
 	return &Config{
-		SQLiteDBPath:         getEnv("SQLITE_DB_PATH", ""),
-		TurboStreamURL:       getEnv("TURBOSTREAM_URL", ""),
-		WebSocketWorkers:     getEnvInt("WEBSOCKET_WORKERS", 3),
-		ElasticsearchURL:     getEnv("ELASTICSEARCH_URL", ""),
-		ElasticsearchAPIKey:  getEnv("ELASTICSEARCH_API_KEY", ""),
-		ElasticsearchWorkers: getEnvInt("ELASTICSEARCH_WORKERS", 5),
-		WorkerTimeout:        getEnvDuration("WORKER_TIMEOUT", 30*time.Second),
-		LocalSQLiteDBPath:    getEnv("LOCAL_SQLITE_DB_PATH", ""),
-		S3SQLiteDBBucket:     getEnv("S3_SQLITE_DB_BUCKET", ""),
-		S3SQLiteDBPrefix:     getEnv("S3_SQLITE_DB_PREFIX", ""),
-		SpoolIntervalSec:     getEnvInt("SPOOL_INTERVAL_SEC", 60),
-		SpoolStateFile:       getEnv("SPOOL_STATE_FILE", ".processed_files.json"),
-		AWSRegion:            getEnv("AWS_REGION", "us-east-1"),
-		LoggingEnabled:       getEnvBool("LOGGING_ENABLED", true),
+		SQLiteDBPath:           getEnv("SQLITE_DB_PATH", ""),
+		TurboStreamURL:         getEnv("TURBOSTREAM_URL", ""),
+		WebSocketWorkers:       getEnvInt("WEBSOCKET_WORKERS", 3),
+		ElasticsearchURL:       getEnv("ELASTICSEARCH_URL", ""),
+		ElasticsearchAPIKey:    getEnv("ELASTICSEARCH_API_KEY", ""),
+		ElasticsearchWorkers:   getEnvInt("ELASTICSEARCH_WORKERS", 5),
+		ElasticsearchQueueSize: getEnvInt("ELASTICSEARCH_QUEUE_SIZE", 2),
+		WorkerTimeout:          getEnvDuration("WORKER_TIMEOUT", 30*time.Second),
+		LocalSQLiteDBPath:      getEnv("LOCAL_SQLITE_DB_PATH", ""),
+		LocalStableSec:         getEnvInt("LOCAL_STABLE_SEC", 5),
+		LocalRequireDoneMarker: getEnvBool("LOCAL_REQUIRE_DONE_MARKER", false),
+		LocalProcessedAction:   getEnv("LOCAL_PROCESSED_ACTION", "delete"),
+		LocalFailedAction:      getEnv("LOCAL_FAILED_ACTION", "keep"),
+		LocalArchiveDir:        getEnv("LOCAL_ARCHIVE_DIR", ""),
+		LocalFailedDir:         getEnv("LOCAL_FAILED_DIR", ""),
+		LocalArchiveCompress:   getEnvBool("LOCAL_ARCHIVE_COMPRESS", false),
+		LocalArchiveMaxAgeDays: getEnvInt("LOCAL_ARCHIVE_MAX_AGE_DAYS", 0),
+		FileRetryMaxAttempts:   getEnvInt("FILE_RETRY_MAX_ATTEMPTS", 5),
+		FileRetryBaseDelay:     getEnvDuration("FILE_RETRY_BASE_DELAY", time.Minute),
+		FileRetryMaxDelay:      getEnvDuration("FILE_RETRY_MAX_DELAY", time.Hour),
+		StateRetentionDays:     getEnvInt("STATE_RETENTION_DAYS", 0),
+		ChangedFilePolicy:      getEnv("CHANGED_FILE_POLICY", "reprocess"),
+		S3SQLiteDBBucket:       getEnv("S3_SQLITE_DB_BUCKET", ""),
+		S3SQLiteDBPrefix:       getEnv("S3_SQLITE_DB_PREFIX", ""),
+		SpoolIntervalSec:       getEnvInt("SPOOL_INTERVAL_SEC", 60),
+		SpoolStateFile:         getEnv("SPOOL_STATE_FILE", ".processed_files.json"),
+		SpoolStateBackend:      getEnv("SPOOL_STATE_BACKEND", "json"),
+		SpoolStateDB:           getEnv("SPOOL_STATE_DB", ".processed_files.db"),
+		SpoolStateESIndex:      getEnv("SPOOL_STATE_ES_INDEX", "ingest-state"),
+		SpoolReplicaID:         getEnv("SPOOL_REPLICA_ID", defaultReplicaID()),
+		SpoolLeaseTTL:          getEnvDuration("SPOOL_LEASE_TTL", 2*time.Minute),
+		AWSRegion:              getEnv("AWS_REGION", "us-east-1"),
+		AWSEndpointURL:         getEnv("AWS_ENDPOINT_URL", ""),
+		AWSProfile:             getEnv("AWS_PROFILE", ""),
+		S3EndpointURL:          getEnv("S3_ENDPOINT_URL", ""),
+		S3UsePathStyle:         getEnvBool("S3_USE_PATH_STYLE", false),
+		S3AccessKeyID:          getEnv("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:      getEnv("S3_SECRET_ACCESS_KEY", ""),
+		S3SessionToken:         getEnv("S3_SESSION_TOKEN", ""),
+		S3RequesterPays:        getEnvBool("S3_REQUESTER_PAYS", true),
+		S3PrefetchFiles:        getEnvInt("S3_PREFETCH_FILES", 2),
+		S3StreamExtract:        getEnvBool("S3_STREAM_EXTRACT", true),
+		S3MultipartThreshold:   getEnvInt("S3_MULTIPART_THRESHOLD", 64*1024*1024),
+		S3MultipartPartSize:    getEnvInt("S3_MULTIPART_PART_SIZE", 16*1024*1024),
+		S3MultipartConcurrency: getEnvInt("S3_MULTIPART_CONCURRENCY", 4),
+		S3SQSQueueURL:          getEnv("S3_SQS_QUEUE_URL", ""),
+		S3FullListingInterval:  getEnvDuration("S3_FULL_LISTING_INTERVAL", 24*time.Hour),
+		ScratchDir:             getEnv("SCRATCH_DIR", ""),
+		ScratchMaxBytes:        getEnvInt("SCRATCH_MAX_BYTES", 4*1024*1024*1024),
+		ScratchMinFreeBytes:    getEnvInt("SCRATCH_MIN_FREE_BYTES", 256*1024*1024),
+		BulkBatchSize:          getEnvInt("BULK_BATCH_SIZE", 100),
+		BulkBatchBytes:         getEnvInt("BULK_BATCH_BYTES", 5*1024*1024),
+		BulkFlushInterval:      getEnvDuration("BULK_FLUSH_INTERVAL", 2*time.Second),
+		BulkMaxRetries:         getEnvInt("BULK_MAX_RETRIES", 5),
+		BulkRetryBackoff:       getEnvDuration("BULK_RETRY_BACKOFF", time.Second),
+		DeadLetterPath:         getEnv("DEAD_LETTER_PATH", ".dead_letter.jsonl"),
+		EmbeddingModels:        getEnv("EMBEDDING_MODELS", ""),
+		LoggingEnabled:         getEnvBool("LOGGING_ENABLED", true),
+	}
+}
+
+// defaultReplicaID identifies this process in file leases: the hostname,
+// which is the pod name on Kubernetes
+func defaultReplicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "ingest-" + strconv.Itoa(os.Getpid())
 	}
+	return hostname
 }
 
 // getEnv returns the value of an environment variable or a default value
@@ -24,6 +24,43 @@ func TestLoadConfig_Defaults(t *testing.T) {
 		t.Errorf("Expected default WorkerTimeout to be 30s, got %v", config.WorkerTimeout)
 	}
 
+	if config.BulkBatchSize != 100 || config.BulkBatchBytes != 5*1024*1024 || config.BulkFlushInterval != 2*time.Second {
+		t.Errorf("Expected default bulk limits of 100 actions, 5MB and 2s, got %d, %d, %v", config.BulkBatchSize, config.BulkBatchBytes, config.BulkFlushInterval)
+	}
+
+	if !config.S3RequesterPays || config.S3UsePathStyle {
+		t.Errorf("Expected S3 requester-pays on and path-style off by default, got %v and %v", config.S3RequesterPays, config.S3UsePathStyle)
+	}
+
+	if config.LocalStableSec != 5 || config.LocalRequireDoneMarker {
+		t.Errorf("Expected local files to settle for 5s without a marker by default, got %d and %v", config.LocalStableSec, config.LocalRequireDoneMarker)
+	}
+
+	if config.LocalProcessedAction != "delete" || config.LocalFailedAction != "keep" {
+		t.Errorf("Expected processed local files to be deleted and failed ones kept by default, got %s and %s", config.LocalProcessedAction, config.LocalFailedAction)
+	}
+
+	if config.FileRetryMaxAttempts != 5 || config.FileRetryBaseDelay != time.Minute || config.FileRetryMaxDelay != time.Hour {
+		t.Errorf("Expected failed files to be retried 5 times from 1m up to 1h, got %d, %v and %v", config.FileRetryMaxAttempts, config.FileRetryBaseDelay, config.FileRetryMaxDelay)
+	}
+	if config.StateRetentionDays != 0 {
+		t.Errorf("Expected state entries to be kept forever by default, got %d days", config.StateRetentionDays)
+	}
+	if config.ChangedFilePolicy != "reprocess" {
+		t.Errorf("Expected changed files to be reprocessed by default, got %s", config.ChangedFilePolicy)
+	}
+	if config.S3FullListingInterval != 24*time.Hour {
+		t.Errorf("Expected a full S3 listing every 24h by default, got %v", config.S3FullListingInterval)
+	}
+
+	if config.SpoolStateBackend != "json" || config.SpoolStateDB != ".processed_files.db" {
+		t.Errorf("Expected JSON state by default, got %s and %s", config.SpoolStateBackend, config.SpoolStateDB)
+	}
+
+	if config.SpoolStateESIndex != "ingest-state" || config.SpoolLeaseTTL != 2*time.Minute || config.SpoolReplicaID == "" {
+		t.Errorf("Expected shared state in ingest-state with 2m leases, got %s, %v and %q", config.SpoolStateESIndex, config.SpoolLeaseTTL, config.SpoolReplicaID)
+	}
+
 	if !config.LoggingEnabled {
 		t.Error("Expected default LoggingEnabled to be true")
 	}
@@ -36,6 +73,8 @@ func TestLoadConfig_FromEnvironment(t *testing.T) {
 	os.Setenv("WEBSOCKET_WORKERS", "10")
 	os.Setenv("ELASTICSEARCH_WORKERS", "15")
 	os.Setenv("WORKER_TIMEOUT", "45s")
+	os.Setenv("BULK_BATCH_BYTES", "1048576")
+	os.Setenv("BULK_FLUSH_INTERVAL", "500ms")
 	os.Setenv("LOGGING_ENABLED", "false")
 	os.Setenv("PORT", "3000")
 
@@ -63,6 +102,10 @@ func TestLoadConfig_FromEnvironment(t *testing.T) {
 		t.Errorf("Expected WorkerTimeout from env to be 45s, got %v", config.WorkerTimeout)
 	}
 
+	if config.BulkBatchBytes != 1048576 || config.BulkFlushInterval != 500*time.Millisecond {
+		t.Errorf("Expected bulk limits from env, got %d bytes and %v", config.BulkBatchBytes, config.BulkFlushInterval)
+	}
+
 	if config.LoggingEnabled {
 		t.Error("Expected LoggingEnabled from env to be false")
 	}
@@ -104,6 +147,14 @@ func clearEnvVars() {
 		"WEBSOCKET_WORKERS",
 		"ELASTICSEARCH_WORKERS",
 		"WORKER_TIMEOUT",
+		"BULK_BATCH_BYTES",
+		"BULK_FLUSH_INTERVAL",
+		"S3_USE_PATH_STYLE",
+		"S3_REQUESTER_PAYS",
+		"LOCAL_STABLE_SEC",
+		"LOCAL_REQUIRE_DONE_MARKER",
+		"LOCAL_PROCESSED_ACTION",
+		"LOCAL_FAILED_ACTION",
 		"LOGGING_ENABLED",
 		"PORT",
 	}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangedContentPolicy decides what happens to a file whose content no
+// longer matches the fingerprint its entry was written for, such as an S3
+// object re-uploaded with corrected contents
+type ChangedContentPolicy string
+
+const (
+	// ChangedContentReprocess makes the file due for processing again, from
+	// its first row
+	ChangedContentReprocess ChangedContentPolicy = "reprocess"
+	// ChangedContentFlag marks the file changed and skips it until it is
+	// retried with the state command
+	ChangedContentFlag ChangedContentPolicy = "flag"
+)
+
+// parseChangedContentPolicy validates a changed content policy
+func parseChangedContentPolicy(value string) (ChangedContentPolicy, error) {
+	switch policy := ChangedContentPolicy(value); policy {
+	case ChangedContentReprocess, ChangedContentFlag:
+		return policy, nil
+	case "":
+		return ChangedContentReprocess, nil
+	}
+	return "", fmt.Errorf("invalid changed file policy %q (must be reprocess or flag)", value)
+}
+
+// s3Fingerprint identifies the content of an S3 object by its ETag and size.
+// Listings and HeadObject quote the ETag, notifications do not.
+func s3Fingerprint(etag string, size int64) string {
+	return fmt.Sprintf("etag:%s:size:%d", strings.Trim(etag, `"`), size)
+}
+
+// sha256Fingerprint identifies the content of a local file by its SHA-256
+// digest
+func sha256Fingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fingerprintCache remembers the digests of local files, so that a file is
+// only hashed again once its size or modification time changes
+type fingerprintCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedFingerprint
+}
+
+type cachedFingerprint struct {
+	size        int64
+	modTime     time.Time
+	fingerprint string
+}
+
+func newFingerprintCache() *fingerprintCache {
+	return &fingerprintCache{entries: make(map[string]cachedFingerprint)}
+}
+
+// fingerprint returns the SHA-256 fingerprint of the file at path
+func (c *fingerprintCache) fingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	c.mu.Lock()
+	cached, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.fingerprint, nil
+	}
+
+	fingerprint, err := sha256Fingerprint(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[path] = cachedFingerprint{size: info.Size(), modTime: info.ModTime(), fingerprint: fingerprint}
+	c.mu.Unlock()
+	return fingerprint, nil
+}
+
+// prune forgets the files not in keep
+func (c *fingerprintCache) prune(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.entries {
+		if !keep[path] {
+			delete(c.entries, path)
+		}
+	}
+}
+
+// SetChangedContentPolicy replaces the policy applied by later calls to
+// Observe
+func (sm *StateManager) SetChangedContentPolicy(policy ChangedContentPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.changed = policy
+}
+
+// Observe records the fingerprint of the content found at key, which the
+// entry of key is written with from then on. If the entry was written for
+// other content, the changed content policy applies: the file is made due
+// for processing again, or flagged as changed.
+func (sm *StateManager) Observe(key, fingerprint string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	entry, exists := sm.entryUnsafe(key)
+	if exists && entry.Fingerprint != "" && entry.Fingerprint != fingerprint && entry.Status != FileStatusChanged {
+		if err := sm.contentChangedUnsafe(key, entry, fingerprint); err != nil {
+			return err
+		}
+		entry = sm.state[key]
+	}
+
+	// Only files that will be attempted need their fingerprint until their
+	// entry is written
+	if !exists || entry.Status == FileStatusFailed || entry.Status == FileStatusInProgress {
+		sm.fingerprints[key] = fingerprint
+	}
+	return nil
+}
+
+func (sm *StateManager) contentChangedUnsafe(key string, prev FileStateEntry, fingerprint string) error {
+	now := sm.now().UTC()
+	reason := fmt.Sprintf("content changed since the file was %s: was %s, now %s", prev.Status, prev.Fingerprint, fingerprint)
+
+	if sm.changed == ChangedContentFlag {
+		if err := sm.putUnsafe(FileStateEntry{
+			Filename:    key,
+			Status:      FileStatusChanged,
+			Timestamp:   now,
+			Error:       reason,
+			Attempts:    prev.Attempts,
+			Fingerprint: prev.Fingerprint,
+		}); err != nil {
+			return err
+		}
+		sm.logger.Error("Flagged changed file: %s - %s", key, reason)
+		return nil
+	}
+
+	// The checkpoint belongs to the old content, so the file starts over
+	if err := sm.putUnsafe(FileStateEntry{
+		Filename:    key,
+		Status:      FileStatusFailed,
+		Timestamp:   now,
+		Error:       reason,
+		NextRetry:   now,
+		Fingerprint: fingerprint,
+	}); err != nil {
+		return err
+	}
+	sm.logger.Info("Processing changed file again: %s - %s", key, reason)
+	return nil
+}
+
+// IsChanged reports whether the file was flagged because its content changed
+func (sm *StateManager) IsChanged(key string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.entryUnsafe(key)
+	return exists && entry.Status == FileStatusChanged
+}
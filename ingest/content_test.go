@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateManager_ObserveChangedContent(t *testing.T) {
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	key := "a/mega_1.db.zip"
+	observe := func(fingerprint string) {
+		t.Helper()
+		if err := sm.Observe(key, fingerprint); err != nil {
+			t.Fatalf("Failed to observe content: %v", err)
+		}
+	}
+
+	observe("etag:1:size:10")
+	if err := sm.SetProgress(key, FileProgress{LastRowid: 1000, RowsAcked: 1000}); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+	if err := sm.MarkProcessed(key); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	observe("etag:1:size:10")
+	if entry, _ := sm.Entry(key); !sm.IsProcessed(key) || entry.Fingerprint != "etag:1:size:10" {
+		t.Fatalf("Expected unchanged content to stay processed, got %+v", entry)
+	}
+
+	// Under the default policy, new content is due at once, from the start
+	observe("etag:2:size:12")
+	if sm.IsProcessed(key) || !sm.RetryDue(key) {
+		t.Error("Expected changed content to be processed again")
+	}
+	if _, ok := sm.Progress(key); ok {
+		t.Error("Expected the checkpoint of the old content to be dropped")
+	}
+	if err := sm.MarkProcessed(key); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if entry, _ := sm.Entry(key); entry.Fingerprint != "etag:2:size:12" {
+		t.Errorf("Expected the entry to be written for the new content, got %q", entry.Fingerprint)
+	}
+
+	// Under the flag policy, it waits for a retry
+	sm.SetChangedContentPolicy(ChangedContentFlag)
+	observe("etag:3:size:14")
+	if !sm.IsChanged(key) || sm.IsProcessed(key) || sm.RetryDue(key) {
+		t.Fatal("Expected changed content to be flagged")
+	}
+	observe("etag:3:size:14")
+	if !sm.IsChanged(key) {
+		t.Error("Expected the file to stay flagged")
+	}
+	if err := sm.Retry(key); err != nil {
+		t.Fatalf("Failed to retry file: %v", err)
+	}
+	observe("etag:3:size:14")
+	if !sm.RetryDue(key) {
+		t.Fatal("Expected a retried changed file to be due")
+	}
+	if err := sm.MarkProcessed(key); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if entry, _ := sm.Entry(key); entry.Fingerprint != "etag:3:size:14" {
+		t.Errorf("Expected the entry to be written for the retried content, got %q", entry.Fingerprint)
+	}
+}
+
+func TestStateManager_KeysS3ObjectsByFullKey(t *testing.T) {
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	if err := sm.MarkProcessed("a/mega_1.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if sm.IsProcessed("b/mega_1.db.zip") {
+		t.Error("Expected the same file name under another prefix not to collide")
+	}
+
+	// An entry of an earlier version, keyed by base name, goes to the first
+	// key adopting it
+	if err := sm.MarkProcessed("mega_2.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	for _, key := range []string{"a/mega_2.db.zip", "b/mega_2.db.zip"} {
+		if err := sm.AdoptLegacyEntry(key); err != nil {
+			t.Fatalf("Failed to adopt legacy entry: %v", err)
+		}
+	}
+	if !sm.IsProcessed("a/mega_2.db.zip") {
+		t.Error("Expected the legacy entry to apply to the key adopting it")
+	}
+	if sm.IsProcessed("b/mega_2.db.zip") {
+		t.Error("Expected the legacy entry not to apply to the same name under another prefix")
+	}
+	if _, exists := sm.Entry("mega_2.db.zip"); exists {
+		t.Error("Expected the legacy entry to be moved")
+	}
+}
+
+func TestS3Spooler_AdoptsLegacyEntryForOnePrefix(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	s3Client := &fakeS3{objects: map[string][]byte{
+		"a/mega_1.db.zip": zipData,
+		"b/mega_1.db.zip": zipData,
+	}, pageSize: 10}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	if err := sm.MarkProcessed("mega_1.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+
+	spooler := newS3SpoolerWithClient(s3Client, "bucket", []string{"a/", "b/"}, "once", time.Millisecond, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	count := drainAndAck(t, spooler, nil)
+	spooler.Stop()
+
+	if count != 2 {
+		t.Errorf("Expected only the key under the second prefix to be processed, got %d rows", count)
+	}
+	if !sm.IsProcessed("a/mega_1.db.zip") || !sm.IsProcessed("b/mega_1.db.zip") {
+		t.Error("Expected both keys to be processed")
+	}
+}
+
+func TestLocalSpooler_ReprocessesChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "mega_1.db.zip")
+	createTestZip(t, filePath, 2)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	run := func() int {
+		spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+		spooler.postProcess.OnSuccess = PostProcessKeep
+		if err := spooler.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start spooler: %v", err)
+		}
+		count := drainAndAck(t, spooler, nil)
+		spooler.Stop()
+		return count
+	}
+
+	if count := run(); count != 2 {
+		t.Fatalf("Expected 2 rows, got %d", count)
+	}
+	if count := run(); count != 0 {
+		t.Errorf("Expected a kept file with the same content to be skipped, got %d rows", count)
+	}
+
+	createTestZip(t, filePath, 3)
+	if count := run(); count != 3 {
+		t.Errorf("Expected the rewritten file to be processed again, got %d rows", count)
+	}
+	fingerprint, err := sha256Fingerprint(filePath)
+	if err != nil {
+		t.Fatalf("Failed to hash file: %v", err)
+	}
+	if entry, _ := sm.Entry("mega_1.db.zip"); entry.Status != FileStatusProcessed || entry.Fingerprint != fingerprint {
+		t.Errorf("Expected the entry to be written for the new content, got %+v", entry)
+	}
+}
+
+func TestS3Spooler_FlagsReuploadedFile(t *testing.T) {
+	logger := NewLogger(false)
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	createTestZip(t, zipPath, 3)
+	corrected, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	key := "a/mega_1.db.zip"
+	s3Client := &fakeS3{objects: map[string][]byte{key: zipData}, pageSize: 10}
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	sm.SetChangedContentPolicy(ChangedContentFlag)
+
+	announce := func(id string, data []byte) int {
+		queue := &fakeSQS{}
+		queue.send(id, fmt.Sprintf(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"bucket"},"object":{"key":%q,"size":%d,"eTag":"%x"}}}]}`, key, len(data), md5.Sum(data)))
+		spooler := newS3SpoolerWithClient(s3Client, "bucket", []string{"a/"}, "once", time.Millisecond, sm, logger)
+		spooler.notifications = newS3Notifications(queue, "https://sqs.local/queue", logger)
+		if err := spooler.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start spooler: %v", err)
+		}
+		count := drainAndAck(t, spooler, nil)
+		spooler.Stop()
+		return count
+	}
+
+	if count := announce("m1", zipData); count != 2 {
+		t.Fatalf("Expected 2 rows, got %d", count)
+	}
+	if count := announce("m2", zipData); count != 0 {
+		t.Errorf("Expected a repeated notification to be skipped, got %d rows", count)
+	}
+
+	s3Client.objects[key] = corrected
+	if count := announce("m3", corrected); count != 0 {
+		t.Errorf("Expected the re-uploaded file to be held, got %d rows", count)
+	}
+	if !sm.IsChanged(key) {
+		t.Fatal("Expected the re-uploaded file to be flagged")
+	}
+
+	if err := sm.Retry(key); err != nil {
+		t.Fatalf("Failed to retry file: %v", err)
+	}
+	if count := announce("m4", corrected); count != 3 {
+		t.Errorf("Expected the retried file to be processed, got %d rows", count)
+	}
+	if !sm.IsProcessed(key) {
+		t.Error("Expected the retried file to be processed")
+	}
+}
+
+func TestS3Spooler_FullListingFindsReuploadedKey(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	createTestZip(t, zipPath, 3)
+	corrected, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	s3Client := &fakeS3{objects: map[string][]byte{
+		"a/mega_1.db.zip": zipData,
+		"a/mega_2.db.zip": zipData,
+		"a/mega_3.db.zip": zipData,
+	}, pageSize: 10}
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	poll := func(fullListing time.Duration) int {
+		spooler := newS3SpoolerWithClient(s3Client, "bucket", []string{"a/"}, "once", time.Millisecond, sm, NewLogger(false))
+		spooler.fullListing = fullListing
+		if err := spooler.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start spooler: %v", err)
+		}
+		count := drainAndAck(t, spooler, nil)
+		spooler.Stop()
+		return count
+	}
+
+	if count := poll(0); count != 6 {
+		t.Fatalf("Expected 6 rows, got %d", count)
+	}
+	poll(0)
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_3.db.zip" {
+		t.Fatalf("Expected the watermark to pass every key, got %q", got)
+	}
+
+	// mega_2 is re-uploaded, and the entry of mega_3 pruned
+	s3Client.objects["a/mega_2.db.zip"] = corrected
+	if err := sm.Forget("a/mega_3.db.zip"); err != nil {
+		t.Fatalf("Failed to forget file: %v", err)
+	}
+	if count := poll(0); count != 0 {
+		t.Errorf("Expected keys behind the watermark not to be listed, got %d rows", count)
+	}
+
+	if count := poll(time.Hour); count != 3 {
+		t.Errorf("Expected a full listing to process the re-uploaded key alone, got %d rows", count)
+	}
+	if entry, _ := sm.Entry("a/mega_2.db.zip"); entry.Status != FileStatusProcessed || entry.Fingerprint != s3Fingerprint(fmt.Sprintf(`"%x"`, md5.Sum(corrected)), int64(len(corrected))) {
+		t.Errorf("Expected the entry to be written for the new content, got %+v", entry)
+	}
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_3.db.zip" {
+		t.Errorf("Expected the watermark to be kept, got %q", got)
+	}
+}
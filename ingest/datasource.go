@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AckToken identifies the unit of work a Record belongs to, such as a source
+// file or a stream position. Records are acknowledged back to their DataSource
+// by token.
+type AckToken uint64
+
+// Record is a single post read from a DataSource, in the Megastream row shape
+type Record struct {
+	AtURI      string
+	DID        string
+	RawPost    string
+	Inferences string
+	Source     string
+	Token      AckToken
+}
+
+// Ack acknowledges Count records sharing a token. A non-nil Err reports that
+// those records failed to index.
+type Ack struct {
+	Token AckToken
+	Count int
+	Err   error
+}
+
+// DataSourceOptions holds everything a DataSource factory may need
+type DataSourceOptions struct {
+	Config       *Config
+	Mode         string
+	StateManager *StateManager
+	Logger       *IngestLogger
+}
+
+// DataSourceFactory validates its configuration and creates a DataSource
+type DataSourceFactory func(opts DataSourceOptions) (DataSource, error)
+
+var dataSourceFactories = make(map[string]DataSourceFactory)
+
+// RegisterDataSource makes a DataSource available under the given -source name
+func RegisterDataSource(name string, factory DataSourceFactory) {
+	if _, exists := dataSourceFactories[name]; exists {
+		panic(fmt.Sprintf("data source %q registered twice", name))
+	}
+	dataSourceFactories[name] = factory
+}
+
+// DataSourceNames returns the names of all registered data sources in sorted order
+func DataSourceNames() []string {
+	names := make([]string, 0, len(dataSourceFactories))
+	for name := range dataSourceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDataSource creates the data source registered under name
+func NewDataSource(name string, opts DataSourceOptions) (DataSource, error) {
+	factory, ok := dataSourceFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid source: %s (must be one of: %s)", name, strings.Join(DataSourceNames(), ", "))
+	}
+	return factory(opts)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDataSourceNames_IncludesBuiltins(t *testing.T) {
+	names := strings.Join(DataSourceNames(), ",")
+
+	for _, expected := range []string{"local", "s3", "websocket"} {
+		if !strings.Contains(names, expected) {
+			t.Errorf("Expected %q to be registered, got %s", expected, names)
+		}
+	}
+}
+
+func TestNewDataSource_UnknownSource(t *testing.T) {
+	_, err := NewDataSource("ftp", DataSourceOptions{Config: &Config{}, Logger: NewLogger(false)})
+	if err == nil {
+		t.Fatal("Expected error for unknown source")
+	}
+
+	if !strings.Contains(err.Error(), "local") {
+		t.Errorf("Expected error to list registered sources, got: %v", err)
+	}
+}
+
+func TestNewDataSource_ValidatesConfig(t *testing.T) {
+	logger := NewLogger(false)
+
+	for _, name := range []string{"local", "s3", "websocket"} {
+		if _, err := NewDataSource(name, DataSourceOptions{Config: &Config{}, Logger: logger}); err == nil {
+			t.Errorf("Expected %s source to reject empty configuration", name)
+		}
+	}
+}
+
+func TestNewDataSource_Local(t *testing.T) {
+	logger := NewLogger(false)
+	config := &Config{LocalSQLiteDBPath: t.TempDir(), SpoolIntervalSec: 1}
+
+	source, err := NewDataSource("local", DataSourceOptions{Config: config, Mode: "once", Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to create local data source: %v", err)
+	}
+
+	if _, ok := source.(*LocalSpooler); !ok {
+		t.Errorf("Expected *LocalSpooler, got %T", source)
+	}
+}
+
+func TestNewDataSource_LocalSkipsStateFiles(t *testing.T) {
+	logger := NewLogger(false)
+	dir := t.TempDir()
+	config := &Config{
+		LocalSQLiteDBPath: dir,
+		SpoolIntervalSec:  1,
+		SpoolStateDB:      filepath.Join(dir, ".processed_files.db"),
+	}
+	for _, name := range []string{".processed_files.db", "mega.db"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	source, err := NewDataSource("local", DataSourceOptions{Config: config, Mode: "once", StateManager: sm, Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to create local data source: %v", err)
+	}
+
+	files, err := source.(*LocalSpooler).discoverFiles()
+	if err != nil {
+		t.Fatalf("Failed to discover files: %v", err)
+	}
+	if len(files) != 1 || files[0] != "mega.db" {
+		t.Errorf("Expected only mega.db to be discovered, got %v", files)
+	}
+}
+
+func TestNewDataSource_WebSocketRequiresSpoolMode(t *testing.T) {
+	logger := NewLogger(false)
+	config := &Config{TurboStreamURL: "ws://unused"}
+
+	for _, mode := range []string{"once", "watch"} {
+		if _, err := NewDataSource("websocket", DataSourceOptions{Config: config, Mode: mode, Logger: logger}); err == nil {
+			t.Errorf("Expected websocket source to reject %s mode", mode)
+		}
+	}
+
+	source, err := NewDataSource("websocket", DataSourceOptions{Config: config, Mode: "spool", Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to create websocket data source: %v", err)
+	}
+	source.Stop()
+}
+
+func TestRegisterDataSource_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic when registering a duplicate data source")
+		}
+	}()
+
+	RegisterDataSource("local", newLocalDataSource)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetterEntry is a bulk action that Elasticsearch rejected permanently,
+// stored together with the source row so it can be replayed later
+type DeadLetterEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Op          string    `json:"op"`
+	ID          string    `json:"id"`
+	Version     int64     `json:"version,omitempty"`
+	Status      int       `json:"status"`
+	ErrorType   string    `json:"error_type,omitempty"`
+	ErrorReason string    `json:"error_reason,omitempty"`
+
+	// Source row, empty if the action was not built from a Record
+	AtURI      string `json:"at_uri,omitempty"`
+	DID        string `json:"did,omitempty"`
+	RawPost    string `json:"raw_post,omitempty"`
+	Inferences string `json:"inferences,omitempty"`
+	Source     string `json:"source,omitempty"`
+}
+
+// NewDeadLetterEntry creates an entry for action rejected with the given error
+func NewDeadLetterEntry(action BulkAction, status int, errorType, errorReason string) DeadLetterEntry {
+	entry := DeadLetterEntry{
+		Timestamp:   time.Now().UTC(),
+		Op:          action.Op,
+		ID:          action.ID,
+		Version:     action.Version,
+		Status:      status,
+		ErrorType:   errorType,
+		ErrorReason: errorReason,
+	}
+
+	if action.Record != nil {
+		entry.AtURI = action.Record.AtURI
+		entry.DID = action.Record.DID
+		entry.RawPost = action.Record.RawPost
+		entry.Inferences = action.Record.Inferences
+		entry.Source = action.Record.Source
+	}
+
+	return entry
+}
+
+// Record returns the source row of the entry, or nil if it has none
+func (e DeadLetterEntry) Record() *Record {
+	if e.AtURI == "" {
+		return nil
+	}
+	return &Record{
+		AtURI:      e.AtURI,
+		DID:        e.DID,
+		RawPost:    e.RawPost,
+		Inferences: e.Inferences,
+		Source:     e.Source,
+	}
+}
+
+// DeadLetterQueue appends dead-letter entries to a JSONL file
+type DeadLetterQueue struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewDeadLetterQueue opens (or creates) the JSONL file at path for appending
+func NewDeadLetterQueue(path string) (*DeadLetterQueue, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter queue: %w", err)
+	}
+
+	return &DeadLetterQueue{path: path, file: file}, nil
+}
+
+// Path returns the file the queue writes to
+func (q *DeadLetterQueue) Path() string {
+	return q.path
+}
+
+// Write appends entries and syncs the file, so that a batch is only
+// acknowledged once its failures are durably recorded
+func (q *DeadLetterQueue) Write(entries []DeadLetterEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead-letter entry: %w", err)
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.lockCurrentUnsafe(); err != nil {
+		return err
+	}
+	defer unlockFile(q.file)
+
+	if _, err := q.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write dead-letter queue: %w", err)
+	}
+
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dead-letter queue: %w", err)
+	}
+
+	return nil
+}
+
+// lockCurrentUnsafe locks the queue's file, first reopening the path if the
+// file was moved aside by MoveDeadLetters, so that entries are never appended
+// to a file that is being replayed
+func (q *DeadLetterQueue) lockCurrentUnsafe() error {
+	for {
+		if err := lockFile(q.file); err != nil {
+			return fmt.Errorf("failed to lock dead-letter queue: %w", err)
+		}
+
+		current, err := q.file.Stat()
+		if err != nil {
+			unlockFile(q.file)
+			return fmt.Errorf("failed to stat dead-letter queue: %w", err)
+		}
+		if latest, err := os.Stat(q.path); err == nil && os.SameFile(current, latest) {
+			return nil
+		}
+
+		unlockFile(q.file)
+		q.file.Close()
+		file, err := os.OpenFile(q.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to reopen dead-letter queue: %w", err)
+		}
+		q.file = file
+	}
+}
+
+// Close closes the underlying file
+func (q *DeadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+// MoveDeadLetters renames the dead-letter file at path to dest under the
+// queue's lock. Queues writing to path, including those of running
+// ingesters, finish their current write first and append to a fresh file at
+// path afterwards, so every entry in dest is complete and none is added later.
+func MoveDeadLetters(path, dest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter queue: %w", err)
+	}
+	defer file.Close()
+
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("failed to lock dead-letter queue: %w", err)
+	}
+	defer unlockFile(file)
+
+	if err := os.Rename(path, dest); err != nil {
+		return fmt.Errorf("failed to move dead-letter queue aside: %w", err)
+	}
+	return nil
+}
+
+// ReadDeadLetters reads every entry from a dead-letter JSONL file
+func ReadDeadLetters(path string) ([]DeadLetterEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter queue: %w", err)
+	}
+	defer file.Close()
+
+	var entries []DeadLetterEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry DeadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse dead-letter entry on line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter queue: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueue_AppendsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.jsonl")
+
+	for i, id := range []string{"at://a", "at://b"} {
+		queue, err := NewDeadLetterQueue(path)
+		if err != nil {
+			t.Fatalf("Failed to open dead-letter queue: %v", err)
+		}
+		entry := NewDeadLetterEntry(NewDeleteAction(id, int64(i+1)), http.StatusBadRequest, "illegal_argument_exception", "bad")
+		if err := queue.Write([]DeadLetterEntry{entry}); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+		queue.Close()
+	}
+
+	entries, err := ReadDeadLetters(path)
+	if err != nil {
+		t.Fatalf("Failed to read dead-letter queue: %v", err)
+	}
+
+	if len(entries) != 2 || entries[0].ID != "at://a" || entries[1].ID != "at://b" {
+		t.Errorf("Expected both entries in order, got %+v", entries)
+	}
+}
+
+func TestDeadLetterQueue_FollowsPathAfterMove(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dlq.jsonl")
+	replayPath := path + ".replaying"
+
+	// An ingester's queue keeps writing while replay-dlq moves the file aside
+	queue, err := NewDeadLetterQueue(path)
+	if err != nil {
+		t.Fatalf("Failed to open dead-letter queue: %v", err)
+	}
+	defer queue.Close()
+
+	write := func(id string) {
+		entry := NewDeadLetterEntry(NewDeleteAction(id, 1), http.StatusBadRequest, "illegal_argument_exception", "bad")
+		if err := queue.Write([]DeadLetterEntry{entry}); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+
+	write("at://before")
+	if err := MoveDeadLetters(path, replayPath); err != nil {
+		t.Fatalf("Failed to move dead-letter queue: %v", err)
+	}
+	write("at://after")
+
+	for file, want := range map[string]string{replayPath: "at://before", path: "at://after"} {
+		entries, err := ReadDeadLetters(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if len(entries) != 1 || entries[0].ID != want {
+			t.Errorf("Expected %s to hold only %s, got %+v", file, want, entries)
+		}
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, op+" "+id)
+		if id == "at://still-bad" {
+			return http.StatusBadRequest, "mapper_parsing_exception"
+		}
+		return http.StatusCreated, ""
+	})
+
+	dir := t.TempDir()
+	replayPath := filepath.Join(dir, "dlq.jsonl.replaying")
+	original, err := NewDeadLetterQueue(replayPath)
+	if err != nil {
+		t.Fatalf("Failed to create dead-letter queue: %v", err)
+	}
+
+	fixed := NewIndexAction(ElasticsearchDoc{}, 0)
+	fixed.ID = "at://fixed"
+	fixed.Record = &Record{AtURI: "at://fixed", DID: "did:plc:a", RawPost: `{"message":{"time_us":10,"commit":{"operation":"create","record":{"text":"hi"}}}}`, Inferences: "{}"}
+
+	stillBad := NewIndexAction(ElasticsearchDoc{}, 0)
+	stillBad.ID = "at://still-bad"
+	stillBad.Record = &Record{AtURI: "at://still-bad", DID: "did:plc:b", RawPost: `{"message":{}}`, Inferences: "{}"}
+
+	original.Write([]DeadLetterEntry{
+		NewDeadLetterEntry(fixed, http.StatusBadRequest, "mapper_parsing_exception", "old mapping"),
+		NewDeadLetterEntry(stillBad, http.StatusBadRequest, "mapper_parsing_exception", "old mapping"),
+		NewDeadLetterEntry(NewDeleteAction("at://gone", 7), http.StatusBadRequest, "illegal_argument_exception", "bad"),
+		NewDeadLetterEntry(NewIndexAction(ElasticsearchDoc{AtURI: "at://no-source"}, 0), http.StatusBadRequest, "mapper_parsing_exception", "bad"),
+	})
+	original.Close()
+
+	requeue, err := NewDeadLetterQueue(filepath.Join(dir, "dlq.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to create requeue: %v", err)
+	}
+	defer requeue.Close()
+
+	logger := NewLogger(false)
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{RetryBackoff: time.Millisecond, DeadLetters: requeue}, nil, logger)
+
+	replayed, err := ReplayDeadLetters(context.Background(), replayPath, indexer, requeue, DefaultEmbeddingModelRegistry(), nil, logger)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if replayed != 3 {
+		t.Errorf("Expected 3 replayed actions, got %d", replayed)
+	}
+
+	if len(sent) != 3 || sent[0] != "index at://fixed" || sent[2] != "delete at://gone" {
+		t.Errorf("Unexpected replayed actions: %v", sent)
+	}
+
+	remaining, err := ReadDeadLetters(requeue.Path())
+	if err != nil {
+		t.Fatalf("Failed to read requeue: %v", err)
+	}
+
+	ids := make(map[string]bool)
+	for _, entry := range remaining {
+		ids[entry.ID] = true
+	}
+	if len(remaining) != 2 || !ids["at://still-bad"] || !ids["at://no-source"] {
+		t.Errorf("Expected still-failing and unreplayable entries to be requeued, got %+v", remaining)
+	}
+
+	if _, err := os.Stat(replayPath); err != nil {
+		t.Errorf("Expected ReplayDeadLetters to leave removal of the replayed file to the caller: %v", err)
+	}
+}
+
+func TestReplayDeadLetters_ResumesFromCheckpoint(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, op+" "+id)
+		if id == "at://bad-2" {
+			return http.StatusBadRequest, "illegal_argument_exception"
+		}
+		return http.StatusOK, ""
+	})
+
+	dir := t.TempDir()
+	replayPath := filepath.Join(dir, "dlq.jsonl.replaying")
+	original, err := NewDeadLetterQueue(replayPath)
+	if err != nil {
+		t.Fatalf("Failed to create dead-letter queue: %v", err)
+	}
+	var entries []DeadLetterEntry
+	for i := range 2*replayBatchSize + 1 {
+		entries = append(entries, NewDeadLetterEntry(NewDeleteAction(fmt.Sprintf("at://bad-%d", i), 1), http.StatusBadRequest, "illegal_argument_exception", "bad"))
+	}
+	original.Write(entries)
+	original.Close()
+
+	requeue, err := NewDeadLetterQueue(filepath.Join(dir, "dlq.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to create requeue: %v", err)
+	}
+	defer requeue.Close()
+
+	// An earlier run finished the first batch, and dead-lettered at://bad-102
+	// again before it was interrupted in the second
+	if err := writeReplayCheckpoint(replayPath, replayBatchSize); err != nil {
+		t.Fatalf("Failed to write checkpoint: %v", err)
+	}
+	requeue.Write(entries[replayBatchSize+2 : replayBatchSize+3])
+
+	logger := NewLogger(false)
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{RetryBackoff: time.Millisecond, DeadLetters: requeue}, nil, logger)
+
+	replayed, err := ReplayDeadLetters(context.Background(), replayPath, indexer, requeue, DefaultEmbeddingModelRegistry(), nil, logger)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if replayed != replayBatchSize || len(sent) != replayBatchSize || sent[0] != "delete at://bad-100" {
+		t.Errorf("Expected the %d entries after the checkpoint but one to be replayed, got %d: %v", replayBatchSize, replayed, sent)
+	}
+
+	remaining, err := ReadDeadLetters(requeue.Path())
+	if err != nil {
+		t.Fatalf("Failed to read requeue: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != "at://bad-102" {
+		t.Errorf("Expected the interrupted entry to be queued once, got %+v", remaining)
+	}
+
+	if offset, err := readReplayCheckpoint(replayPath); err != nil || offset != len(entries) {
+		t.Errorf("Expected the checkpoint at %d, got %d (%v)", len(entries), offset, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -21,7 +22,7 @@ type ElasticsearchDoc struct {
 	ThreadRootPost   string               `json:"thread_root_post,omitempty"`
 	ThreadParentPost string               `json:"thread_parent_post,omitempty"`
 	QuotePost        string               `json:"quote_post,omitempty"`
-	Embeddings       map[string][]float32 `json:"embeddings,omitempty"`
+	Embeddings       map[string][]float32 `json:"embeddings,omitempty"` // keyed by EmbeddingModel.FieldName
 	IndexedAt        string               `json:"indexed_at"`
 }
 
@@ -63,91 +64,390 @@ func NewElasticsearchClient(config ElasticsearchConfig, logger *IngestLogger) (*
 	return client, nil
 }
 
-// bulkIndex indexes a batch of documents to Elasticsearch
-func bulkIndex(ctx context.Context, client *elasticsearch.Client, index string, docs []ElasticsearchDoc, dryRun bool, logger *IngestLogger) error {
-	if len(docs) == 0 {
-		return nil
+// Bulk action operations
+const (
+	BulkOpIndex  = "index"
+	BulkOpDelete = "delete"
+)
+
+// BulkAction is a single index or delete operation in a bulk request.
+// Actions are sent in the order they were appended so that a create and a
+// later delete of the same at_uri are applied in sequence. A positive Version
+// is sent as an external version, so Elasticsearch rejects actions that are
+// older than the document it already holds. A deleted document's version is
+// only kept for the index's gc_deletes period, which the posts index templates
+// raise so that replays within it cannot resurrect deleted posts.
+type BulkAction struct {
+	Op      string
+	ID      string
+	Version int64
+	Doc     *ElasticsearchDoc
+
+	// Record is the source row the action was built from, kept so that
+	// permanently failed actions can be dead-lettered and replayed
+	Record *Record
+
+	// body caches the serialized document once its size has been measured
+	body []byte
+}
+
+// encodedSize returns the approximate number of bytes the action adds to a
+// bulk request body, serializing and caching its document if necessary
+func (a *BulkAction) encodedSize() int {
+	const metaSize = 128 // action metadata line, including index, id and version
+
+	if a.Op != BulkOpIndex || a.Doc == nil {
+		return metaSize
+	}
+	if a.body == nil {
+		body, err := json.Marshal(a.Doc)
+		if err != nil {
+			// Reported when the batch is sent
+			return metaSize
+		}
+		a.body = body
+	}
+	return metaSize + len(a.body) + 1
+}
+
+// NewIndexAction creates a bulk action that indexes doc under its at_uri
+func NewIndexAction(doc ElasticsearchDoc, version int64) BulkAction {
+	return BulkAction{Op: BulkOpIndex, ID: doc.AtURI, Version: version, Doc: &doc}
+}
+
+// NewDeleteAction creates a bulk action that deletes the document with the given at_uri
+func NewDeleteAction(atURI string, version int64) BulkAction {
+	return BulkAction{Op: BulkOpDelete, ID: atURI, Version: version}
+}
+
+// bulkItemResult is the per-item outcome in a bulk response
+type bulkItemResult struct {
+	Status int    `json:"status"`
+	Result string `json:"result"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// isSuccess reports whether the item succeeded. Deleting a document that does
+// not exist is treated as success, since the end state is the same.
+func (r bulkItemResult) isSuccess(op string) bool {
+	if r.Error == nil && r.Status < 300 {
+		return true
+	}
+	return op == BulkOpDelete && r.Status == http.StatusNotFound
+}
+
+// isVersionConflict reports whether the item was rejected because Elasticsearch
+// already holds a newer (or the same) external version of the document
+func (r bulkItemResult) isVersionConflict() bool {
+	return r.Status == http.StatusConflict
+}
+
+// isRetryable reports whether the item was rejected for a transient reason
+// (back-pressure or an unavailable shard) and may succeed if sent again
+func (r bulkItemResult) isRetryable() bool {
+	return isRetryableStatus(r.Status)
+}
+
+// errorType returns the Elasticsearch error type, or empty if there is none
+func (r bulkItemResult) errorType() string {
+	if r.Error == nil {
+		return ""
 	}
+	return r.Error.Type
+}
 
-	if dryRun {
-		logger.Debug("Dry-run: Skipping bulk index of %d documents to index '%s'", len(docs), index)
+// errorReason returns the Elasticsearch error reason, or empty if there is none
+func (r bulkItemResult) errorReason() string {
+	if r.Error == nil {
+		return ""
+	}
+	return r.Error.Reason
+}
+
+// isRetryableStatus reports whether an HTTP status signals a transient failure
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// BulkIndexerConfig holds the settings of a BulkIndexer
+type BulkIndexerConfig struct {
+	Index  string
+	DryRun bool
+
+	// MaxRetries is how many times items rejected with 429 or 503 are resent
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry; it doubles on every
+	// attempt up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// RequestTimeout bounds each bulk request; a request that times out is
+	// retried like a 429. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// DeadLetters receives items that failed permanently. When nil, a
+	// permanent item failure fails the whole batch instead.
+	DeadLetters *DeadLetterQueue
+}
+
+// BulkIndexer sends batches of actions to Elasticsearch and classifies every
+// item in the response: successes, version conflicts and deletes of missing
+// documents are done, transient rejections are retried with exponential
+// backoff, and permanent failures are written to the dead-letter queue.
+type BulkIndexer struct {
+	client  *elasticsearch.Client
+	config  BulkIndexerConfig
+	metrics *Metrics
+	logger  *IngestLogger
+}
+
+// NewBulkIndexer creates a BulkIndexer for the given client
+func NewBulkIndexer(client *elasticsearch.Client, config BulkIndexerConfig, metrics *Metrics, logger *IngestLogger) *BulkIndexer {
+	if config.Index == "" {
+		config.Index = "posts"
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+	if config.MaxRetryBackoff < config.RetryBackoff {
+		config.MaxRetryBackoff = 30 * time.Second
+	}
+
+	return &BulkIndexer{
+		client:  client,
+		config:  config,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// bulkFailure is an item that Elasticsearch rejected
+type bulkFailure struct {
+	action BulkAction
+	result bulkItemResult
+}
+
+// Index sends actions to Elasticsearch. It returns an error only if the batch
+// could not be fully handled: the request itself failed, transient rejections
+// outlasted every retry, or a permanent failure could not be dead-lettered.
+func (b *BulkIndexer) Index(ctx context.Context, actions []BulkAction) error {
+	if len(actions) == 0 {
 		return nil
 	}
 
-	var buf bytes.Buffer
-	validDocCount := 0
+	if b.config.DryRun {
+		b.logger.Debug("Dry-run: Skipping bulk request of %d actions to index '%s'", len(actions), b.config.Index)
+		return nil
+	}
 
-	for _, doc := range docs {
-		if doc.AtURI == "" {
-			logger.Error("Skipping document with empty at_uri (author_did: %s)", doc.AuthorDID)
+	var pending []BulkAction
+	for _, action := range actions {
+		if action.ID == "" {
+			b.logger.Error("Skipping %s action with empty at_uri", action.Op)
 			continue
 		}
+		pending = append(pending, action)
+	}
 
-		meta := map[string]interface{}{
-			"index": map[string]interface{}{
-				"_index": index,
-				"_id":    doc.AtURI,
-			},
+	if len(pending) == 0 {
+		b.logger.Error("No valid actions to send (all had empty at_uri)")
+		return fmt.Errorf("no valid actions in batch")
+	}
+
+	total := len(pending)
+	backoff := b.config.RetryBackoff
+	var permanent []bulkFailure
+
+	for attempt := 0; ; attempt++ {
+		retry, failed, err := b.send(ctx, pending)
+		if err != nil {
+			return err
+		}
+		permanent = append(permanent, failed...)
+
+		if len(retry) == 0 {
+			break
+		}
+
+		if attempt >= b.config.MaxRetries {
+			b.metrics.Add("bulk.retries_exhausted", int64(len(retry)))
+			return fmt.Errorf("bulk request failed: %d of %d actions still rejected after %d retries", len(retry), total, attempt)
+		}
+
+		b.metrics.Add("bulk.retries", int64(len(retry)))
+		b.logger.Info("Retrying %d of %d bulk actions in %v (attempt %d of %d)", len(retry), total, backoff, attempt+1, b.config.MaxRetries)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("bulk retry cancelled: %w", ctx.Err())
+		case <-time.After(backoff):
 		}
 
-		validDocCount++
+		backoff *= 2
+		if backoff > b.config.MaxRetryBackoff {
+			backoff = b.config.MaxRetryBackoff
+		}
+		pending = retry
+	}
+
+	if len(permanent) == 0 {
+		return nil
+	}
+
+	if b.config.DeadLetters == nil {
+		return fmt.Errorf("bulk request failed: %d of %d actions had errors (see logs for details)", len(permanent), total)
+	}
+
+	entries := make([]DeadLetterEntry, 0, len(permanent))
+	for _, failure := range permanent {
+		entries = append(entries, NewDeadLetterEntry(failure.action, failure.result.Status, failure.result.errorType(), failure.result.errorReason()))
+	}
+
+	if err := b.config.DeadLetters.Write(entries); err != nil {
+		return fmt.Errorf("failed to dead-letter %d of %d actions: %w", len(permanent), total, err)
+	}
+
+	b.metrics.Add("bulk.dead_lettered", int64(len(permanent)))
+	b.logger.Info("Wrote %d of %d failed bulk actions to dead-letter queue %s", len(permanent), total, b.config.DeadLetters.Path())
+	return nil
+}
+
+// send issues a single bulk request and splits the rejected items into those
+// worth retrying and those that failed permanently. A 429 or 503 response to
+// the whole request marks every action for retry.
+func (b *BulkIndexer) send(ctx context.Context, actions []BulkAction) (retry []BulkAction, failed []bulkFailure, err error) {
+	var buf bytes.Buffer
+
+	for _, action := range actions {
+		actionMeta := map[string]interface{}{
+			"_index": b.config.Index,
+			"_id":    action.ID,
+		}
+		if action.Version > 0 {
+			actionMeta["version"] = action.Version
+			actionMeta["version_type"] = "external"
+		}
+		meta := map[string]interface{}{action.Op: actionMeta}
 
 		metaJSON, err := json.Marshal(meta)
 		if err != nil {
-			return fmt.Errorf("failed to marshal metadata: %w", err)
+			return nil, nil, fmt.Errorf("failed to marshal metadata: %w", err)
 		}
 
 		buf.Write(metaJSON)
 		buf.WriteByte('\n')
 
-		docJSON, err := json.Marshal(doc)
-		if err != nil {
-			return fmt.Errorf("failed to marshal document: %w", err)
-		}
+		if action.Op == BulkOpIndex {
+			docJSON := action.body
+			if docJSON == nil {
+				docJSON, err = json.Marshal(action.Doc)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to marshal document: %w", err)
+				}
+			}
 
-		buf.Write(docJSON)
-		buf.WriteByte('\n')
+			buf.Write(docJSON)
+			buf.WriteByte('\n')
+		}
 	}
 
-	if validDocCount == 0 {
-		logger.Error("No valid documents to index (all had empty at_uri)")
-		return fmt.Errorf("no valid documents in batch")
+	reqCtx := ctx
+	if b.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, b.config.RequestTimeout)
+		defer cancel()
 	}
 
-	res, err := client.Bulk(
+	res, err := b.client.Bulk(
 		bytes.NewReader(buf.Bytes()),
-		client.Bulk.WithContext(ctx),
+		b.client.Bulk.WithContext(reqCtx),
 	)
 	if err != nil {
-		return fmt.Errorf("bulk request failed: %w", err)
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			b.metrics.Inc("bulk.timeouts")
+			b.logger.Error("Bulk request timed out after %v, will retry", b.config.RequestTimeout)
+			return actions, nil, nil
+		}
+		return nil, nil, fmt.Errorf("bulk request failed: %w", err)
 	}
 	defer res.Body.Close()
 
+	if isRetryableStatus(res.StatusCode) {
+		b.logger.Error("Bulk request rejected with status %d, will retry", res.StatusCode)
+		return actions, nil, nil
+	}
+
 	if res.IsError() {
-		return fmt.Errorf("bulk request returned error: %s", res.String())
+		return nil, nil, fmt.Errorf("bulk request returned error: %s", res.String())
 	}
 
 	var bulkResponse struct {
-		Errors bool `json:"errors"`
-		Items  []map[string]struct {
-			Error *struct {
-				Type   string `json:"type"`
-				Reason string `json:"reason"`
-			} `json:"error"`
-		} `json:"items"`
+		Errors bool                        `json:"errors"`
+		Items  []map[string]bulkItemResult `json:"items"`
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(&bulkResponse); err != nil {
-		return fmt.Errorf("failed to parse bulk response: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse bulk response: %w", err)
 	}
 
-	if bulkResponse.Errors {
-		itemsJSON, _ := json.Marshal(bulkResponse.Items)
-		logger.Error("Bulk indexing failed with errors. Response items: %s", string(itemsJSON))
-		return fmt.Errorf("bulk indexing failed: some documents had errors (see logs for details)")
+	if !bulkResponse.Errors {
+		return nil, nil, nil
 	}
 
-	return nil
+	// Once an action is retried, every later action for the same document is
+	// retried after it, so that a create and a delete are never reordered
+	retryIDs := make(map[string]bool)
+
+	for i, item := range bulkResponse.Items {
+		if i >= len(actions) {
+			break
+		}
+		action := actions[i]
+		if retryIDs[action.ID] {
+			retry = append(retry, action)
+			continue
+		}
+
+		result, ok := item[action.Op]
+		if !ok || result.isSuccess(action.Op) {
+			continue
+		}
+
+		switch {
+		case result.isVersionConflict():
+			b.metrics.Inc("bulk.version_conflicts")
+			b.logger.Debug("Ignoring stale %s for %s (version %d): newer version already indexed", action.Op, action.ID, action.Version)
+		case result.isRetryable():
+			retryIDs[action.ID] = true
+			retry = append(retry, action)
+		default:
+			b.metrics.Inc("bulk.failed." + result.errorType())
+			b.logger.Error("Bulk %s failed for %s: [%d] %s: %s", action.Op, action.ID, result.Status, result.errorType(), result.errorReason())
+			failed = append(failed, bulkFailure{action: action, result: result})
+		}
+	}
+
+	return retry, failed, nil
+}
+
+// NewBulkActionFromRecord parses a source record and builds the index or
+// delete action for it, keeping the record for dead-lettering
+func NewBulkActionFromRecord(record Record, models *EmbeddingModelRegistry, metrics *Metrics, logger *IngestLogger) BulkAction {
+	msg := NewMegaStreamMessage(record.AtURI, record.DID, record.RawPost, record.Inferences, models, metrics, logger)
+
+	var action BulkAction
+	if msg.IsDelete() {
+		action = NewDeleteAction(record.AtURI, msg.GetVersion())
+	} else {
+		action = NewIndexAction(CreateElasticsearchDoc(msg), msg.GetVersion())
+	}
+	action.Record = &record
+
+	return action
 }
 
 // CreateElasticsearchDoc creates an ElasticsearchDoc from a MegaStreamMessage
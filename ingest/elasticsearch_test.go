@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v9"
+)
+
+// bulkTestServer is a fake Elasticsearch that records bulk request lines and
+// answers each item with the status returned by respond
+type bulkTestServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests [][]map[string]interface{}
+}
+
+func newBulkTestServer(t *testing.T, respond func(op, id string) (int, string)) (*bulkTestServer, *elasticsearch.Client) {
+	t.Helper()
+
+	bs := &bulkTestServer{}
+	bs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Write([]byte(`{"version":{"number":"9.0.0"}}`))
+			return
+		}
+
+		var lines []map[string]interface{}
+		var items []map[string]interface{}
+		hasErrors := false
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Errorf("Invalid NDJSON line: %v", err)
+				continue
+			}
+			lines = append(lines, line)
+
+			for op, raw := range line {
+				meta, ok := raw.(map[string]interface{})
+				if !ok || (op != "index" && op != "delete") {
+					continue
+				}
+				id, _ := meta["_id"].(string)
+				status, errType := respond(op, id)
+				item := map[string]interface{}{"_id": id, "status": status}
+				if errType != "" {
+					item["error"] = map[string]interface{}{"type": errType, "reason": errType + " for " + id}
+					hasErrors = true
+				}
+				items = append(items, map[string]interface{}{op: item})
+			}
+		}
+
+		bs.mu.Lock()
+		bs.requests = append(bs.requests, lines)
+		bs.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": hasErrors, "items": items})
+	}))
+	t.Cleanup(bs.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{bs.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create Elasticsearch client: %v", err)
+	}
+
+	return bs, client
+}
+
+func (bs *bulkTestServer) lastRequest() []map[string]interface{} {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if len(bs.requests) == 0 {
+		return nil
+	}
+	return bs.requests[len(bs.requests)-1]
+}
+
+func TestBulkIndex_SendsDeletesInOrder(t *testing.T) {
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusOK, ""
+	})
+
+	actions := []BulkAction{
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://a"}, 0),
+		NewDeleteAction("at://a", 0),
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://b"}, 0),
+	}
+
+	if err := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false)).Index(context.Background(), actions); err != nil {
+		t.Fatalf("Expected bulk request to succeed: %v", err)
+	}
+
+	lines := server.lastRequest()
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 NDJSON lines (2 index pairs + 1 delete), got %d", len(lines))
+	}
+
+	expectedOps := []string{"index", "", "delete", "index", ""}
+	for i, op := range expectedOps {
+		if op == "" {
+			continue
+		}
+		if _, ok := lines[i][op]; !ok {
+			t.Errorf("Expected line %d to be a %s action, got %v", i, op, lines[i])
+		}
+	}
+}
+
+func TestBulkIndex_DeleteNotFoundIsSuccess(t *testing.T) {
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		if op == "delete" {
+			return http.StatusNotFound, ""
+		}
+		return http.StatusCreated, ""
+	})
+
+	actions := []BulkAction{NewDeleteAction("at://missing", 0), NewIndexAction(ElasticsearchDoc{AtURI: "at://a"}, 0)}
+	if err := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false)).Index(context.Background(), actions); err != nil {
+		t.Errorf("Expected 404 on delete to count as success: %v", err)
+	}
+}
+
+func TestBulkIndex_ItemErrorFailsBatch(t *testing.T) {
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		if id == "at://bad" {
+			return http.StatusBadRequest, "mapper_parsing_exception"
+		}
+		return http.StatusCreated, ""
+	})
+
+	actions := []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://good"}, 0), NewIndexAction(ElasticsearchDoc{AtURI: "at://bad"}, 0)}
+	err := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false)).Index(context.Background(), actions)
+	if err == nil {
+		t.Fatal("Expected item error to fail the batch")
+	}
+
+	if !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("Expected error to count failed items, got: %v", err)
+	}
+}
+
+func TestBulkIndex_ExternalVersionConflictIsExpected(t *testing.T) {
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		if id == "at://stale" {
+			return http.StatusConflict, "version_conflict_engine_exception"
+		}
+		return http.StatusCreated, ""
+	})
+
+	metrics := NewMetrics()
+	actions := []BulkAction{
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://fresh"}, 200),
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://stale"}, 100),
+	}
+
+	if err := NewBulkIndexer(client, BulkIndexerConfig{}, metrics, NewLogger(false)).Index(context.Background(), actions); err != nil {
+		t.Fatalf("Expected version conflict not to fail the batch: %v", err)
+	}
+
+	if got := metrics.Get("bulk.version_conflicts"); got != 1 {
+		t.Errorf("Expected 1 version conflict in metrics, got %d", got)
+	}
+
+	meta, _ := server.lastRequest()[0]["index"].(map[string]interface{})
+	if meta["version"] != float64(200) || meta["version_type"] != "external" {
+		t.Errorf("Expected external version 200 in action metadata, got %v", meta)
+	}
+}
+
+func TestBulkIndex_UnversionedActionOmitsVersion(t *testing.T) {
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusCreated, ""
+	})
+
+	actions := []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://a"}, 0)}
+	if err := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false)).Index(context.Background(), actions); err != nil {
+		t.Fatalf("Expected bulk request to succeed: %v", err)
+	}
+
+	meta, _ := server.lastRequest()[0]["index"].(map[string]interface{})
+	if _, ok := meta["version_type"]; ok {
+		t.Errorf("Expected no version_type for unversioned action, got %v", meta)
+	}
+}
+
+func TestBulkIndexer_RetriesRejectedItems(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[id]++
+		if id == "at://busy" && attempts[id] < 3 {
+			return http.StatusTooManyRequests, "es_rejected_execution_exception"
+		}
+		return http.StatusCreated, ""
+	})
+
+	metrics := NewMetrics()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{MaxRetries: 3, RetryBackoff: time.Millisecond}, metrics, NewLogger(false))
+	actions := []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://ok"}, 0), NewIndexAction(ElasticsearchDoc{AtURI: "at://busy"}, 0)}
+
+	if err := indexer.Index(context.Background(), actions); err != nil {
+		t.Fatalf("Expected rejected item to succeed on retry: %v", err)
+	}
+
+	if attempts["at://ok"] != 1 || attempts["at://busy"] != 3 {
+		t.Errorf("Expected only the rejected item to be resent, got attempts %v", attempts)
+	}
+
+	if len(server.lastRequest()) != 2 {
+		t.Errorf("Expected last retry to contain a single index pair, got %d lines", len(server.lastRequest()))
+	}
+
+	if got := metrics.Get("bulk.retries"); got != 2 {
+		t.Errorf("Expected 2 retries in metrics, got %d", got)
+	}
+}
+
+func TestBulkIndexer_RetriesExhausted(t *testing.T) {
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusServiceUnavailable, "unavailable_shards_exception"
+	})
+
+	deadLetters, err := NewDeadLetterQueue(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to create dead-letter queue: %v", err)
+	}
+	defer deadLetters.Close()
+
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{MaxRetries: 2, RetryBackoff: time.Millisecond, DeadLetters: deadLetters}, nil, NewLogger(false))
+	err = indexer.Index(context.Background(), []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://a"}, 0)})
+	if err == nil {
+		t.Fatal("Expected error once retries are exhausted")
+	}
+
+	entries, err := ReadDeadLetters(deadLetters.Path())
+	if err != nil {
+		t.Fatalf("Failed to read dead-letter queue: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected transient failures not to be dead-lettered, got %d entries", len(entries))
+	}
+}
+
+func TestBulkIndexer_DeadLettersPermanentFailures(t *testing.T) {
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		if id == "at://bad" {
+			return http.StatusBadRequest, "mapper_parsing_exception"
+		}
+		return http.StatusCreated, ""
+	})
+
+	deadLetters, err := NewDeadLetterQueue(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to create dead-letter queue: %v", err)
+	}
+	defer deadLetters.Close()
+
+	metrics := NewMetrics()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{DeadLetters: deadLetters}, metrics, NewLogger(false))
+
+	record := Record{AtURI: "at://bad", DID: "did:plc:bad", RawPost: `{"message":{}}`, Inferences: "{}", Source: "db_1.zip"}
+	bad := NewIndexAction(ElasticsearchDoc{AtURI: "at://bad"}, 42)
+	bad.Record = &record
+
+	if err := indexer.Index(context.Background(), []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://good"}, 0), bad}); err != nil {
+		t.Fatalf("Expected dead-lettered failure not to fail the batch: %v", err)
+	}
+
+	entries, err := ReadDeadLetters(deadLetters.Path())
+	if err != nil {
+		t.Fatalf("Failed to read dead-letter queue: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 dead-letter entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.ID != "at://bad" || entry.Status != http.StatusBadRequest || entry.ErrorType != "mapper_parsing_exception" || entry.Version != 42 {
+		t.Errorf("Unexpected dead-letter entry: %+v", entry)
+	}
+	if entry.Record() == nil || *entry.Record() != record {
+		t.Errorf("Expected dead-letter entry to carry the source row, got %+v", entry.Record())
+	}
+
+	if got := metrics.Get("bulk.dead_lettered"); got != 1 {
+		t.Errorf("Expected 1 dead-lettered action in metrics, got %d", got)
+	}
+}
+
+func TestBulkIndexer_RetryKeepsLaterActionsForSameDocument(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	rejected := false
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, op+" "+id)
+		if op == "index" && id == "at://a" && !rejected {
+			rejected = true
+			return http.StatusTooManyRequests, "es_rejected_execution_exception"
+		}
+		return http.StatusOK, ""
+	})
+
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{MaxRetries: 1, RetryBackoff: time.Millisecond}, nil, NewLogger(false))
+	actions := []BulkAction{
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://a"}, 0),
+		NewIndexAction(ElasticsearchDoc{AtURI: "at://b"}, 0),
+		NewDeleteAction("at://a", 0),
+	}
+
+	if err := indexer.Index(context.Background(), actions); err != nil {
+		t.Fatalf("Expected retry to succeed: %v", err)
+	}
+
+	expected := "[index at://a index at://b delete at://a index at://a delete at://a]"
+	if got := fmt.Sprint(sent); got != expected {
+		t.Errorf("Expected delete to be resent after the retried index, got %s", got)
+	}
+}
+
+func TestBulkIndexer_RequestTimeoutIsRetried(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return http.StatusCreated, ""
+	})
+
+	metrics := NewMetrics()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{MaxRetries: 2, RetryBackoff: time.Millisecond, RequestTimeout: 50 * time.Millisecond}, metrics, NewLogger(false))
+
+	if err := indexer.Index(context.Background(), []BulkAction{NewIndexAction(ElasticsearchDoc{AtURI: "at://slow"}, 0)}); err != nil {
+		t.Fatalf("Expected timed out request to be retried: %v", err)
+	}
+
+	if metrics.Get("bulk.timeouts") != 1 {
+		t.Errorf("Expected 1 timeout in metrics, got %d", metrics.Get("bulk.timeouts"))
+	}
+}
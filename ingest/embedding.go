@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Megastream stores each embedding as a little-endian float32 array that is
+// optionally zlib- or zstd-compressed and then text-encoded as base64 or as
+// base85 (the alphabet used by Python's base64.b85encode).
+
+// base85Alphabet is the RFC 1924 character set used by Python's b85encode
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+var (
+	base85Decode [256]byte
+	zstdMagic    = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func init() {
+	for i := range base85Decode {
+		base85Decode[i] = 0xff
+	}
+	for i := 0; i < len(base85Alphabet); i++ {
+		base85Decode[base85Alphabet[i]] = byte(i)
+	}
+}
+
+// decodeEmbedding decodes an encoded embedding string to a float32 array.
+// When expectedDims is positive, the decoded vector must have exactly that many dimensions.
+func decodeEmbedding(encoded string, expectedDims int) ([]float32, error) {
+	if encoded == "" {
+		return nil, errors.New("empty embedding")
+	}
+
+	var errs []error
+	for _, candidate := range decodeEmbeddingText(encoded) {
+		if candidate.err != nil {
+			errs = append(errs, candidate.err)
+			continue
+		}
+
+		floats, err := bytesToFloat32s(decompressEmbedding(candidate.data))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", candidate.encoding, err))
+			continue
+		}
+
+		if expectedDims > 0 && len(floats) != expectedDims {
+			errs = append(errs, fmt.Errorf("%s: expected %d dimensions, got %d", candidate.encoding, expectedDims, len(floats)))
+			continue
+		}
+
+		return floats, nil
+	}
+
+	return nil, fmt.Errorf("failed to decode embedding: %w", errors.Join(errs...))
+}
+
+// decodedText is the result of one attempt to decode the text encoding
+type decodedText struct {
+	encoding string
+	data     []byte
+	err      error
+}
+
+// decodeEmbeddingText returns every plausible decoding of encoded, most likely first.
+// Strings that only use base64 characters are tried as base64 before base85.
+func decodeEmbeddingText(encoded string) []decodedText {
+	var candidates []decodedText
+
+	if isBase64Text(encoded) {
+		if data, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			candidates = append(candidates, decodedText{encoding: "base64", data: data})
+		} else if data, err := base64.RawStdEncoding.DecodeString(encoded); err == nil {
+			candidates = append(candidates, decodedText{encoding: "base64", data: data})
+		} else {
+			candidates = append(candidates, decodedText{encoding: "base64", err: fmt.Errorf("base64 decode failed: %w", err)})
+		}
+	}
+
+	data, err := decodeBase85(encoded)
+	if err != nil {
+		err = fmt.Errorf("base85 decode failed: %w", err)
+	}
+	candidates = append(candidates, decodedText{encoding: "base85", data: data, err: err})
+
+	return candidates
+}
+
+// isBase64Text reports whether s only contains standard base64 characters
+func isBase64Text(s string) bool {
+	trimmed := strings.TrimRight(s, "=")
+	for i := 0; i < len(trimmed); i++ {
+		c := trimmed[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBase85 decodes a base85 string as produced by Python's base64.b85encode
+func decodeBase85(s string) ([]byte, error) {
+	padding := (5 - len(s)%5) % 5
+	padded := s + strings.Repeat("~", padding)
+
+	out := make([]byte, 0, len(padded)/5*4)
+	for i := 0; i < len(padded); i += 5 {
+		var acc uint64
+		for j := range 5 {
+			digit := base85Decode[padded[i+j]]
+			if digit == 0xff {
+				return nil, fmt.Errorf("invalid base85 character %q at offset %d", padded[i+j], i+j)
+			}
+			acc = acc*85 + uint64(digit)
+		}
+		if acc > math.MaxUint32 {
+			return nil, fmt.Errorf("base85 overflow in group at offset %d", i)
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(acc))
+	}
+
+	return out[:len(out)-padding], nil
+}
+
+// decompressEmbedding inflates zlib or zstd payloads, detected by their magic
+// bytes. Anything else, including payloads that fail to inflate, is returned as-is.
+func decompressEmbedding(data []byte) []byte {
+	switch {
+	case isZlibHeader(data):
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return data
+		}
+		defer r.Close()
+		if inflated, err := io.ReadAll(r); err == nil {
+			return inflated
+		}
+	case bytes.HasPrefix(data, zstdMagic):
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return data
+		}
+		defer d.Close()
+		if inflated, err := d.DecodeAll(data, nil); err == nil {
+			return inflated
+		}
+	}
+	return data
+}
+
+// isZlibHeader checks the zlib CMF/FLG header: deflate method and a valid check value
+func isZlibHeader(data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+	return data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
+
+// bytesToFloat32s reinterprets little-endian bytes as float32 values
+func bytesToFloat32s(data []byte) ([]float32, error) {
+	if len(data) == 0 || len(data)%4 != 0 {
+		return nil, fmt.Errorf("payload length %d is not a multiple of 4", len(data))
+	}
+
+	floats := make([]float32, len(data)/4)
+	for i := range floats {
+		f := math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			return nil, fmt.Errorf("non-finite value at index %d", i)
+		}
+		floats[i] = f
+	}
+
+	return floats, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// loadFixtureEmbeddings returns the raw text_embeddings strings of a test_data fixture
+func loadFixtureEmbeddings(t *testing.T, name string) map[string]string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("test_data", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", name, err)
+	}
+
+	var fixture struct {
+		Inferences struct {
+			TextEmbeddings map[string]string `json:"text_embeddings"`
+		} `json:"inferences"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatalf("Failed to parse fixture %s: %v", name, err)
+	}
+
+	return fixture.Inferences.TextEmbeddings
+}
+
+func float32Bytes(values []float32) []byte {
+	buf := make([]byte, 0, len(values)*4)
+	for _, v := range values {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+	}
+	return buf
+}
+
+func TestDecodeEmbedding_FixtureGolden(t *testing.T) {
+	tests := []struct {
+		fixture string
+		model   string
+		dims    int
+		first   float32
+		second  float32
+		last    float32
+	}{
+		{"standalone-post.json", "all-MiniLM-L12-v2", 384, -0.0303955078125, 0.1278076171875, -0.0091400146484375},
+		{"standalone-post.json", "all-MiniLM-L6-v2", 384, -0.0872802734375, 0.1187744140625, -0.00644683837890625},
+		{"standalone-post.json", "all-mpnet-base-v2", 768, -0.02325439453125, 0.0592041015625, 0.0013599395751953125},
+		{"quote-post.md.json", "all-MiniLM-L12-v2", 384, -0.0645751953125, 0.005035400390625, -0.00516510009765625},
+		{"quote-post.md.json", "all-MiniLM-L6-v2", 384, -0.041473388671875, -0.0245819091796875, 0.0062713623046875},
+		{"multiparty-reply-thread.json", "all-MiniLM-L12-v2", 384, -0.0877685546875, 0.024627685546875, 0.006191253662109375},
+		{"multiparty-reply-thread.json", "all-MiniLM-L6-v2", 384, -0.013641357421875, 0.07879638671875, -0.02972412109375},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture+"/"+tt.model, func(t *testing.T) {
+			encoded := loadFixtureEmbeddings(t, tt.fixture)[tt.model]
+
+			floats, err := decodeEmbedding(encoded, tt.dims)
+			if err != nil {
+				t.Fatalf("Failed to decode fixture embedding: %v", err)
+			}
+
+			if floats[0] != tt.first || floats[1] != tt.second || floats[len(floats)-1] != tt.last {
+				t.Errorf("Unexpected values: got [%v, %v, ..., %v], want [%v, %v, ..., %v]",
+					floats[0], floats[1], floats[len(floats)-1], tt.first, tt.second, tt.last)
+			}
+
+			var norm float64
+			for _, f := range floats {
+				norm += float64(f) * float64(f)
+			}
+			if math.Abs(math.Sqrt(norm)-1) > 0.001 {
+				t.Errorf("Expected unit-length sentence embedding, got norm %v", math.Sqrt(norm))
+			}
+		})
+	}
+}
+
+func TestDecodeEmbedding_DimensionMismatch(t *testing.T) {
+	encoded := loadFixtureEmbeddings(t, "standalone-post.json")["all-mpnet-base-v2"]
+
+	_, err := decodeEmbedding(encoded, 384)
+	if err == nil {
+		t.Fatal("Expected dimension mismatch error")
+	}
+
+	if !strings.Contains(err.Error(), "expected 384 dimensions, got 768") {
+		t.Errorf("Expected dimension mismatch in error, got: %v", err)
+	}
+}
+
+func TestDecodeEmbedding_Base64ReinterpretsBits(t *testing.T) {
+	values := []float32{1.0, -0.5, 0.25}
+	encoded := base64.StdEncoding.EncodeToString(float32Bytes(values))
+
+	floats, err := decodeEmbedding(encoded, len(values))
+	if err != nil {
+		t.Fatalf("Failed to decode base64 embedding: %v", err)
+	}
+
+	for i, v := range values {
+		if floats[i] != v {
+			t.Errorf("Index %d: expected %v, got %v", i, v, floats[i])
+		}
+	}
+}
+
+func TestDecodeEmbedding_Compressed(t *testing.T) {
+	values := make([]float32, 384)
+	for i := range values {
+		values[i] = float32(i) / 384
+	}
+	raw := float32Bytes(values)
+
+	var zlibBuf bytes.Buffer
+	zw := zlib.NewWriter(&zlibBuf)
+	zw.Write(raw)
+	zw.Close()
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	zstdPayload := encoder.EncodeAll(raw, nil)
+	encoder.Close()
+
+	tests := map[string]string{
+		"zlib+base64": base64.StdEncoding.EncodeToString(zlibBuf.Bytes()),
+		"zstd+base64": base64.StdEncoding.EncodeToString(zstdPayload),
+		"zstd+raw64":  base64.RawStdEncoding.EncodeToString(zstdPayload),
+	}
+
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			floats, err := decodeEmbedding(encoded, len(values))
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if floats[383] != values[383] {
+				t.Errorf("Expected %v, got %v", values[383], floats[383])
+			}
+		})
+	}
+}
+
+func TestDecodeBase85(t *testing.T) {
+	// Reference values produced by Python's base64.b85encode
+	tests := map[string]string{
+		"":      "",
+		"a":     "VE",
+		"hello": "Xk~0{Zv",
+		"\x00":  "00",
+	}
+
+	for want, encoded := range tests {
+		got, err := decodeBase85(encoded)
+		if err != nil {
+			t.Errorf("Failed to decode %q: %v", encoded, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("decodeBase85(%q) = %q, want %q", encoded, got, want)
+		}
+	}
+
+	if _, err := decodeBase85("ab\"cd"); err == nil {
+		t.Error("Expected error for invalid base85 character")
+	}
+}
+
+func TestDecodeEmbedding_Invalid(t *testing.T) {
+	for _, encoded := range []string{"", "\"\"\"", "AAA="} {
+		if _, err := decodeEmbedding(encoded, 0); err == nil {
+			t.Errorf("Expected error decoding %q", encoded)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// lockFile does nothing where file locks are not supported
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing where file locks are not supported
+func unlockFile(f *os.File) {}
@@ -5,11 +5,67 @@ import (
 	"io"
 )
 
-// TODO: Abstract WebSocketClient to a general DataSource interface
-// The new DataSource interface should support multiple implementations:
-// - WebSocketDataSource (real-time streams)
-// - LocalSQLiteDataSource (local file ingestion)
-// - S3SQLiteDataSource (remote S3-hosted files)
+// DataSource defines the interface for sources of posts to be indexed.
+// Implementations register themselves with RegisterDataSource.
+type DataSource interface {
+	// Start begins reading records in the background
+	Start(ctx context.Context) error
+
+	// Records returns the channel of records, closed when the source is exhausted
+	Records() <-chan Record
+
+	// Ack reports the indexing outcome of previously received records
+	Ack(ack Ack)
+
+	// Stop waits for outstanding acknowledgments to be applied
+	Stop() error
+
+	// Checkpoint returns the position up to which all records have been acknowledged
+	Checkpoint() string
+}
+
+// StateBackend defines the interface for the stores that persist the state of
+// a StateManager. The manager keeps the whole state in memory and writes each
+// change through, so a backend only has to make single changes durable.
+type StateBackend interface {
+	// Load returns every stored file entry, watermark and summary
+	Load() (stateFile, error)
+
+	// PutFile inserts or replaces the entry of a file
+	PutFile(entry FileStateEntry) error
+
+	// DeleteFiles removes the entries of files, returning those it found
+	DeleteFiles(filenames ...string) ([]string, error)
+
+	// PutWatermark stores the watermark for name
+	PutWatermark(name, watermark string) error
+
+	// AddSummary adds to the summary of pruned entries for a day, returning
+	// the stored total
+	AddSummary(day string, delta DaySummary) (DaySummary, error)
+
+	// Replace swaps the whole stored state for the given one
+	Replace(state stateFile) error
+
+	// Close releases the store
+	Close() error
+}
+
+// LeasingStateBackend defines the interface for state backends shared between
+// replicas, which lease each file to the replica processing it
+type LeasingStateBackend interface {
+	StateBackend
+
+	// Claim takes or renews the lease on a file unless another replica holds
+	// it, returning the shared entry of the file if there is one
+	Claim(filename string) (*FileStateEntry, bool, error)
+
+	// Release gives up the lease on a file
+	Release(filename string) error
+
+	// Holds reports whether this replica still holds the lease on a file
+	Holds(filename string) bool
+}
 
 // WebSocketClient defines the interface for WebSocket connections
 type WebSocketClient interface {
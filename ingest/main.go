@@ -3,20 +3,29 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
-// TODO: Move to multithreaded implementation
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		runReplayCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		runStateCommand(os.Args[2:])
+		return
+	}
+
 	// Parse command line flags
 	dryRun := flag.Bool("dry-run", false, "Run in dry-run mode (no writes to Elasticsearch)")
 	skipTLSVerify := flag.Bool("skip-tls-verify", false, "Skip TLS certificate verification (use for local development only)")
-	source := flag.String("source", "local", "Source of SQLite files: 'local' or 's3'")
-	mode := flag.String("mode", "once", "Ingestion mode: 'once' or 'spool'")
+	source := flag.String("source", "local", "Data source: one of "+strings.Join(DataSourceNames(), ", "))
+	mode := flag.String("mode", "once", "Ingestion mode: 'once', 'spool' or 'watch'")
 	flag.Parse()
 
 	// Load configuration
@@ -41,57 +50,37 @@ func main() {
 		cancel()
 	}()
 
-	logger.Info("Starting SQLite ingestion (source: %s, mode: %s)", *source, *mode)
-	runIngestion(ctx, config, logger, *source, *mode, *dryRun, *skipTLSVerify)
-}
-
-func runIngestion(ctx context.Context, config *Config, logger *IngestLogger, source, mode string, dryRun, skipTLSVerify bool) {
-	// Validate source parameter
-	if source != "local" && source != "s3" {
-		logger.Error("Invalid source: %s (must be 'local' or 's3')", source)
+	logger.Info("Starting ingestion (source: %s, mode: %s)", *source, *mode)
+	if err := runIngestion(ctx, config, logger, *source, *mode, *dryRun, *skipTLSVerify); err != nil {
+		logger.Error("%v", err)
 		os.Exit(1)
 	}
+}
 
+// runIngestion indexes records from the data source until it is exhausted or
+// ctx is cancelled. It returns instead of exiting on errors, so that the
+// state is closed and its lock released on every path.
+func runIngestion(ctx context.Context, config *Config, logger *IngestLogger, source, mode string, dryRun, skipTLSVerify bool) error {
 	// Validate mode parameter
-	if mode != "once" && mode != "spool" {
-		logger.Error("Invalid mode: %s (must be 'once' or 'spool')", mode)
-		os.Exit(1)
+	if mode != "once" && mode != "spool" && mode != "watch" {
+		return fmt.Errorf("invalid mode: %s (must be 'once', 'spool' or 'watch')", mode)
 	}
 
 	// Validate Elasticsearch configuration
 	if config.ElasticsearchURL == "" {
-		logger.Error("ELASTICSEARCH_URL environment variable is required")
-		os.Exit(1)
+		return fmt.Errorf("ELASTICSEARCH_URL environment variable is required")
 	}
 
 	if !dryRun && config.ElasticsearchAPIKey == "" {
-		logger.Error("ELASTICSEARCH_API_KEY environment variable is required")
-		os.Exit(1)
+		return fmt.Errorf("ELASTICSEARCH_API_KEY environment variable is required")
 	}
 
-	// Validate source-specific configuration
-	if source == "local" {
-		if config.LocalSQLiteDBPath == "" {
-			logger.Error("LOCAL_SQLITE_DB_PATH environment variable is required for local source")
-			os.Exit(1)
-		}
-	} else if source == "s3" {
-		if config.S3SQLiteDBBucket == "" {
-			logger.Error("S3_SQLITE_DB_BUCKET environment variable is required for s3 source")
-			os.Exit(1)
-		}
-		if config.S3SQLiteDBPrefix == "" {
-			logger.Error("S3_SQLITE_DB_PREFIX environment variable is required for s3 source")
-			os.Exit(1)
-		}
-	}
-
-	// Initialize state manager
-	stateManager, err := NewStateManager(config.SpoolStateFile, logger)
+	// Initialize embedding model registry
+	models, err := LoadEmbeddingModelRegistry(config.EmbeddingModels)
 	if err != nil {
-		logger.Error("Failed to initialize state manager: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("invalid EMBEDDING_MODELS configuration: %w", err)
 	}
+	metrics := NewMetrics()
 
 	// Initialize Elasticsearch client
 	esConfig := ElasticsearchConfig{
@@ -102,95 +91,110 @@ func runIngestion(ctx context.Context, config *Config, logger *IngestLogger, sou
 
 	esClient, err := NewElasticsearchClient(esConfig, logger)
 	if err != nil {
-		logger.Error("%v", err)
-		os.Exit(1)
+		return err
 	}
 
-	// Initialize spooler
-	var spooler Spooler
-	interval := time.Duration(config.SpoolIntervalSec) * time.Second
+	// Initialize state manager
+	stateManager, err := OpenStateManager(config, esClient, StateShared, logger)
+	if err != nil {
+		return err
+	}
+	defer stateManager.Close()
+
+	// Initialize data source (validates source-specific configuration)
+	dataSource, err := NewDataSource(source, DataSourceOptions{
+		Config:       config,
+		Mode:         mode,
+		StateManager: stateManager,
+		Logger:       logger,
+	})
+	if err != nil {
+		return err
+	}
 
-	if source == "local" {
-		spooler = NewLocalSpooler(config.LocalSQLiteDBPath, mode, interval, stateManager, logger)
-	} else {
-		spooler, err = NewS3Spooler(config.S3SQLiteDBBucket, config.S3SQLiteDBPrefix, config.AWSRegion, mode, interval, stateManager, logger)
+	// Initialize dead-letter queue for permanently failed actions
+	var deadLetters *DeadLetterQueue
+	if config.DeadLetterPath != "" && !dryRun {
+		deadLetters, err = NewDeadLetterQueue(config.DeadLetterPath)
 		if err != nil {
-			logger.Error("Failed to create S3 spooler: %v", err)
-			os.Exit(1)
+			return err
 		}
+		defer deadLetters.Close()
 	}
 
-	// Start spooler
-	if err := spooler.Start(ctx); err != nil {
-		logger.Error("Failed to start spooler: %v", err)
-		os.Exit(1)
+	indexer := NewBulkIndexer(esClient, BulkIndexerConfig{
+		Index:          "posts",
+		DryRun:         dryRun,
+		MaxRetries:     config.BulkMaxRetries,
+		RetryBackoff:   config.BulkRetryBackoff,
+		RequestTimeout: config.WorkerTimeout,
+		DeadLetters:    deadLetters,
+	}, metrics, logger)
+
+	// Start data source
+	if err := dataSource.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start data source: %w", err)
+	}
+
+	// Index records through the bulk worker pool, which acknowledges each
+	// batch back to the data source once Elasticsearch has handled it
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{
+		Workers:       config.ElasticsearchWorkers,
+		QueueSize:     config.ElasticsearchQueueSize,
+		BatchSize:     config.BulkBatchSize,
+		BatchBytes:    config.BulkBatchBytes,
+		FlushInterval: config.BulkFlushInterval,
+	}, dataSource.Ack, metrics, logger)
+	pool.Start(ctx)
+
+	// Check for batches that have waited too long several times per interval
+	var flushTick <-chan time.Time
+	if config.BulkFlushInterval > 0 {
+		ticker := time.NewTicker(max(config.BulkFlushInterval/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		flushTick = ticker.C
 	}
 
-	// Process rows from spooler
-	rowChan := spooler.GetRowChannel()
-	var batch []ElasticsearchDoc
-	const batchSize = 100
-	processedCount := 0
+	records := dataSource.Records()
 	skippedCount := 0
 
 	for {
 		select {
+		case <-flushTick:
+			pool.FlushExpired()
 		case <-ctx.Done():
 			logger.Info("Shutdown signal received, stopping ingestion")
 			goto cleanup
-		case row, ok := <-rowChan:
+		case record, ok := <-records:
 			if !ok {
-				logger.Info("Spooler channel closed, finishing remaining batch")
+				logger.Info("Data source channel closed, finishing remaining batches")
 				goto cleanup
 			}
 
-			if row.AtURI == "" {
-				logger.Error("Skipping row with empty at_uri from file %s (did: %s)", row.SourceFilename, row.DID)
+			if record.AtURI == "" {
+				logger.Error("Skipping record with empty at_uri from %s (did: %s)", record.Source, record.DID)
 				skippedCount++
+				dataSource.Ack(Ack{Token: record.Token, Count: 1})
 				continue
 			}
 
-			msg := NewMegaStreamMessage(row.AtURI, row.DID, row.RawPost, row.Inferences, logger)
-
-			if msg.IsDelete() {
-				skippedCount++
-				continue
-			}
-
-			doc := CreateElasticsearchDoc(msg)
-			batch = append(batch, doc)
-
-			// Bulk index when batch is full
-			if len(batch) >= batchSize {
-				if err := bulkIndex(ctx, esClient, "posts", batch, dryRun, logger); err != nil {
-					logger.Error("Failed to bulk index batch: %v", err)
-				} else {
-					processedCount += len(batch)
-					if dryRun {
-						logger.Info("Dry-run: Would index batch: %d documents (total: %d, skipped: %d)", len(batch), processedCount, skippedCount)
-					} else {
-						logger.Info("Indexed batch: %d documents (total: %d, skipped: %d)", len(batch), processedCount, skippedCount)
-					}
-				}
-				batch = batch[:0]
-			}
+			action := NewBulkActionFromRecord(record, models, metrics, logger)
+			metrics.Inc("actions." + action.Op)
+			pool.Add(action, record.Token)
 		}
 	}
 
 cleanup:
-	// Index remaining documents in batch
-	if len(batch) > 0 {
-		if err := bulkIndex(ctx, esClient, "posts", batch, dryRun, logger); err != nil {
-			logger.Error("Failed to bulk index final batch: %v", err)
-		} else {
-			processedCount += len(batch)
-			if dryRun {
-				logger.Info("Dry-run: Would index final batch: %d documents", len(batch))
-			} else {
-				logger.Info("Indexed final batch: %d documents", len(batch))
-			}
-		}
+	// Send remaining batches. Workers do not inherit the cancellation of ctx,
+	// so batches already read from the data source are still indexed.
+	pool.Close()
+
+	// Wait for outstanding acknowledgments to be recorded in the state file
+	if err := dataSource.Stop(); err != nil {
+		logger.Error("Failed to stop data source: %v", err)
 	}
 
-	logger.Info("Spooler ingestion complete. Processed: %d, Skipped: %d", processedCount, skippedCount)
+	logger.Info("Ingestion complete. Processed: %d, Failed: %d, Skipped: %d, Checkpoint: %q", pool.Processed(), pool.Failed(), skippedCount, dataSource.Checkpoint())
+	logger.Info("Metrics: %s", metrics)
+	return nil
 }
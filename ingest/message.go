@@ -1,10 +1,16 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"strings"
+)
+
+// Commit operations found in message.commit.operation
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
 )
 
 // MegaStreamMessage defines the interface for processing messages from the MegaStream database
@@ -17,6 +23,8 @@ type MegaStreamMessage interface {
 	GetThreadParentPost() string
 	GetQuotePost() string
 	GetEmbeddings() map[string][]float32
+	GetOperation() string
+	GetVersion() int64
 	IsDelete() bool
 }
 
@@ -30,12 +38,15 @@ type megaStreamMessage struct {
 	threadParentPost string
 	quotePost        string
 	embeddings       map[string][]float32
+	operation        string
+	version          int64
 	isDelete         bool
 	parseError       error
 }
 
-// NewMegaStreamMessage creates a new MegaStreamMessage from raw SQLite data
-func NewMegaStreamMessage(atURI, did, rawPostJSON, inferencesJSON string, logger *IngestLogger) MegaStreamMessage {
+// NewMegaStreamMessage creates a new MegaStreamMessage from raw SQLite data.
+// Embeddings are keyed by the FieldName of their model in the registry.
+func NewMegaStreamMessage(atURI, did, rawPostJSON, inferencesJSON string, models *EmbeddingModelRegistry, metrics *Metrics, logger *IngestLogger) MegaStreamMessage {
 	msg := &megaStreamMessage{
 		atURI:      atURI,
 		did:        did,
@@ -43,7 +54,7 @@ func NewMegaStreamMessage(atURI, did, rawPostJSON, inferencesJSON string, logger
 	}
 
 	msg.parseRawPost(rawPostJSON, logger)
-	msg.parseInferences(inferencesJSON, logger)
+	msg.parseInferences(inferencesJSON, models, metrics, logger)
 
 	return msg
 }
@@ -51,7 +62,9 @@ func NewMegaStreamMessage(atURI, did, rawPostJSON, inferencesJSON string, logger
 // parseRawPost parses the raw_post JSON and extracts relevant fields
 func (m *megaStreamMessage) parseRawPost(rawPostJSON string, logger *IngestLogger) {
 	var rawPost map[string]interface{}
-	if err := json.Unmarshal([]byte(rawPostJSON), &rawPost); err != nil {
+	decoder := json.NewDecoder(strings.NewReader(rawPostJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rawPost); err != nil {
 		m.parseError = fmt.Errorf("failed to parse raw_post JSON: %w", err)
 		logger.Error("Failed to parse raw_post JSON for %s: %v", m.atURI, err)
 		return
@@ -69,8 +82,10 @@ func (m *megaStreamMessage) parseRawPost(rawPostJSON string, logger *IngestLogge
 		return
 	}
 
-	operation, _ := commit["operation"].(string)
-	if operation == "delete" {
+	m.operation, _ = commit["operation"].(string)
+	m.version = parseVersion(commit)
+
+	if m.operation == OperationDelete {
 		m.isDelete = true
 		return
 	}
@@ -100,8 +115,43 @@ func (m *megaStreamMessage) parseRawPost(rawPostJSON string, logger *IngestLogge
 	}
 }
 
-// parseInferences parses the inferences JSON and extracts embeddings
-func (m *megaStreamMessage) parseInferences(inferencesJSON string, logger *IngestLogger) {
+// parseVersion returns the ordering version of a commit: the timestamp encoded
+// in its rev, which increases with every commit to the repository the record
+// lives in. message.time_us is not used even when present, since it is stamped
+// by the relay on another clock, and versions from the two clocks cannot be
+// compared. Zero means unknown.
+func parseVersion(commit map[string]interface{}) int64 {
+	rev, _ := commit["rev"].(string)
+	return tidTimestampMicros(rev)
+}
+
+// tidAlphabet is the base32-sortable alphabet of AT Protocol timestamp identifiers
+const tidAlphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// tidTimestampMicros decodes the microsecond timestamp from a 13-character TID
+// such as a commit rev. It returns 0 if tid is not a valid TID.
+func tidTimestampMicros(tid string) int64 {
+	if len(tid) != 13 {
+		return 0
+	}
+
+	var value uint64
+	for i := 0; i < len(tid); i++ {
+		digit := strings.IndexByte(tidAlphabet, tid[i])
+		if digit < 0 {
+			return 0
+		}
+		value = value<<5 | uint64(digit)
+	}
+
+	// The low 10 bits are a clock identifier, the top bit is always zero
+	return int64(value>>10) & (1<<53 - 1)
+}
+
+// parseInferences parses the inferences JSON and extracts every embedding
+// recognised by the model registry. Unknown models and decode failures are
+// counted in metrics rather than dropped silently.
+func (m *megaStreamMessage) parseInferences(inferencesJSON string, models *EmbeddingModelRegistry, metrics *Metrics, logger *IngestLogger) {
 	var inferences map[string]interface{}
 	if err := json.Unmarshal([]byte(inferencesJSON), &inferences); err != nil {
 		logger.Debug("Failed to parse inferences JSON for %s: %v", m.atURI, err)
@@ -113,39 +163,36 @@ func (m *megaStreamMessage) parseInferences(inferencesJSON string, logger *Inges
 		return
 	}
 
-	if embL12, ok := textEmbeddings["all-MiniLM-L12-v2"].(string); ok {
-		if decoded, err := decodeEmbedding(embL12); err == nil {
-			m.embeddings["all_MiniLM_L12_v2"] = decoded
-		} else {
-			logger.Debug("Failed to decode L12 embedding for %s: %v", m.atURI, err)
+	for sourceKey, value := range textEmbeddings {
+		model, ok := models.Lookup(sourceKey)
+		if !ok {
+			// The keys come from the input data, so they share one counter
+			metrics.Inc("embeddings.unknown_model")
+			if models.firstUnknown(sourceKey) {
+				logger.Info("Ignoring embeddings from unknown model %s, first seen in %s; add it to EMBEDDING_MODELS to index them", sourceKey, m.atURI)
+			} else {
+				logger.Debug("Ignoring embedding from unknown model %s for %s", sourceKey, m.atURI)
+			}
+			continue
 		}
-	}
 
-	if embL6, ok := textEmbeddings["all-MiniLM-L6-v2"].(string); ok {
-		if decoded, err := decodeEmbedding(embL6); err == nil {
-			m.embeddings["all_MiniLM_L6_v2"] = decoded
-		} else {
-			logger.Debug("Failed to decode L6 embedding for %s: %v", m.atURI, err)
+		encoded, ok := value.(string)
+		if !ok {
+			metrics.Inc("embeddings.decode_failed." + sourceKey)
+			logger.Debug("Embedding %s for %s is not a string", sourceKey, m.atURI)
+			continue
 		}
-	}
-}
-
-// decodeEmbedding decodes a base64-encoded embedding string to float32 array
-func decodeEmbedding(encoded string) ([]float32, error) {
-	decoded, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		return nil, fmt.Errorf("base64 decode failed: %w", err)
-	}
 
-	floatCount := len(decoded) / 4
-	floats := make([]float32, floatCount)
+		decoded, err := decodeEmbedding(encoded, model.Dims)
+		if err != nil {
+			metrics.Inc("embeddings.decode_failed." + sourceKey)
+			logger.Debug("Failed to decode %s embedding for %s: %v", sourceKey, m.atURI, err)
+			continue
+		}
 
-	for i := range floatCount {
-		bits := binary.LittleEndian.Uint32(decoded[i*4 : (i+1)*4])
-		floats[i] = float32(bits)
+		m.embeddings[model.FieldName] = decoded
+		metrics.Inc("embeddings.indexed." + sourceKey)
 	}
-
-	return floats, nil
 }
 
 // Interface method implementations
@@ -182,6 +229,14 @@ func (m *megaStreamMessage) GetEmbeddings() map[string][]float32 {
 	return m.embeddings
 }
 
+func (m *megaStreamMessage) GetOperation() string {
+	return m.operation
+}
+
+func (m *megaStreamMessage) GetVersion() int64 {
+	return m.version
+}
+
 func (m *megaStreamMessage) IsDelete() bool {
 	return m.isDelete
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMegaStreamMessage_VersionFromRev(t *testing.T) {
+	msg := loadFixtureMessage(t, "standalone-post.json", DefaultEmbeddingModelRegistry(), nil)
+
+	if msg.GetVersion() != 1757450801402286 {
+		t.Errorf("Expected version decoded from rev rather than message.time_us, got %d", msg.GetVersion())
+	}
+
+	if msg.GetOperation() != OperationCreate {
+		t.Errorf("Expected create operation, got %q", msg.GetOperation())
+	}
+}
+
+func TestMegaStreamMessage_VersionWithoutTimeUS(t *testing.T) {
+	rawPost := `{"message":{"commit":{"operation":"update","rev":"3lyglnfoohi24","record":{"text":"edited"}}}}`
+	msg := NewMegaStreamMessage("at://a", "did:plc:a", rawPost, "{}", DefaultEmbeddingModelRegistry(), nil, NewLogger(false))
+
+	if msg.GetVersion() != 1757450801402286 {
+		t.Errorf("Expected version decoded from rev, got %d", msg.GetVersion())
+	}
+
+	if msg.GetOperation() != OperationUpdate || msg.IsDelete() {
+		t.Errorf("Expected non-delete update operation, got %q", msg.GetOperation())
+	}
+
+	if msg.GetContent() != "edited" {
+		t.Errorf("Expected updated content, got %q", msg.GetContent())
+	}
+}
+
+func TestMegaStreamMessage_DeleteCarriesVersion(t *testing.T) {
+	rawPost := `{"message":{"time_us":1757450801618622,"commit":{"operation":"delete","rev":"3lyglnfoohi24"}}}`
+	msg := NewMegaStreamMessage("at://a", "did:plc:a", rawPost, "{}", DefaultEmbeddingModelRegistry(), nil, NewLogger(false))
+
+	if !msg.IsDelete() {
+		t.Error("Expected delete operation")
+	}
+
+	if msg.GetVersion() != 1757450801402286 {
+		t.Errorf("Expected delete to carry rev version, got %d", msg.GetVersion())
+	}
+}
+
+func TestMegaStreamMessage_VersionsShareOneClock(t *testing.T) {
+	models := DefaultEmbeddingModelRegistry()
+	logger := NewLogger(false)
+
+	// The create has no time_us, and the later delete was stamped by a relay
+	// whose clock is behind the one that made the create's rev
+	create := NewMegaStreamMessage("at://a", "did:plc:a", `{"message":{"commit":{"operation":"create","rev":"3lyglnfoohi24","record":{"text":"hello"}}}}`, "{}", models, nil, logger)
+	remove := NewMegaStreamMessage("at://a", "did:plc:a", `{"message":{"time_us":1757450800000000,"commit":{"operation":"delete","rev":"3lyglnfoohj24"}}}`, "{}", models, nil, logger)
+
+	if remove.GetVersion() <= create.GetVersion() {
+		t.Errorf("Expected the later delete to have the higher version, got %d after %d", remove.GetVersion(), create.GetVersion())
+	}
+}
+
+func TestTIDTimestampMicros(t *testing.T) {
+	tests := map[string]int64{
+		"3lyglnfoohi24": 1757450801402286,
+		"":              0,
+		"short":         0,
+		"3lyglnfoohi2!": 0,
+	}
+
+	for tid, expected := range tests {
+		if got := tidTimestampMicros(tid); got != expected {
+			t.Errorf("tidTimestampMicros(%q) = %d, want %d", tid, got, expected)
+		}
+	}
+}
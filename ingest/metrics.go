@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics holds named ingestion counters. A nil *Metrics discards all updates,
+// so callers that do not care about metrics can pass nil.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+// NewMetrics creates an empty set of counters
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]int64),
+	}
+}
+
+// Add increments the named counter by delta
+func (m *Metrics) Add(name string, delta int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+// Inc increments the named counter by one
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Get returns the current value of the named counter
+func (m *Metrics) Get(name string) int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+// Snapshot returns a copy of all counters
+func (m *Metrics) Snapshot() map[string]int64 {
+	snapshot := make(map[string]int64)
+	if m == nil {
+		return snapshot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, value := range m.counters {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// String formats all counters as sorted name=value pairs
+func (m *Metrics) String() string {
+	snapshot := m.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, snapshot[name]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxReportedUnknownModels caps how many distinct unknown models are
+// remembered for logging, since the keys come from the input data
+const maxReportedUnknownModels = 100
+
+// EmbeddingModel maps an embedding in Megastream inferences to its Elasticsearch field
+type EmbeddingModel struct {
+	// SourceKey is the model name used as key in inferences.text_embeddings
+	SourceKey string
+
+	// FieldName is the property under "embeddings" in the posts index mapping
+	FieldName string
+
+	// Dims is the dense_vector dimension the decoded embedding must have
+	Dims int
+
+	// Similarity is the dense_vector similarity function
+	Similarity string
+}
+
+// DefaultEmbeddingModels returns the models produced by Megastream
+func DefaultEmbeddingModels() []EmbeddingModel {
+	return []EmbeddingModel{
+		{SourceKey: "all-MiniLM-L12-v2", FieldName: "all_MiniLM_L12_v2", Dims: 384, Similarity: "cosine"},
+		{SourceKey: "all-MiniLM-L6-v2", FieldName: "all_MiniLM_L6_v2", Dims: 384, Similarity: "cosine"},
+		{SourceKey: "all-mpnet-base-v2", FieldName: "all_mpnet_base_v2", Dims: 768, Similarity: "cosine"},
+	}
+}
+
+// EmbeddingModelRegistry looks up embedding models by their inferences key
+type EmbeddingModelRegistry struct {
+	models   []EmbeddingModel
+	bySource map[string]EmbeddingModel
+
+	unknownMu sync.Mutex
+	unknown   map[string]bool
+}
+
+// NewEmbeddingModelRegistry validates models and builds a registry from them
+func NewEmbeddingModelRegistry(models []EmbeddingModel) (*EmbeddingModelRegistry, error) {
+	registry := &EmbeddingModelRegistry{
+		bySource: make(map[string]EmbeddingModel),
+		unknown:  make(map[string]bool),
+	}
+	fields := make(map[string]bool)
+
+	for _, model := range models {
+		if model.SourceKey == "" || model.FieldName == "" {
+			return nil, fmt.Errorf("embedding model must have a source key and a field name: %+v", model)
+		}
+		if model.Dims <= 0 {
+			return nil, fmt.Errorf("embedding model %s must have positive dims, got %d", model.SourceKey, model.Dims)
+		}
+		if _, exists := registry.bySource[model.SourceKey]; exists {
+			return nil, fmt.Errorf("duplicate embedding model source key: %s", model.SourceKey)
+		}
+		if fields[model.FieldName] {
+			return nil, fmt.Errorf("duplicate embedding model field name: %s", model.FieldName)
+		}
+
+		registry.models = append(registry.models, model)
+		registry.bySource[model.SourceKey] = model
+		fields[model.FieldName] = true
+	}
+
+	return registry, nil
+}
+
+// DefaultEmbeddingModelRegistry returns a registry of DefaultEmbeddingModels
+func DefaultEmbeddingModelRegistry() *EmbeddingModelRegistry {
+	registry, err := NewEmbeddingModelRegistry(DefaultEmbeddingModels())
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+// Lookup returns the model registered for an inferences key
+func (r *EmbeddingModelRegistry) Lookup(sourceKey string) (EmbeddingModel, bool) {
+	model, ok := r.bySource[sourceKey]
+	return model, ok
+}
+
+// firstUnknown reports whether sourceKey is an unknown model seen for the
+// first time. Once maxReportedUnknownModels have been seen, it reports false
+// for any other.
+func (r *EmbeddingModelRegistry) firstUnknown(sourceKey string) bool {
+	r.unknownMu.Lock()
+	defer r.unknownMu.Unlock()
+	if r.unknown[sourceKey] || len(r.unknown) >= maxReportedUnknownModels {
+		return false
+	}
+	r.unknown[sourceKey] = true
+	return true
+}
+
+// Models returns the registered models in registration order
+func (r *EmbeddingModelRegistry) Models() []EmbeddingModel {
+	return append([]EmbeddingModel(nil), r.models...)
+}
+
+// MappingProperties returns the dense_vector properties of the "embeddings"
+// object in the posts index mapping
+func (r *EmbeddingModelRegistry) MappingProperties() map[string]interface{} {
+	properties := make(map[string]interface{}, len(r.models))
+	for _, model := range r.models {
+		properties[model.FieldName] = map[string]interface{}{
+			"type":       "dense_vector",
+			"dims":       model.Dims,
+			"index":      true,
+			"similarity": model.Similarity,
+		}
+	}
+	return properties
+}
+
+// ParseEmbeddingModels parses a comma-separated list of
+// source_key:field_name:dims[:similarity] entries. Similarity defaults to cosine.
+func ParseEmbeddingModels(spec string) ([]EmbeddingModel, error) {
+	var models []EmbeddingModel
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid embedding model %q (expected source_key:field_name:dims[:similarity])", entry)
+		}
+
+		dims, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid dims in embedding model %q: %w", entry, err)
+		}
+
+		model := EmbeddingModel{
+			SourceKey:  parts[0],
+			FieldName:  parts[1],
+			Dims:       dims,
+			Similarity: "cosine",
+		}
+		if len(parts) == 4 && parts[3] != "" {
+			model.Similarity = parts[3]
+		}
+
+		models = append(models, model)
+	}
+
+	return models, nil
+}
+
+// LoadEmbeddingModelRegistry builds the registry from the EMBEDDING_MODELS
+// setting, falling back to DefaultEmbeddingModels when it is empty
+func LoadEmbeddingModelRegistry(spec string) (*EmbeddingModelRegistry, error) {
+	models, err := ParseEmbeddingModels(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		models = DefaultEmbeddingModels()
+	}
+	return NewEmbeddingModelRegistry(models)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadFixtureMessage builds a MegaStreamMessage from a test_data fixture
+func loadFixtureMessage(t *testing.T, name string, models *EmbeddingModelRegistry, metrics *Metrics) MegaStreamMessage {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("test_data", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", name, err)
+	}
+
+	var fixture struct {
+		AtURI      string          `json:"at_uri"`
+		DID        string          `json:"did"`
+		Inferences json.RawMessage `json:"inferences"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatalf("Failed to parse fixture %s: %v", name, err)
+	}
+
+	return NewMegaStreamMessage(fixture.AtURI, fixture.DID, string(data), string(fixture.Inferences), models, metrics, NewLogger(false))
+}
+
+func TestParseInferences_IndexesAllRegisteredModels(t *testing.T) {
+	metrics := NewMetrics()
+	msg := loadFixtureMessage(t, "standalone-post.json", DefaultEmbeddingModelRegistry(), metrics)
+
+	expected := map[string]int{
+		"all_MiniLM_L12_v2": 384,
+		"all_MiniLM_L6_v2":  384,
+		"all_mpnet_base_v2": 768,
+	}
+
+	embeddings := msg.GetEmbeddings()
+	if len(embeddings) != len(expected) {
+		t.Errorf("Expected %d embeddings, got %d", len(expected), len(embeddings))
+	}
+
+	for field, dims := range expected {
+		if got := len(embeddings[field]); got != dims {
+			t.Errorf("Expected %s to have %d dims, got %d", field, dims, got)
+		}
+	}
+
+	if got := metrics.Get("embeddings.indexed.all-mpnet-base-v2"); got != 1 {
+		t.Errorf("Expected mpnet embedding to be counted as indexed, got %d", got)
+	}
+}
+
+func TestParseInferences_ReportsUnknownModels(t *testing.T) {
+	models, err := NewEmbeddingModelRegistry(DefaultEmbeddingModels()[:2])
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+
+	metrics := NewMetrics()
+	msg := loadFixtureMessage(t, "quote-post.md.json", models, metrics)
+
+	if _, ok := msg.GetEmbeddings()["all_mpnet_base_v2"]; ok {
+		t.Error("Expected unregistered model not to be indexed")
+	}
+
+	if got := metrics.Get("embeddings.unknown_model"); got != 1 {
+		t.Errorf("Expected unknown model to be reported in metrics, got %d", got)
+	}
+}
+
+func TestEmbeddingModelRegistry_RemembersBoundedUnknownModels(t *testing.T) {
+	models := DefaultEmbeddingModelRegistry()
+
+	if !models.firstUnknown("custom-model") {
+		t.Error("Expected first sighting of an unknown model to be reported")
+	}
+	if models.firstUnknown("custom-model") {
+		t.Error("Expected an unknown model to be reported only once")
+	}
+
+	for i := 0; i < 2*maxReportedUnknownModels; i++ {
+		models.firstUnknown(fmt.Sprintf("model-%d", i))
+	}
+	if len(models.unknown) != maxReportedUnknownModels {
+		t.Errorf("Expected %d unknown models to be remembered, got %d", maxReportedUnknownModels, len(models.unknown))
+	}
+}
+
+func TestParseInferences_ReportsDimensionMismatch(t *testing.T) {
+	models, err := NewEmbeddingModelRegistry([]EmbeddingModel{
+		{SourceKey: "all-mpnet-base-v2", FieldName: "all_mpnet_base_v2", Dims: 384, Similarity: "cosine"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+
+	metrics := NewMetrics()
+	msg := loadFixtureMessage(t, "multiparty-reply-thread.json", models, metrics)
+
+	if len(msg.GetEmbeddings()) != 0 {
+		t.Errorf("Expected no embeddings, got %d", len(msg.GetEmbeddings()))
+	}
+
+	if got := metrics.Get("embeddings.decode_failed.all-mpnet-base-v2"); got != 1 {
+		t.Errorf("Expected decode failure to be reported in metrics, got %d", got)
+	}
+}
+
+func TestParseEmbeddingModels(t *testing.T) {
+	models, err := ParseEmbeddingModels("all-MiniLM-L6-v2:minilm:384, custom:custom_vec:128:dot_product")
+	if err != nil {
+		t.Fatalf("Failed to parse embedding models: %v", err)
+	}
+
+	if len(models) != 2 {
+		t.Fatalf("Expected 2 models, got %d", len(models))
+	}
+
+	if models[0].FieldName != "minilm" || models[0].Dims != 384 || models[0].Similarity != "cosine" {
+		t.Errorf("Unexpected first model: %+v", models[0])
+	}
+
+	if models[1].Similarity != "dot_product" {
+		t.Errorf("Expected explicit similarity, got %s", models[1].Similarity)
+	}
+
+	for _, invalid := range []string{"a:b", "a:b:c", "a:b:1:c:d"} {
+		if _, err := ParseEmbeddingModels(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadEmbeddingModelRegistry(t *testing.T) {
+	registry, err := LoadEmbeddingModelRegistry("")
+	if err != nil {
+		t.Fatalf("Failed to load default registry: %v", err)
+	}
+
+	if len(registry.Models()) != len(DefaultEmbeddingModels()) {
+		t.Errorf("Expected default models when spec is empty, got %d", len(registry.Models()))
+	}
+
+	if _, err := LoadEmbeddingModelRegistry("a:x:384,b:x:384"); err == nil {
+		t.Error("Expected error for duplicate field names")
+	}
+
+	if _, err := LoadEmbeddingModelRegistry("a:x:0"); err == nil {
+		t.Error("Expected error for zero dims")
+	}
+
+	mapping := registry.MappingProperties()
+	mpnet, ok := mapping["all_mpnet_base_v2"].(map[string]interface{})
+	if !ok || mpnet["dims"] != 768 {
+		t.Errorf("Expected mpnet dense_vector mapping with 768 dims, got %v", mapping["all_mpnet_base_v2"])
+	}
+}
+
+// TestMappingProperties_MatchIndexTemplates keeps the embeddings mapping of
+// the deployed posts index templates in step with the default registry
+func TestMappingProperties_MatchIndexTemplates(t *testing.T) {
+	generated, err := json.Marshal(DefaultEmbeddingModelRegistry().MappingProperties())
+	if err != nil {
+		t.Fatalf("Failed to encode mapping properties: %v", err)
+	}
+	var expected map[string]interface{}
+	if err := json.Unmarshal(generated, &expected); err != nil {
+		t.Fatalf("Failed to decode mapping properties: %v", err)
+	}
+
+	paths, err := filepath.Glob("../index/deploy/k8s/environments/*/templates/posts-index-template.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Failed to find posts index templates: %v", err)
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+
+		// The template is a JSON document embedded as a block scalar
+		_, body, ok := strings.Cut(string(data), "posts-index-template.json: |")
+		if !ok {
+			t.Fatalf("Expected %s to embed posts-index-template.json", path)
+		}
+		var template struct {
+			Template struct {
+				Mappings struct {
+					Properties struct {
+						Embeddings struct {
+							Properties map[string]interface{} `json:"properties"`
+						} `json:"embeddings"`
+					} `json:"properties"`
+				} `json:"mappings"`
+			} `json:"template"`
+		}
+		if err := json.Unmarshal([]byte(body), &template); err != nil {
+			t.Fatalf("Failed to parse template in %s: %v", path, err)
+		}
+
+		if got := template.Template.Mappings.Properties.Embeddings.Properties; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Embeddings mapping in %s does not match the model registry:\n got: %v\nwant: %v", path, got, expected)
+		}
+	}
+}
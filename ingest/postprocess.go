@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// PostProcessAction is what happens to a local source file once it has been
+// processed or has failed
+type PostProcessAction string
+
+const (
+	// PostProcessDelete removes the file
+	PostProcessDelete PostProcessAction = "delete"
+	// PostProcessMove moves the file into a dated subdirectory of the archive
+	// or failed directory
+	PostProcessMove PostProcessAction = "move"
+	// PostProcessKeep leaves the file where it is; the state file keeps it
+	// from being processed again
+	PostProcessKeep PostProcessAction = "keep"
+)
+
+// archiveDayLayout names the per-day directories files are moved into
+const archiveDayLayout = "2006-01-02"
+
+// LocalPostProcessConfig controls what happens to local source files after
+// they are handled
+type LocalPostProcessConfig struct {
+	OnSuccess PostProcessAction
+	OnFailure PostProcessAction
+
+	// ArchiveDir and FailedDir receive moved files, in one subdirectory per
+	// UTC day
+	ArchiveDir string
+	FailedDir  string
+
+	// Compress stores moved bare .db files as .db.zst; archives are moved as
+	// they are
+	Compress bool
+
+	// RetentionDays deletes day directories older than this many days after
+	// each move; 0 keeps them forever
+	RetentionDays int
+}
+
+// DefaultLocalPostProcessConfig deletes processed files and leaves failed ones
+// in place, moving nothing
+func DefaultLocalPostProcessConfig(directory string) LocalPostProcessConfig {
+	return LocalPostProcessConfig{
+		OnSuccess:  PostProcessDelete,
+		OnFailure:  PostProcessKeep,
+		ArchiveDir: filepath.Join(directory, "archive"),
+		FailedDir:  filepath.Join(directory, "failed"),
+	}
+}
+
+// parsePostProcessAction validates an action from the configuration
+func parsePostProcessAction(value string) (PostProcessAction, error) {
+	switch action := PostProcessAction(strings.ToLower(strings.TrimSpace(value))); action {
+	case PostProcessDelete, PostProcessMove, PostProcessKeep:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid post-processing action %q (must be delete, move or keep)", value)
+}
+
+// postProcessJob is a file waiting for its post-processing action
+type postProcessJob struct {
+	filename string
+	failed   bool
+}
+
+// postProcessor applies post-processing actions in the background, so that
+// moving or compressing a large file never holds up acknowledgements
+type postProcessor struct {
+	config       LocalPostProcessConfig
+	directory    string
+	stateManager *StateManager
+	logger       *IngestLogger
+	now          func() time.Time
+
+	jobs      chan postProcessJob
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPostProcessor(directory string, config LocalPostProcessConfig, stateManager *StateManager, logger *IngestLogger) *postProcessor {
+	p := &postProcessor{
+		config:       config,
+		directory:    directory,
+		stateManager: stateManager,
+		logger:       logger,
+		now:          time.Now,
+		jobs:         make(chan postProcessJob, 100),
+		done:         make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// submit queues a handled file for its post-processing action
+func (p *postProcessor) submit(filename string, failed bool) {
+	p.jobs <- postProcessJob{filename: filename, failed: failed}
+}
+
+// close waits until every submitted file has been post-processed
+func (p *postProcessor) close() {
+	p.closeOnce.Do(func() {
+		close(p.jobs)
+	})
+	<-p.done
+}
+
+func (p *postProcessor) run() {
+	defer close(p.done)
+
+	for job := range p.jobs {
+		p.apply(job)
+	}
+}
+
+func (p *postProcessor) apply(job postProcessJob) {
+	filePath := filepath.Join(p.directory, job.filename)
+
+	action, destDir := p.config.OnSuccess, p.config.ArchiveDir
+	if job.failed {
+		action, destDir = p.config.OnFailure, p.config.FailedDir
+	}
+
+	switch action {
+	case PostProcessKeep:
+		return
+
+	case PostProcessDelete:
+		if err := os.Remove(filePath); err != nil {
+			p.logger.Error("Failed to remove file %s: %v", filePath, err)
+		} else {
+			p.logger.Debug("Cleaned up file: %s", filePath)
+		}
+
+	case PostProcessMove:
+		dest, err := p.moveFile(filePath, destDir)
+		if err != nil {
+			p.logger.Error("Failed to move file %s to %s: %v", filePath, destDir, err)
+			return
+		}
+		p.logger.Info("Moved %s to %s", job.filename, dest)
+
+		// The file is out of the spool directory, so forgetting it only
+		// matters if someone moves it back to have it processed again
+		if err := p.stateManager.Forget(job.filename); err != nil {
+			p.logger.Error("Failed to forget state of %s: %v", job.filename, err)
+		}
+
+		p.pruneDays(destDir)
+	}
+
+	if err := os.Remove(filePath + doneSuffix); err != nil && !os.IsNotExist(err) {
+		p.logger.Error("Failed to remove marker for %s: %v", filePath, err)
+	}
+}
+
+// moveFile moves filePath into today's subdirectory of destDir, compressing
+// bare databases if configured, and returns its new path
+func (p *postProcessor) moveFile(filePath, destDir string) (string, error) {
+	dayDir := filepath.Join(destDir, p.now().UTC().Format(archiveDayLayout))
+	if err := os.MkdirAll(dayDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	dest := filepath.Join(dayDir, filepath.Base(filePath))
+
+	if p.config.Compress {
+		format, err := sniffFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		if format == formatSQLite {
+			dest += ".zst"
+			if err := compressFile(filePath, dest); err != nil {
+				os.Remove(dest)
+				return "", err
+			}
+			return dest, os.Remove(filePath)
+		}
+	}
+
+	if err := os.Rename(filePath, dest); err == nil {
+		return dest, nil
+	}
+
+	// The destination may be on another filesystem
+	if err := copyFile(filePath, dest); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, os.Remove(filePath)
+}
+
+// pruneDays deletes the day directories of destDir older than the retention
+// period
+func (p *postProcessor) pruneDays(destDir string) {
+	if p.config.RetentionDays <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		p.logger.Error("Failed to read %s: %v", destDir, err)
+		return
+	}
+
+	cutoff := p.now().UTC().AddDate(0, 0, -p.config.RetentionDays).Format(archiveDayLayout)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(archiveDayLayout, entry.Name()); err != nil {
+			continue
+		}
+		// Day names sort chronologically
+		if entry.Name() >= cutoff {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(destDir, entry.Name())); err != nil {
+			p.logger.Error("Failed to remove expired directory %s: %v", entry.Name(), err)
+			continue
+		}
+		p.logger.Info("Removed expired directory %s", filepath.Join(destDir, entry.Name()))
+	}
+}
+
+// compressFile writes a zstd-compressed copy of src to dest
+func compressFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	enc, err := zstd.NewWriter(out)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		enc.Close()
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	return out.Close()
+}
+
+// copyFile copies src to dest
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	return out.Close()
+}
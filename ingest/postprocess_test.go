@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func runLocalOnce(t *testing.T, dir string, sm *StateManager, postProcess LocalPostProcessConfig, ackErr error) int {
+	t.Helper()
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	spooler.postProcess = postProcess
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	count := drainAndAck(t, spooler, ackErr)
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+	return count
+}
+
+func TestParsePostProcessAction(t *testing.T) {
+	for value, want := range map[string]PostProcessAction{"delete": PostProcessDelete, " Move ": PostProcessMove, "keep": PostProcessKeep} {
+		if got, err := parsePostProcessAction(value); err != nil || got != want {
+			t.Errorf("Expected %q to parse as %s, got %s (%v)", value, want, got, err)
+		}
+	}
+	if _, err := parsePostProcessAction("archive"); err == nil {
+		t.Error("Expected an unknown action to be rejected")
+	}
+}
+
+func TestLocalSpooler_ArchivesProcessedFiles(t *testing.T) {
+	dir := t.TempDir()
+	createTestDatabase(t, filepath.Join(dir, "mega_1.db"), 2)
+	createTestZip(t, filepath.Join(dir, "mega_2.db.zip"), 3)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	postProcess := DefaultLocalPostProcessConfig(dir)
+	postProcess.OnSuccess = PostProcessMove
+	postProcess.Compress = true
+	if count := runLocalOnce(t, dir, sm, postProcess, nil); count != 5 {
+		t.Fatalf("Expected 5 rows, got %d", count)
+	}
+
+	dayDir := filepath.Join(dir, "archive", time.Now().UTC().Format(archiveDayLayout))
+	for _, name := range []string{"mega_1.db.zst", "mega_2.db.zip"} {
+		if _, err := os.Stat(filepath.Join(dayDir, name)); err != nil {
+			t.Errorf("Expected %s in the archive: %v", name, err)
+		}
+	}
+	for _, name := range []string{"mega_1.db", "mega_2.db.zip"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be moved out of the spool directory, got %v", name, err)
+		}
+		if sm.IsProcessed(name) {
+			t.Errorf("Expected the state of archived %s to be forgotten", name)
+		}
+	}
+
+	// Moving a day back reprocesses it
+	for _, name := range []string{"mega_1.db.zst", "mega_2.db.zip"} {
+		if err := os.Rename(filepath.Join(dayDir, name), filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Failed to move %s back: %v", name, err)
+		}
+	}
+	if count := runLocalOnce(t, dir, sm, postProcess, nil); count != 5 {
+		t.Errorf("Expected 5 rows after moving the files back, got %d", count)
+	}
+}
+
+func TestLocalSpooler_MovesFailedFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := "mega_1.db.zip"
+	createTestZip(t, filepath.Join(dir, filename), 2)
+	if err := os.WriteFile(filepath.Join(dir, filename+doneSuffix), nil, 0644); err != nil {
+		t.Fatalf("Failed to write marker: %v", err)
+	}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	// Only files that will not be retried are moved
+	sm.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: 0, MaxDelay: 0})
+
+	postProcess := DefaultLocalPostProcessConfig(dir)
+	postProcess.OnFailure = PostProcessMove
+	runLocalOnce(t, dir, sm, postProcess, errors.New("bulk request failed"))
+	if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+		t.Fatalf("Expected file to stay in place while it will be retried: %v", err)
+	}
+	runLocalOnce(t, dir, sm, postProcess, errors.New("bulk request failed"))
+
+	failed := filepath.Join(dir, "failed", time.Now().UTC().Format(archiveDayLayout), filename)
+	if _, err := os.Stat(failed); err != nil {
+		t.Errorf("Expected failed file in the failed directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, filename+doneSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Expected the marker to be removed with the file, got %v", err)
+	}
+	if sm.IsFailed(filename) {
+		t.Error("Expected the state of the moved file to be forgotten")
+	}
+}
+
+func TestLocalSpooler_KeepsProcessedFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := "mega_1.db.zip"
+	createTestZip(t, filepath.Join(dir, filename), 2)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	postProcess := DefaultLocalPostProcessConfig(dir)
+	postProcess.OnSuccess = PostProcessKeep
+	runLocalOnce(t, dir, sm, postProcess, nil)
+
+	if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+		t.Errorf("Expected processed file to be kept: %v", err)
+	}
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected kept file to stay marked processed")
+	}
+	if count := runLocalOnce(t, dir, sm, postProcess, nil); count != 0 {
+		t.Errorf("Expected kept file not to be processed again, got %d rows", count)
+	}
+}
+
+func TestPostProcessor_PrunesExpiredDays(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "archive")
+	for _, day := range []string{"2024-12-01", "2025-01-02", "2025-01-03", "notes"} {
+		if err := os.MkdirAll(filepath.Join(archiveDir, day), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", day, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mega_1.db.zip"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	config := DefaultLocalPostProcessConfig(dir)
+	config.OnSuccess = PostProcessMove
+	config.RetentionDays = 7
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	p := newPostProcessor(dir, config, sm, NewLogger(false))
+	p.now = func() time.Time { return time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC) }
+	p.submit("mega_1.db.zip", false)
+	p.close()
+
+	for day, kept := range map[string]bool{"2024-12-01": false, "2025-01-02": false, "2025-01-03": true, "2025-01-10": true, "notes": true} {
+		_, err := os.Stat(filepath.Join(archiveDir, day))
+		if kept && err != nil {
+			t.Errorf("Expected %s to be kept: %v", day, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", day, err)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3PrefetchConfig controls how S3 files are downloaded ahead of the one
+// being read. With StreamExtract, the database is inflated straight from a
+// ranged read of its zip entry. Otherwise the archive is downloaded first,
+// and objects of at least MultipartThreshold bytes are fetched as ranged
+// parts of PartSize bytes, PartConcurrency at a time.
+type S3PrefetchConfig struct {
+	Files              int // files downloaded ahead of the one being read
+	StreamExtract      bool
+	MultipartThreshold int64
+	PartSize           int64
+	PartConcurrency    int
+}
+
+// DefaultS3PrefetchConfig returns the prefetch settings used when none are
+// configured
+func DefaultS3PrefetchConfig() S3PrefetchConfig {
+	return S3PrefetchConfig{
+		Files:              2,
+		StreamExtract:      true,
+		MultipartThreshold: 64 * 1024 * 1024,
+		PartSize:           16 * 1024 * 1024,
+		PartConcurrency:    4,
+	}
+}
+
+// s3Object is an object to download, as described by HeadObject
+type s3Object struct {
+	key  string
+	size int64
+	etag string
+
+	// md5 is the hex digest of the content when the ETag is one, which is
+	// not the case for multipart uploads or KMS-encrypted objects
+	md5 string
+}
+
+var md5ETag = regexp.MustCompile(`^"?([0-9a-f]{32})"?$`)
+
+// verifyMD5 compares the digest of the downloaded content with the ETag,
+// where the ETag is one
+func (obj s3Object) verifyMD5(sum []byte) error {
+	if obj.md5 == "" {
+		return nil
+	}
+	if got := hex.EncodeToString(sum); got != obj.md5 {
+		return fmt.Errorf("checksum mismatch: got MD5 %s, ETag is %s", got, obj.etag)
+	}
+	return nil
+}
+
+// s3Source is an object to fetch together with what was learned about it
+// before its disk space was reserved
+type s3Source struct {
+	obj     s3Object
+	format  archiveFormat
+	entries []*zip.File // database entries of a zip archive
+}
+
+// prefetchedFile holds the databases extracted from one object, waiting in
+// the scratch space
+type prefetchedFile struct {
+	key   string
+	dir   string
+	paths []string
+	res   *reservation
+	err   error
+
+	// skipped files are leased by another replica, already handled or
+	// flagged as changed
+	skipped bool
+}
+
+// s3Prefetcher downloads and extracts a list of keys in order, keeping up to
+// Files of them ahead of the consumer within the scratch space budget
+type s3Prefetcher struct {
+	ss      *S3Spooler
+	cancel  context.CancelFunc
+	results []chan prefetchedFile
+	pos     int
+	slots   chan struct{}
+	budget  *diskBudget
+	wg      sync.WaitGroup
+}
+
+// startPrefetch begins downloading keys. Every downloaded file must be
+// handed back with release, and close must be called when done.
+func (ss *S3Spooler) startPrefetch(ctx context.Context, keys []string) *s3Prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p := &s3Prefetcher{
+		ss:      ss,
+		cancel:  cancel,
+		results: make([]chan prefetchedFile, len(keys)),
+		slots:   make(chan struct{}, max(ss.prefetch.Files, 0)+1),
+		budget:  ss.scratch.budget,
+	}
+	for i := range p.results {
+		p.results[i] = make(chan prefetchedFile, 1)
+	}
+
+	p.wg.Add(1)
+	go p.run(ctx, keys)
+	return p
+}
+
+// run reserves a slot and disk space for each key in order, so that the file
+// the consumer waits for is never starved by files queued behind it
+func (p *s3Prefetcher) run(ctx context.Context, keys []string) {
+	defer p.wg.Done()
+
+	for i, key := range keys {
+		select {
+		case <-ctx.Done():
+			for j := i; j < len(keys); j++ {
+				p.results[j] <- prefetchedFile{key: keys[j], err: ctx.Err()}
+			}
+			return
+		case p.slots <- struct{}{}:
+		}
+
+		// Claiming only as files are fetched leaves the rest of the list to
+		// other replicas
+		if !p.ss.stateManager.Claim(key) {
+			p.results[i] <- prefetchedFile{key: key, skipped: true}
+			continue
+		}
+
+		src, known, allowance, err := p.ss.inspectObject(ctx, key)
+		if err != nil {
+			p.results[i] <- prefetchedFile{key: key, err: err}
+			continue
+		}
+
+		// The object may have been replaced since it was discovered
+		p.ss.observe(key, src.obj.etag, src.obj.size)
+		if p.ss.stateManager.IsChanged(key) {
+			p.ss.stateManager.Release(key)
+			p.results[i] <- prefetchedFile{key: key, skipped: true}
+			continue
+		}
+
+		res, err := p.budget.reserve(ctx, known, allowance)
+		if err != nil {
+			p.results[i] <- prefetchedFile{key: key, err: err}
+			continue
+		}
+
+		p.wg.Add(1)
+		go func(i int) {
+			defer p.wg.Done()
+			p.results[i] <- p.ss.fetchObject(ctx, src, res)
+		}(i)
+	}
+}
+
+// next waits for the databases of the next key
+func (p *s3Prefetcher) next() prefetchedFile {
+	file := <-p.results[p.pos]
+	p.pos++
+	return file
+}
+
+// release deletes the databases returned by next and frees their slot and
+// disk space
+func (p *s3Prefetcher) release(file prefetchedFile) {
+	if file.dir != "" {
+		os.RemoveAll(file.dir)
+	}
+	if file.res != nil {
+		file.res.release()
+	}
+	<-p.slots
+}
+
+// close cancels outstanding downloads, deletes databases never consumed and
+// gives up their leases
+func (p *s3Prefetcher) close() {
+	p.cancel()
+	for p.pos < len(p.results) {
+		file := p.next()
+		p.ss.stateManager.Release(file.key)
+		p.release(file)
+	}
+	p.wg.Wait()
+}
+
+// headObject looks up the size and ETag of key
+func (ss *S3Spooler) headObject(ctx context.Context, key string) (s3Object, error) {
+	head, err := ss.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ss.bucket),
+		Key:          aws.String(key),
+		RequestPayer: ss.requestPayer,
+	})
+	if err != nil {
+		return s3Object{}, fmt.Errorf("failed to head S3 object: %w", err)
+	}
+
+	obj := s3Object{
+		key:  key,
+		size: aws.ToInt64(head.ContentLength),
+		etag: aws.ToString(head.ETag),
+	}
+	if match := md5ETag.FindStringSubmatch(obj.etag); match != nil &&
+		head.ServerSideEncryption != s3types.ServerSideEncryptionAwsKms &&
+		head.ServerSideEncryption != s3types.ServerSideEncryptionAwsKmsDsse {
+		obj.md5 = match[1]
+	}
+
+	return obj, nil
+}
+
+// inspectObject looks up key and detects its format. It returns the bytes
+// the extracted databases are known to need, and an allowance for those of
+// compressed streams, whose extracted size is only known once written.
+func (ss *S3Spooler) inspectObject(ctx context.Context, key string) (s3Source, int64, int64, error) {
+	obj, err := ss.headObject(ctx, key)
+	if err != nil {
+		return s3Source{}, 0, 0, err
+	}
+
+	reader := &s3ReaderAt{ctx: ctx, ss: ss, obj: obj}
+	format, err := ss.sniffObject(reader)
+	if err != nil {
+		return s3Source{}, 0, 0, err
+	}
+	src := s3Source{obj: obj, format: format}
+
+	switch format {
+	case formatZip:
+		src.entries, err = ss.zipDatabaseEntries(reader)
+		if err != nil {
+			return s3Source{}, 0, 0, err
+		}
+		// The archive itself is only written to disk when not streamed;
+		// fetchObject frees its share once the entries are extracted
+		known := uncompressedSize(src.entries)
+		if !ss.prefetch.StreamExtract {
+			known += obj.size
+		}
+		return src, known, 0, nil
+
+	case formatSQLite:
+		return src, obj.size, 0, nil
+
+	case formatGzip, formatZstd, formatTar:
+		return src, 0, obj.size, nil
+	}
+
+	return s3Source{}, 0, 0, permanent(fmt.Errorf("unrecognized file format"))
+}
+
+// fetchObject extracts the databases of src into a new scratch directory,
+// charging the disk they use to res
+func (ss *S3Spooler) fetchObject(ctx context.Context, src s3Source, res *reservation) prefetchedFile {
+	file := prefetchedFile{key: src.obj.key, res: res}
+
+	dir, err := ss.scratch.mkdirTemp("s3-*")
+	if err != nil {
+		file.err = fmt.Errorf("failed to create temp directory: %w", err)
+		return file
+	}
+
+	var dbPaths []string
+	switch {
+	case src.format == formatZip && ss.prefetch.StreamExtract:
+		for i, entry := range src.entries {
+			dbPath := databasePath(dir, i, entry.Name)
+			if err = ss.streamEntry(ctx, src.obj, entry, dbPath, res); err != nil {
+				err = fmt.Errorf("failed to stream %s from archive: %w", entry.Name, err)
+				break
+			}
+			dbPaths = append(dbPaths, dbPath)
+		}
+
+	case src.format == formatZip:
+		dbPaths, err = ss.downloadAndExtract(ctx, src.obj, dir, res)
+		res.free(src.obj.size)
+
+	case src.format == formatSQLite:
+		dbPath := databasePath(dir, 0, src.obj.key)
+		if err = ss.downloadFile(ctx, src.obj, dbPath, res); err != nil {
+			err = fmt.Errorf("failed to download file: %w", err)
+		}
+		dbPaths = []string{dbPath}
+
+	default:
+		dbPaths, err = ss.extractObject(ctx, src.obj, dir, res)
+		if err != nil {
+			err = fmt.Errorf("failed to extract %s stream: %w", src.format, err)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		file.err = err
+		return file
+	}
+
+	file.dir = dir
+	file.paths = dbPaths
+	return file
+}
+
+// downloadAndExtract downloads the whole zip archive into dir, extracts its
+// databases and removes the archive again
+func (ss *S3Spooler) downloadAndExtract(ctx context.Context, obj s3Object, dir string, res *reservation) ([]string, error) {
+	zipPath := filepath.Join(dir, filepath.Base(obj.key))
+	if err := ss.downloadFile(ctx, obj, zipPath, res); err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer os.Remove(zipPath)
+
+	return extractZip(zipPath, dir, res)
+}
+
+// extractObject reads a compressed stream or tar bundle straight from S3
+// into dir, verifying the object's length and MD5 ETag as it goes
+func (ss *S3Spooler) extractObject(ctx context.Context, obj s3Object, dir string, res *reservation) ([]string, error) {
+	body, err := ss.getRange(ctx, obj, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	hash := md5.New()
+	var n byteCounter
+	tee := io.TeeReader(body, io.MultiWriter(hash, &n))
+
+	dbPaths, err := extractStream(tee, filepath.Base(obj.key), dir, res)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read anything after the end of the stream so the whole object is
+	// verified
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, fmt.Errorf("failed to read S3 object: %w", err)
+	}
+	if int64(n) != obj.size {
+		return nil, fmt.Errorf("downloaded %d bytes, expected %d", n, obj.size)
+	}
+	if err := obj.verifyMD5(hash.Sum(nil)); err != nil {
+		return nil, err
+	}
+
+	return dbPaths, nil
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// downloadFile writes obj to destPath and verifies its length and, where the
+// ETag is an MD5 digest, its content. The bytes written are recorded with res.
+func (ss *S3Spooler) downloadFile(ctx context.Context, obj s3Object, destPath string, res *reservation) error {
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	hash := md5.New()
+	if ss.prefetch.PartSize > 0 && obj.size >= ss.prefetch.MultipartThreshold && obj.size > ss.prefetch.PartSize {
+		err = ss.downloadParts(ctx, obj, outFile, res)
+		if err == nil && obj.md5 != "" {
+			_, err = io.Copy(hash, io.NewSectionReader(outFile, 0, obj.size))
+		}
+	} else {
+		var n int64
+		n, err = ss.downloadRange(ctx, obj, "", io.MultiWriter(res.writer(outFile), hash))
+		if err == nil && n != obj.size {
+			err = fmt.Errorf("downloaded %d bytes, expected %d", n, obj.size)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := obj.verifyMD5(hash.Sum(nil)); err != nil {
+		return err
+	}
+
+	ss.logger.Debug("Downloaded S3 file to: %s", destPath)
+	return nil
+}
+
+// downloadParts fetches obj as concurrent ranged requests written in place
+func (ss *S3Spooler) downloadParts(ctx context.Context, obj s3Object, outFile *os.File, res *reservation) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		cancel()
+	}
+
+	sem := make(chan struct{}, max(ss.prefetch.PartConcurrency, 1))
+	for start := int64(0); start < obj.size && ctx.Err() == nil; start += ss.prefetch.PartSize {
+		end := min(start+ss.prefetch.PartSize, obj.size) - 1
+
+		select {
+		case <-ctx.Done():
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			rng := fmt.Sprintf("bytes=%d-%d", start, end)
+			n, err := ss.downloadRange(ctx, obj, rng, res.writer(io.NewOffsetWriter(outFile, start)))
+			if err == nil && n != end-start+1 {
+				err = fmt.Errorf("downloaded %d bytes of range %s", n, rng)
+			}
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// downloadRange copies the given byte range of obj (or all of it if rng is
+// empty) to w and returns the number of bytes written
+func (ss *S3Spooler) downloadRange(ctx context.Context, obj s3Object, rng string, w io.Writer) (int64, error) {
+	body, err := ss.getRange(ctx, obj, rng)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, fmt.Errorf("failed to write file: %w", err)
+	}
+	return n, nil
+}
+
+// getRange opens the given byte range of obj, or all of it if rng is empty.
+// The request is conditional on the ETag, so an object replaced since
+// HeadObject fails instead of being mixed.
+func (ss *S3Spooler) getRange(ctx context.Context, obj s3Object, rng string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(ss.bucket),
+		Key:          aws.String(obj.key),
+		RequestPayer: ss.requestPayer,
+	}
+	if obj.etag != "" {
+		input.IfMatch = aws.String(obj.etag)
+	}
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+
+	result, err := ss.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 object: %w", err)
+	}
+	return result.Body, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// recordingS3 records the keys fetched through GetObject
+type recordingS3 struct {
+	*fakeS3
+
+	mu      sync.Mutex
+	fetched map[string]int
+}
+
+func (r *recordingS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	r.mu.Lock()
+	r.fetched[aws.ToString(params.Key)]++
+	r.mu.Unlock()
+	return r.fakeS3.GetObject(ctx, params, optFns...)
+}
+
+func (r *recordingS3) wasFetched(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fetched[key] > 0
+}
+
+func TestS3Prefetcher_DownloadsAhead(t *testing.T) {
+	logger := NewLogger(false)
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 1)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	keys := []string{"a/1.db.zip", "a/2.db.zip", "a/3.db.zip"}
+	fake := &recordingS3{fakeS3: &fakeS3{objects: make(map[string][]byte)}, fetched: make(map[string]int)}
+	for _, key := range keys {
+		fake.objects[key] = zipData
+	}
+
+	spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Second, sm, logger)
+	spooler.prefetch.Files = 1
+
+	prefetcher := spooler.startPrefetch(context.Background(), keys)
+	defer prefetcher.close()
+
+	first := prefetcher.next()
+	if first.err != nil {
+		t.Fatalf("Expected first download to succeed: %v", first.err)
+	}
+	if len(first.paths) != 1 || filepath.Base(first.paths[0]) != "0-test.db" {
+		t.Fatalf("Expected the extracted database, got %v", first.paths)
+	}
+	if _, err := os.Stat(first.paths[0]); err != nil {
+		t.Fatalf("Expected extracted database on disk: %v", err)
+	}
+
+	waitFor(t, func() bool { return fake.wasFetched(keys[1]) }, "the next file to be prefetched")
+	time.Sleep(50 * time.Millisecond)
+	if fake.wasFetched(keys[2]) {
+		t.Error("Expected only one file to be downloaded ahead of the one being read")
+	}
+
+	prefetcher.release(first)
+	if _, err := os.Stat(first.paths[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected released file to be deleted, got %v", err)
+	}
+	waitFor(t, func() bool { return fake.wasFetched(keys[2]) }, "the last file to be prefetched after a release")
+}
+
+func TestS3Spooler_RangedDownload(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 5)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	partSize := len(zipData)/3 + 1
+	spooler.prefetch = S3PrefetchConfig{
+		Files:              1,
+		MultipartThreshold: 1,
+		PartSize:           int64(partSize),
+		PartConcurrency:    2,
+	}
+
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 5 {
+		t.Errorf("Expected 5 rows from ranged download, got %d", count)
+	}
+	spooler.Stop()
+
+	if !sm.IsProcessed("megastream/mega_20250101_000000.db.zip") {
+		t.Error("Expected file to be processed")
+	}
+
+	ranges := make(map[string]bool)
+	for _, r := range server.received() {
+		if r.Header.Get("Range") != "" {
+			ranges[r.Header.Get("Range")] = true
+			if r.Header.Get("If-Match") == "" {
+				t.Errorf("Expected ranged request to be conditional on the ETag")
+			}
+		}
+	}
+	for start := 0; start < len(zipData); start += partSize {
+		part := fmt.Sprintf("bytes=%d-%d", start, min(start+partSize, len(zipData))-1)
+		if !ranges[part] {
+			t.Errorf("Expected part %s to be requested, got %v", part, ranges)
+		}
+	}
+}
+
+func TestS3Spooler_ChecksumMismatchFailsFile(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+	server.etags["megastream/mega_20250101_000000.db.zip"] = `"00000000000000000000000000000000"`
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	spooler.prefetch.StreamExtract = false
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 0 {
+		t.Errorf("Expected no rows from a corrupt download, got %d", count)
+	}
+	spooler.Stop()
+
+	if !sm.IsFailed("megastream/mega_20250101_000000.db.zip") {
+		t.Error("Expected file with mismatched checksum to be marked failed")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runReplayCommand implements the replay-dlq subcommand, which re-submits
+// dead-lettered actions to Elasticsearch
+func runReplayCommand(args []string) {
+	config := LoadConfig()
+
+	flags := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	path := flags.String("file", config.DeadLetterPath, "Dead-letter JSONL file to replay")
+	dryRun := flags.Bool("dry-run", false, "Report the entries that would be replayed without sending them")
+	skipTLSVerify := flags.Bool("skip-tls-verify", false, "Skip TLS certificate verification (use for local development only)")
+	flags.Parse(args)
+
+	logger := NewLogger(config.LoggingEnabled)
+	logger.Info("Green Earth Ingex - Dead-Letter Replay")
+
+	if *path == "" {
+		logger.Error("No dead-letter file given (set -file or DEAD_LETTER_PATH)")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		logger.Info("Received shutdown signal, stopping replay...")
+		cancel()
+	}()
+
+	models, err := LoadEmbeddingModelRegistry(config.EmbeddingModels)
+	if err != nil {
+		logger.Error("Invalid EMBEDDING_MODELS configuration: %v", err)
+		os.Exit(1)
+	}
+	metrics := NewMetrics()
+
+	if *dryRun {
+		entries, err := ReadDeadLetters(*path)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(1)
+		}
+		logger.Info("Dry-run: Would replay %d dead-lettered actions from %s", len(entries), *path)
+		return
+	}
+
+	if config.ElasticsearchURL == "" || config.ElasticsearchAPIKey == "" {
+		logger.Error("ELASTICSEARCH_URL and ELASTICSEARCH_API_KEY environment variables are required")
+		os.Exit(1)
+	}
+
+	esClient, err := NewElasticsearchClient(ElasticsearchConfig{
+		URL:           config.ElasticsearchURL,
+		APIKey:        config.ElasticsearchAPIKey,
+		SkipTLSVerify: *skipTLSVerify,
+	}, logger)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+
+	// Move the queue aside so that failures during the replay are appended to
+	// a fresh file at the same path. A running ingester's queue still has the
+	// old file open; the move waits for its current write, and its later
+	// writes go to the fresh file as well.
+	replayPath := *path + ".replaying"
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		if _, err := os.Stat(*path); os.IsNotExist(err) {
+			logger.Info("No dead-lettered actions to replay in %s", *path)
+			return
+		}
+		if err := MoveDeadLetters(*path, replayPath); err != nil {
+			logger.Error("%v", err)
+			os.Exit(1)
+		}
+	} else {
+		logger.Info("Resuming interrupted replay of %s", replayPath)
+	}
+
+	requeue, err := NewDeadLetterQueue(*path)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+	defer requeue.Close()
+
+	indexer := NewBulkIndexer(esClient, BulkIndexerConfig{
+		Index:        "posts",
+		MaxRetries:   config.BulkMaxRetries,
+		RetryBackoff: config.BulkRetryBackoff,
+		DeadLetters:  requeue,
+	}, metrics, logger)
+
+	replayed, err := ReplayDeadLetters(ctx, replayPath, indexer, requeue, models, metrics, logger)
+	if err != nil {
+		logger.Error("Replay failed after %d actions: %v", replayed, err)
+		os.Exit(1)
+	}
+
+	if err := os.Remove(replayPath); err != nil {
+		logger.Error("Failed to remove replayed dead-letter file: %v", err)
+	}
+	if err := os.Remove(replayCheckpointPath(replayPath)); err != nil && !os.IsNotExist(err) {
+		logger.Error("Failed to remove replay checkpoint: %v", err)
+	}
+
+	logger.Info("Replay complete. Replayed: %d, Dead-lettered again: %d", replayed, metrics.Get("bulk.dead_lettered"))
+	logger.Info("Metrics: %s", metrics)
+}
+
+// replayBatchSize is the number of entries replayed between checkpoints
+const replayBatchSize = 100
+
+// replayCheckpointPath returns the file recording how many entries of the
+// dead-letter file at path have been replayed
+func replayCheckpointPath(path string) string {
+	return path + ".offset"
+}
+
+// ReplayDeadLetters re-submits the entries in the dead-letter file at path.
+// Entries are rebuilt from their source rows with the current embedding
+// registry, so fixes to mappings or models apply on replay. Entries that
+// cannot be rebuilt and batches that fail again transiently are written back
+// to requeue unchanged. It returns the number of entries re-submitted.
+//
+// The number of entries handled is checkpointed next to path after every
+// batch, so a cancelled or crashed replay resumes after the last finished
+// batch. Entries whose action is already in requeue, such as those of a batch
+// that was interrupted after being dead-lettered again, are not replayed a
+// second time. The caller removes path and its checkpoint once it is done.
+func ReplayDeadLetters(ctx context.Context, path string, indexer *BulkIndexer, requeue *DeadLetterQueue, models *EmbeddingModelRegistry, metrics *Metrics, logger *IngestLogger) (int, error) {
+	entries, err := ReadDeadLetters(path)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := readReplayCheckpoint(path)
+	if err != nil {
+		return 0, err
+	}
+	offset = min(offset, len(entries))
+
+	queued, err := ReadDeadLetters(requeue.Path())
+	if err != nil {
+		return 0, err
+	}
+	alreadyQueued := make(map[string]bool, len(queued))
+	for _, entry := range queued {
+		alreadyQueued[entry.key()] = true
+	}
+
+	if offset > 0 {
+		logger.Info("Resuming replay of %s after %d of %d dead-lettered actions", path, offset, len(entries))
+	} else {
+		logger.Info("Replaying %d dead-lettered actions from %s", len(entries), path)
+	}
+
+	replayed, skipped := 0, 0
+	for start := offset; start < len(entries); start += replayBatchSize {
+		end := min(start+replayBatchSize, len(entries))
+
+		if ctx.Err() != nil {
+			return replayed, fmt.Errorf("replay cancelled after %d of %d entries: %w", start, len(entries), ctx.Err())
+		}
+
+		var replayable, unreplayable []DeadLetterEntry
+		var actions []BulkAction
+		for _, entry := range entries[start:end] {
+			if alreadyQueued[entry.key()] {
+				skipped++
+				continue
+			}
+			action, ok := entry.action(models, metrics, logger)
+			if !ok {
+				unreplayable = append(unreplayable, entry)
+				continue
+			}
+			replayable = append(replayable, entry)
+			actions = append(actions, action)
+		}
+
+		if len(unreplayable) > 0 {
+			logger.Error("Keeping %d dead-lettered actions without a source row", len(unreplayable))
+			if err := requeue.Write(unreplayable); err != nil {
+				return replayed, err
+			}
+		}
+
+		if len(actions) > 0 {
+			if err := indexer.Index(ctx, actions); err != nil {
+				logger.Error("Failed to replay batch, keeping it in the dead-letter queue: %v", err)
+				if err := requeue.Write(replayable); err != nil {
+					return replayed, err
+				}
+			} else {
+				replayed += len(actions)
+			}
+		}
+
+		if err := writeReplayCheckpoint(path, end); err != nil {
+			return replayed, err
+		}
+	}
+
+	if skipped > 0 {
+		logger.Info("Skipped %d dead-lettered actions already queued again", skipped)
+	}
+
+	return replayed, nil
+}
+
+// readReplayCheckpoint returns the number of entries of the dead-letter file
+// at path already replayed, which is 0 if no replay of it was checkpointed
+func readReplayCheckpoint(path string) (int, error) {
+	data, err := os.ReadFile(replayCheckpointPath(path))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read replay checkpoint: %w", err)
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid replay checkpoint %q in %s", data, replayCheckpointPath(path))
+	}
+	return offset, nil
+}
+
+// writeReplayCheckpoint records that the first offset entries of the
+// dead-letter file at path have been replayed
+func writeReplayCheckpoint(path string, offset int) error {
+	if err := writeFileAtomic(replayCheckpointPath(path), []byte(strconv.Itoa(offset)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write replay checkpoint: %w", err)
+	}
+	return nil
+}
+
+// key identifies the action of a dead-letter entry, regardless of when and
+// why it was dead-lettered
+func (e DeadLetterEntry) key() string {
+	return fmt.Sprintf("%s %s %d", e.Op, e.ID, e.Version)
+}
+
+// action rebuilds the bulk action of a dead-letter entry. Entries without a
+// source row can only be replayed if they are deletes.
+func (e DeadLetterEntry) action(models *EmbeddingModelRegistry, metrics *Metrics, logger *IngestLogger) (BulkAction, bool) {
+	if record := e.Record(); record != nil {
+		return NewBulkActionFromRecord(*record, models, metrics, logger), true
+	}
+
+	if e.Op == BulkOpDelete && e.ID != "" {
+		return NewDeleteAction(e.ID, e.Version), true
+	}
+
+	return BulkAction{}, false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+)
+
+// compactionInterval is the least time between two compactions of the state,
+// which are attempted on every discovery pass
+const compactionInterval = time.Hour
+
+// RetentionPolicy decides how long the entries of processed files are kept.
+// Entries older than MaxAge are pruned and counted in the summary of the day
+// they were processed on. A zero MaxAge keeps every entry.
+type RetentionPolicy struct {
+	MaxAge time.Duration
+}
+
+// DaySummary counts the pruned entries of the files processed on a day
+type DaySummary struct {
+	Processed int `json:"processed"`
+}
+
+func (s DaySummary) add(delta DaySummary) DaySummary {
+	s.Processed += delta.Processed
+	return s
+}
+
+// SetRetentionPolicy replaces the policy applied by later calls to Compact
+func (sm *StateManager) SetRetentionPolicy(policy RetentionPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.retention = policy
+}
+
+// Summaries returns the summaries of pruned entries, keyed by UTC day
+// (YYYY-MM-DD)
+func (sm *StateManager) Summaries() map[string]DaySummary {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return maps.Clone(sm.summaries)
+}
+
+// Compact prunes the entries of processed files older than the retention
+// policy allows, for which prunable reports that the file will not be seen
+// again, and adds them to the summaries of the days they were processed on.
+// It returns the number of entries pruned. Compaction runs at most once per
+// compactionInterval; calls in between do nothing.
+//
+// prunable is called with the state locked and must not call back into sm.
+func (sm *StateManager) Compact(prunable func(filename string) bool) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.retention.MaxAge <= 0 {
+		return 0, nil
+	}
+	now := sm.now()
+	if now.Sub(sm.compacted) < compactionInterval {
+		return 0, nil
+	}
+	sm.compacted = now
+
+	cutoff := now.Add(-sm.retention.MaxAge)
+	var pruned []string
+	for filename, entry := range sm.state {
+		if entry.Status != FileStatusProcessed || !entry.Timestamp.Before(cutoff) || !prunable(filename) {
+			continue
+		}
+		pruned = append(pruned, filename)
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	sort.Strings(pruned)
+
+	// Entries are deleted before they are counted, so that a failure loses
+	// counts rather than counting a file that is still in the state. Only
+	// the entries the backend found are counted, since another replica
+	// sharing it may have pruned the rest already.
+	deleted, err := sm.backend.DeleteFiles(pruned...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune state entries: %w", err)
+	}
+	counts := make(map[string]int)
+	for _, filename := range deleted {
+		counts[sm.state[filename].Timestamp.UTC().Format(time.DateOnly)]++
+	}
+	for _, filename := range pruned {
+		delete(sm.state, filename)
+	}
+
+	days := make([]string, 0, len(counts))
+	for day := range counts {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days {
+		summary, err := sm.backend.AddSummary(day, DaySummary{Processed: counts[day]})
+		if err != nil {
+			return len(pruned), fmt.Errorf("failed to write summary for %s: %w", day, err)
+		}
+		sm.summaries[day] = summary
+	}
+
+	sm.logger.Info("Pruned %d processed entries older than %s into %d daily summaries", len(pruned), cutoff.UTC().Format(time.RFC3339), len(days))
+	return len(pruned), nil
+}
+
+// compactState compacts the state of the spooler, sparing the entries of the
+// files in seen, which discovery could still return
+func (bs *baseSpooler) compactState(seen map[string]bool) {
+	if _, err := bs.stateManager.Compact(func(filename string) bool { return !seen[filename] }); err != nil {
+		bs.logger.Error("Failed to compact state: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// agedStateManager marks the given files processed and moves the clock of sm
+// 31 days on, with a 30-day retention
+func agedStateManager(t *testing.T, sm *StateManager, processed ...string) {
+	t.Helper()
+
+	for _, filename := range processed {
+		if err := sm.MarkProcessed(filename); err != nil {
+			t.Fatalf("Failed to mark file as processed: %v", err)
+		}
+	}
+	sm.SetRetentionPolicy(RetentionPolicy{MaxAge: 30 * 24 * time.Hour})
+	now := time.Now().Add(31 * 24 * time.Hour)
+	sm.now = func() time.Time { return now }
+}
+
+func TestStateManager_Compact(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name string
+		open func() *StateManager
+	}{
+		{"json", func() *StateManager {
+			sm, err := NewStateManager(filepath.Join(dir, "state.json"), NewLogger(false))
+			if err != nil {
+				t.Fatalf("Failed to create state manager: %v", err)
+			}
+			return sm
+		}},
+		{"sqlite", func() *StateManager {
+			return newSQLiteStateManager(t, filepath.Join(dir, "state.db"), "")
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := tc.open()
+			if err := sm.MarkFailed("failed.db.zip", "timeout"); err != nil {
+				t.Fatalf("Failed to mark file as failed: %v", err)
+			}
+			agedStateManager(t, sm, "a.db.zip", "b.db.zip", "listed.db.zip")
+			day := time.Now().UTC().Format(time.DateOnly)
+
+			pruned, err := sm.Compact(func(filename string) bool { return filename != "listed.db.zip" })
+			if err != nil {
+				t.Fatalf("Failed to compact state: %v", err)
+			}
+			if pruned != 2 || sm.IsProcessed("a.db.zip") || sm.IsProcessed("b.db.zip") {
+				t.Errorf("Expected the 2 unlisted processed entries to be pruned, got %d", pruned)
+			}
+			if !sm.IsProcessed("listed.db.zip") || !sm.IsFailed("failed.db.zip") {
+				t.Error("Expected listed and failed entries to be kept")
+			}
+			if got := sm.Summaries()[day].Processed; got != 2 {
+				t.Errorf("Expected 2 processed files in the summary of %s, got %d", day, got)
+			}
+
+			// Compaction waits for the interval to pass
+			if pruned, _ := sm.Compact(func(string) bool { return true }); pruned != 0 {
+				t.Errorf("Expected no compaction within the interval, got %d pruned", pruned)
+			}
+			later := sm.now().Add(compactionInterval)
+			sm.now = func() time.Time { return later }
+			if pruned, _ := sm.Compact(func(string) bool { return true }); pruned != 1 {
+				t.Errorf("Expected the listed entry to be pruned once unlisted, got %d pruned", pruned)
+			}
+			sm.Close()
+
+			sm = tc.open()
+			defer sm.Close()
+			if len(sm.Entries()) != 1 || sm.Summaries()[day].Processed != 3 {
+				t.Errorf("Expected pruning and summaries to persist, got %+v and %+v", sm.Entries(), sm.Summaries())
+			}
+		})
+	}
+}
+
+func TestStateManager_CompactKeepsEverythingByDefault(t *testing.T) {
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	agedStateManager(t, sm, "a.db.zip")
+	sm.SetRetentionPolicy(RetentionPolicy{})
+
+	if pruned, err := sm.Compact(func(string) bool { return true }); err != nil || pruned != 0 {
+		t.Errorf("Expected nothing to be pruned without a retention, got %d (%v)", pruned, err)
+	}
+}
+
+func TestLocalSpooler_PrunesEntriesOfRemovedFiles(t *testing.T) {
+	dir := t.TempDir()
+	createTestZip(t, filepath.Join(dir, "kept.db.zip"), 2)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	agedStateManager(t, sm, "kept.db.zip", "removed.db.zip")
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	if _, err := spooler.discoverFiles(); err != nil {
+		t.Fatalf("Failed to discover files: %v", err)
+	}
+
+	if !sm.IsProcessed("kept.db.zip") {
+		t.Error("Expected the entry of a file still in the directory to be kept")
+	}
+	if _, exists := sm.Entry("removed.db.zip"); exists {
+		t.Error("Expected the entry of a removed file to be pruned")
+	}
+}
+
+func TestS3Spooler_PrunesEntriesBelowWatermark(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	fake := &fakeS3{objects: map[string][]byte{
+		"a/mega_1.db.zip": zipData,
+		"a/mega_2.db.zip": zipData,
+		"a/mega_3.db.zip": zipData,
+	}, pageSize: 10}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	if err := sm.MarkFailed("a/mega_2.db.zip", "timeout"); err != nil {
+		t.Fatalf("Failed to mark file as failed: %v", err)
+	}
+	agedStateManager(t, sm, "a/mega_1.db.zip", "a/mega_3.db.zip")
+	if err := sm.SetWatermark("s3://bucket/a/", "a/mega_1.db.zip"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+
+	// mega_2 holds the watermark at mega_1, so mega_3 is still listed
+	spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Second, sm, NewLogger(false))
+	if _, err := spooler.discoverFiles(context.Background()); err != nil {
+		t.Fatalf("Failed to discover files: %v", err)
+	}
+
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_1.db.zip" {
+		t.Fatalf("Expected the watermark to stay at mega_1, got %q", got)
+	}
+	if _, exists := sm.Entry("a/mega_1.db.zip"); exists {
+		t.Error("Expected the entry below the watermark to be pruned")
+	}
+	if !sm.IsProcessed("a/mega_3.db.zip") {
+		t.Error("Expected the entry above the watermark to be kept")
+	}
+}
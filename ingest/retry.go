@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// RetryPolicy decides when a failed file is attempted again. The delay
+// doubles after every failed attempt, starting at BaseDelay and capped at
+// MaxDelay. A file that has failed MaxAttempts times is quarantined.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Hour,
+	}
+}
+
+// delay returns how long to wait before the attempt following the given
+// number of failed attempts
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return min(d, p.MaxDelay)
+}
+
+// permanentError marks a failure that retrying cannot fix, such as a corrupt
+// archive
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// corruptionErrors are returned by the decoders for malformed input
+var corruptionErrors = []error{
+	zip.ErrFormat,
+	zip.ErrAlgorithm,
+	zip.ErrChecksum,
+	gzip.ErrHeader,
+	gzip.ErrChecksum,
+	tar.ErrHeader,
+	zstd.ErrMagicMismatch,
+	zstd.ErrReservedBlockType,
+	zstd.ErrCRCMismatch,
+	zstd.ErrFrameSizeMismatch,
+}
+
+// isRetryable reports whether a file that failed with err may succeed on a
+// later attempt. Corrupt or unreadable content fails the same way every
+// time, while network errors, timeouts, full disks and rejected bulk
+// requests are usually transient.
+func isRetryable(err error) bool {
+	var perm permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+
+	var corrupt flate.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return false
+	}
+
+	for _, target := range corruptionErrors {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
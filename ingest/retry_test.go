@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, expected := range want {
+		if got := policy.delay(i + 1); got != expected {
+			t.Errorf("Expected delay %v after %d attempts, got %v", expected, i+1, got)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network", fmt.Errorf("failed to download file: %w", context.DeadlineExceeded), true},
+		{"disk", fmt.Errorf("failed to extract: %w", errInsufficientDisk), true},
+		{"bulk", errors.New("bulk request failed"), true},
+		{"corrupt zip", fmt.Errorf("failed to unzip file: %w", zip.ErrFormat), false},
+		{"permanent", fmt.Errorf("failed to process: %w", permanent(errors.New("unrecognized file format"))), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("Expected isRetryable to be %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLocalSpooler_QuarantinesCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.db.zip"), []byte("not an archive"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	runLocalOnce(t, dir, sm, DefaultLocalPostProcessConfig(dir), nil)
+
+	if !sm.IsQuarantined("corrupt.db.zip") {
+		t.Error("Expected a corrupt file to be quarantined without retries")
+	}
+}
+
+func TestLocalSpooler_RetriesTransientFailure(t *testing.T) {
+	dir := t.TempDir()
+	filename := "mega_1.db.zip"
+	createTestZip(t, filepath.Join(dir, filename), 2)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+
+	postProcess := DefaultLocalPostProcessConfig(dir)
+	runLocalOnce(t, dir, sm, postProcess, errors.New("bulk request failed"))
+	if !sm.IsFailed(filename) || sm.IsQuarantined(filename) {
+		t.Fatal("Expected a transient failure to be retried")
+	}
+
+	if count := runLocalOnce(t, dir, sm, postProcess, nil); count != 0 {
+		t.Errorf("Expected no retry before the backoff has passed, got %d rows", count)
+	}
+
+	now = sm.RetryAt(filename)
+	if count := runLocalOnce(t, dir, sm, postProcess, nil); count != 2 {
+		t.Errorf("Expected the retry to process 2 rows, got %d", count)
+	}
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected the retried file to be processed")
+	}
+}
+
+func TestS3Spooler_FailedFileHoldsWatermark(t *testing.T) {
+	logger := NewLogger(false)
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	fake := &fakeS3{objects: map[string][]byte{"a/mega_1.db.zip": zipData}, pageSize: 10}
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	now := time.Now()
+	sm.now = func() time.Time { return now }
+
+	run := func(ackErr error) int {
+		spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Second, sm, logger)
+		if err := spooler.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start spooler: %v", err)
+		}
+		count := drainAndAck(t, spooler, ackErr)
+		spooler.Stop()
+		return count
+	}
+
+	run(errors.New("bulk request failed"))
+	if !sm.IsFailed("a/mega_1.db.zip") {
+		t.Fatal("Expected file to be marked failed")
+	}
+
+	run(nil)
+	if got := sm.Watermark("s3://bucket/a/"); got != "" {
+		t.Errorf("Expected the watermark to wait for the retry, got %q", got)
+	}
+
+	now = sm.RetryAt("a/mega_1.db.zip")
+	if count := run(nil); count != 2 {
+		t.Errorf("Expected the retry to process 2 rows, got %d", count)
+	}
+	run(nil)
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_1.db.zip" {
+		t.Errorf("Expected the watermark to advance once the retry succeeded, got %q", got)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sqsAPI is the subset of the SQS client used for S3 event notifications
+type sqsAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// s3EventNotification is the body of an S3 event notification message
+type s3EventNotification struct {
+	// Event is set to "s3:TestEvent" on the test message S3 sends when
+	// notifications are configured
+	Event   string `json:"Event"`
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsEnvelope wraps a notification that was fanned out through SNS
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// s3EventObject is an object announced by an ObjectCreated record
+type s3EventObject struct {
+	bucket string
+	key    string
+	etag   string
+	size   int64
+}
+
+// parseS3Event returns the object of every ObjectCreated record in an SQS
+// message body, unwrapping SNS envelopes. Test events yield no objects.
+func parseS3Event(body string) ([]s3EventObject, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	var event s3EventNotification
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, fmt.Errorf("failed to parse S3 event notification: %w", err)
+	}
+
+	var objects []s3EventObject
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+
+		// Keys are URL-encoded in notifications, with spaces as '+'
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode S3 key %q: %w", record.S3.Object.Key, err)
+		}
+		objects = append(objects, s3EventObject{
+			bucket: record.S3.Bucket.Name,
+			key:    key,
+			etag:   record.S3.Object.ETag,
+			size:   record.S3.Object.Size,
+		})
+	}
+
+	return objects, nil
+}
+
+// sqsMessage is a received notification whose files are still being processed
+type sqsMessage struct {
+	id            string
+	receiptHandle string
+	pending       map[string]bool
+}
+
+// s3Notifications tracks which SQS messages announced which S3 keys, so that
+// a message is deleted only once every file it announced has been processed.
+// Completed messages are deleted in the background, so that acknowledgments
+// never wait for SQS.
+type s3Notifications struct {
+	client   sqsAPI
+	queueURL string
+	logger   *IngestLogger
+	deletes  chan sqsMessage
+	deleted  chan struct{}
+
+	mu       sync.Mutex
+	messages map[string]*sqsMessage
+	byKey    map[string][]*sqsMessage
+	closed   bool
+}
+
+func newS3Notifications(client sqsAPI, queueURL string, logger *IngestLogger) *s3Notifications {
+	n := &s3Notifications{
+		client:   client,
+		queueURL: queueURL,
+		logger:   logger,
+		deletes:  make(chan sqsMessage, 1000),
+		deleted:  make(chan struct{}),
+		messages: make(map[string]*sqsMessage),
+		byKey:    make(map[string][]*sqsMessage),
+	}
+
+	go n.runDeletes()
+
+	return n
+}
+
+// consumeNotifications feeds keys from S3 ObjectCreated notifications into
+// processFiles. In once mode it returns when the queue is empty.
+func (ss *S3Spooler) consumeNotifications(ctx context.Context) {
+	defer close(ss.records)
+
+	waitSeconds := int32(20)
+	if ss.mode == "once" {
+		waitSeconds = 1
+	}
+
+	var compacted time.Time
+	for {
+		if ctx.Err() != nil {
+			ss.logger.Info("Context cancelled, stopping S3 notification consumer")
+			return
+		}
+
+		out, err := ss.notifications.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(ss.notifications.queueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     waitSeconds,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			ss.logger.Error("Failed to receive S3 notifications: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(ss.interval):
+			}
+			continue
+		}
+
+		// Notifications are not replayed once deleted, so any old entry can
+		// be pruned; the retention must exceed the queue's message retention.
+		// Receives are frequent, so the state is not even locked to check
+		// whether compaction is due more often than it can run.
+		if time.Since(compacted) >= compactionInterval {
+			compacted = time.Now()
+			ss.compactState(nil)
+		}
+
+		if len(out.Messages) == 0 {
+			if ss.mode == "once" {
+				ss.logger.Info("Notification queue is empty, exiting spooler")
+				return
+			}
+			continue
+		}
+
+		keys := ss.receiveNotifications(ctx, out.Messages)
+		if len(keys) > 0 {
+			ss.logger.Info("Discovered %d unprocessed files from S3 notifications", len(keys))
+			ss.processFiles(ctx, keys, ss.notifications.complete)
+		}
+	}
+}
+
+// receiveNotifications registers received messages and returns the keys that
+// still need processing. Messages announcing nothing left to process are
+// deleted right away.
+func (ss *S3Spooler) receiveNotifications(ctx context.Context, messages []sqstypes.Message) []string {
+	n := ss.notifications
+	var keys []string
+
+	for _, message := range messages {
+		id := aws.ToString(message.MessageId)
+		receipt := aws.ToString(message.ReceiptHandle)
+
+		n.mu.Lock()
+		tracked, redelivered := n.messages[id]
+		var pendingKeys []string
+		if redelivered {
+			// The visibility timeout expired while its files were in flight.
+			// Only the newest receipt handle can delete the message.
+			tracked.receiptHandle = receipt
+			for key := range tracked.pending {
+				pendingKeys = append(pendingKeys, key)
+			}
+		}
+		n.mu.Unlock()
+
+		if redelivered {
+			// Files that failed are never completed; release their message
+			// once they are quarantined, and retry them while they are not
+			for _, key := range pendingKeys {
+				switch {
+				case ss.isHandled(key):
+					n.complete(key)
+				case ss.stateManager.RetryDue(key) && !ss.isPending(key) && !slices.Contains(keys, key):
+					keys = append(keys, key)
+				}
+			}
+			continue
+		}
+
+		objects, err := parseS3Event(aws.ToString(message.Body))
+		if err != nil {
+			// It would fail the same way on every redelivery
+			ss.logger.Error("Deleting unparseable SQS message %s: %v", id, err)
+			n.delete(ctx, id, receipt)
+			continue
+		}
+
+		msg := &sqsMessage{id: id, receiptHandle: receipt, pending: make(map[string]bool)}
+		for _, object := range objects {
+			key := object.key
+			if object.bucket != ss.bucket || !ss.matchesPrefix(key) || !isSourceFile(key) {
+				ss.logger.Debug("Ignoring notification for s3://%s/%s", object.bucket, key)
+				continue
+			}
+			ss.adoptLegacyEntry(key)
+			if object.etag != "" {
+				ss.observe(key, object.etag, object.size)
+			}
+			if ss.isHandled(key) {
+				ss.logger.Debug("Skipping already handled file: %s", key)
+				continue
+			}
+			msg.pending[key] = true
+		}
+
+		if len(msg.pending) == 0 {
+			n.delete(ctx, msg.id, msg.receiptHandle)
+			continue
+		}
+
+		n.mu.Lock()
+		n.messages[id] = msg
+		for key := range msg.pending {
+			// A file waiting for its retry is picked up when the message is
+			// received again after its visibility timeout
+			if len(n.byKey[key]) == 0 && !ss.awaitingRetry(key) {
+				keys = append(keys, key)
+			}
+			n.byKey[key] = append(n.byKey[key], msg)
+		}
+		n.mu.Unlock()
+	}
+
+	return keys
+}
+
+// complete records that key has been processed and queues the deletion of
+// every message that has no other pending files
+func (n *s3Notifications) complete(key string) {
+	n.mu.Lock()
+	var done []sqsMessage
+	for _, msg := range n.byKey[key] {
+		delete(msg.pending, key)
+		if len(msg.pending) == 0 {
+			delete(n.messages, msg.id)
+			done = append(done, sqsMessage{id: msg.id, receiptHandle: msg.receiptHandle})
+		}
+	}
+	delete(n.byKey, key)
+
+	closed := n.closed
+	if !closed {
+		for _, msg := range done {
+			n.deletes <- msg
+		}
+	}
+	n.mu.Unlock()
+
+	if closed {
+		for _, msg := range done {
+			n.deleteCompleted(msg)
+		}
+	}
+}
+
+// runDeletes deletes completed messages until close is called
+func (n *s3Notifications) runDeletes() {
+	defer close(n.deleted)
+
+	for msg := range n.deletes {
+		n.deleteCompleted(msg)
+	}
+}
+
+// deleteCompleted deletes a message whose files have all been processed.
+// Deletion happens after the ingestion context may have been cancelled, so it
+// gets its own deadline.
+func (n *s3Notifications) deleteCompleted(msg sqsMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n.delete(ctx, msg.id, msg.receiptHandle)
+}
+
+// close waits for the deletion of every completed message
+func (n *s3Notifications) close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.deletes)
+	}
+	n.mu.Unlock()
+
+	<-n.deleted
+}
+
+func (n *s3Notifications) delete(ctx context.Context, id, receiptHandle string) {
+	_, err := n.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(n.queueURL),
+		ReceiptHandle: aws.String(receiptHandle),
+	})
+	if err != nil {
+		n.logger.Error("Failed to delete SQS message %s, it will be received again: %v", id, err)
+		return
+	}
+	n.logger.Debug("Deleted SQS message %s", id)
+}
+
+// isHandled reports whether the file behind key is already processed or
+// quarantined
+func (ss *S3Spooler) isHandled(key string) bool {
+	return ss.stateManager.IsProcessed(key) || ss.stateManager.IsQuarantined(key)
+}
+
+// awaitingRetry reports whether the file behind key failed and is not yet due
+// for another attempt, or was flagged as changed and awaits a manual retry
+func (ss *S3Spooler) awaitingRetry(key string) bool {
+	if ss.stateManager.IsChanged(key) {
+		return true
+	}
+	return ss.stateManager.IsFailed(key) && !ss.stateManager.IsQuarantined(key) && !ss.stateManager.RetryDue(key)
+}
+
+func (ss *S3Spooler) matchesPrefix(key string) bool {
+	for _, prefix := range ss.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// fakeSQS hands out queued messages once and records deleted receipt handles
+type fakeSQS struct {
+	mu       sync.Mutex
+	queue    []sqstypes.Message
+	deleted  []string
+	received int
+}
+
+func (f *fakeSQS) send(id, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, sqstypes.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("receipt-" + id),
+		Body:          aws.String(body),
+	})
+}
+
+func (f *fakeSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.received++
+
+	n := min(int(params.MaxNumberOfMessages), len(f.queue))
+	out := &sqs.ReceiveMessageOutput{Messages: f.queue[:n]}
+	f.queue = f.queue[n:]
+	return out, nil
+}
+
+func (f *fakeSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) deletedHandles() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+func s3EventBody(bucket string, keys ...string) string {
+	records := ""
+	for i, key := range keys {
+		if i > 0 {
+			records += ","
+		}
+		records += fmt.Sprintf(`{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":%q},"object":{"key":%q}}}`, bucket, key)
+	}
+	return `{"Records":[` + records + `]}`
+}
+
+func TestParseS3Event(t *testing.T) {
+	objects, err := parseS3Event(`{"Records":[{"eventName":"ObjectCreated:CompleteMultipartUpload","s3":{"bucket":{"name":"b"},"object":{"key":"dir/my+file%3D1.db.zip"}}},{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"b"},"object":{"key":"gone.db.zip"}}}]}`)
+	if err != nil {
+		t.Fatalf("Failed to parse event: %v", err)
+	}
+	if len(objects) != 1 || objects[0] != (s3EventObject{bucket: "b", key: "dir/my file=1.db.zip"}) {
+		t.Errorf("Expected one decoded ObjectCreated key, got %v", objects)
+	}
+
+	wrapped := fmt.Sprintf(`{"Type":"Notification","Message":%q}`, s3EventBody("b", "x.db.zip"))
+	if objects, err := parseS3Event(wrapped); err != nil || len(objects) != 1 {
+		t.Errorf("Expected SNS-wrapped event to be unwrapped, got %v (%v)", objects, err)
+	}
+
+	if objects, err := parseS3Event(`{"Event":"s3:TestEvent","Bucket":"b"}`); err != nil || len(objects) != 0 {
+		t.Errorf("Expected test event to yield no objects, got %v (%v)", objects, err)
+	}
+
+	if _, err := parseS3Event("not json"); err == nil {
+		t.Error("Expected error for invalid message body")
+	}
+}
+
+func TestS3Spooler_DeletesNotificationsAfterAck(t *testing.T) {
+	logger := NewLogger(false)
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	s3Client := &fakeS3{objects: map[string][]byte{
+		"a/one.db.zip":  zipData,
+		"a/two.db.zip":  zipData,
+		"a/done.db.zip": zipData,
+	}, pageSize: 10}
+
+	queue := &fakeSQS{}
+	queue.send("m1", s3EventBody("bucket", "a/one.db.zip", "a/two.db.zip"))
+	queue.send("m2", s3EventBody("bucket", "a/done.db.zip"))
+	queue.send("m3", s3EventBody("other-bucket", "a/one.db.zip"))
+	queue.send("m4", `{"Event":"s3:TestEvent"}`)
+	queue.send("m5", "not json")
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	// Entry of an earlier version, under the base name of a/done.db.zip
+	sm.MarkProcessed("done.db.zip")
+
+	spooler := newS3SpoolerWithClient(s3Client, "bucket", []string{"a/"}, "once", time.Millisecond, sm, logger)
+	spooler.notifications = newS3Notifications(queue, "https://sqs.local/queue", logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+
+	var held []Record
+	for len(held) < 4 {
+		select {
+		case record := <-spooler.Records():
+			held = append(held, record)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for records, got %d", len(held))
+		}
+	}
+
+	for _, handle := range queue.deletedHandles() {
+		if handle == "receipt-m1" {
+			t.Fatal("Expected message to be kept until its files are acknowledged")
+		}
+	}
+
+	for _, record := range held {
+		spooler.Ack(Ack{Token: record.Token, Count: 1})
+	}
+	drainAndAck(t, spooler, nil)
+	spooler.Stop()
+
+	deleted := make(map[string]bool)
+	for _, handle := range queue.deletedHandles() {
+		deleted[handle] = true
+	}
+	for _, handle := range []string{"receipt-m1", "receipt-m2", "receipt-m3", "receipt-m4", "receipt-m5"} {
+		if !deleted[handle] {
+			t.Errorf("Expected %s to be deleted, deleted: %v", handle, queue.deletedHandles())
+		}
+	}
+
+	if !sm.IsProcessed("a/one.db.zip") || !sm.IsProcessed("a/two.db.zip") {
+		t.Error("Expected both announced files to be processed")
+	}
+}
+
+// blockingSQS holds every DeleteMessage call until release is closed
+type blockingSQS struct {
+	*fakeSQS
+	release chan struct{}
+}
+
+func (b *blockingSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	<-b.release
+	return b.fakeSQS.DeleteMessage(ctx, params, optFns...)
+}
+
+func TestS3Notifications_CompleteDoesNotWaitForSQS(t *testing.T) {
+	queue := &blockingSQS{fakeSQS: &fakeSQS{}, release: make(chan struct{})}
+	n := newS3Notifications(queue, "https://sqs.local/queue", NewLogger(false))
+
+	msg := &sqsMessage{id: "m1", receiptHandle: "receipt-m1", pending: map[string]bool{"a/one.db.zip": true}}
+	n.messages[msg.id] = msg
+	n.byKey["a/one.db.zip"] = []*sqsMessage{msg}
+
+	completed := make(chan struct{})
+	go func() {
+		n.complete("a/one.db.zip")
+		close(completed)
+	}()
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected complete to return while SQS is slow")
+	}
+
+	close(queue.release)
+	n.close()
+	if deleted := queue.deletedHandles(); len(deleted) != 1 || deleted[0] != "receipt-m1" {
+		t.Errorf("Expected the message to be deleted by close, got %v", deleted)
+	}
+}
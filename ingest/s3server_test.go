@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3StandIn is an in-process, path-style S3 endpoint serving ListObjectsV2,
+// HeadObject and (ranged) GetObject from memory, so that the spooler can be exercised through the
+// real AWS SDK client
+type s3StandIn struct {
+	*httptest.Server
+
+	bucket   string
+	pageSize int
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	etags    map[string]string
+	requests []*http.Request
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	KeyCount              int      `xml:"KeyCount"`
+	MaxKeys               int      `xml:"MaxKeys"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+}
+
+func newS3StandIn(t *testing.T, bucket string) *s3StandIn {
+	t.Helper()
+
+	s := &s3StandIn{bucket: bucket, pageSize: 1000, objects: make(map[string][]byte), etags: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *s3StandIn) put(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+}
+
+func (s *s3StandIn) received() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+func (s *s3StandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Clone(context.Background()))
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || bucket != s.bucket {
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+		return
+	}
+
+	if key == "" {
+		s.list(w, r)
+		return
+	}
+
+	data, ok := s.objects[key]
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		return
+	}
+	w.Header().Set("ETag", s.etag(key))
+	http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+}
+
+// etag returns the ETag of key: the MD5 digest of its content unless
+// overridden
+func (s *s3StandIn) etag(key string) string {
+	if etag, ok := s.etags[key]; ok {
+		return etag
+	}
+	return fmt.Sprintf(`"%x"`, md5.Sum(s.objects[key]))
+}
+
+func (s *s3StandIn) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := max(query.Get("start-after"), query.Get("continuation-token"))
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: s.bucket, Prefix: prefix, MaxKeys: s.pageSize}
+	if len(keys) > s.pageSize {
+		keys = keys[:s.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	result.KeyCount = len(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key  string `xml:"Key"`
+			Size int    `xml:"Size"`
+			ETag string `xml:"ETag"`
+		}{key, len(s.objects[key]), s.etag(key)})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newStandInSpooler(t *testing.T, server *s3StandIn, requesterPays bool) (*S3Spooler, *StateManager) {
+	t.Helper()
+
+	logger := NewLogger(false)
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler, err := NewS3Spooler(S3SpoolerConfig{
+		Bucket:          server.bucket,
+		Prefixes:        []string{"megastream/"},
+		Region:          "us-east-1",
+		S3EndpointURL:   server.URL,
+		UsePathStyle:    true,
+		AccessKeyID:     "AKIDSTANDIN",
+		SecretAccessKey: "secret",
+		RequesterPays:   requesterPays,
+		Prefetch:        DefaultS3PrefetchConfig(),
+	}, "once", time.Second, sm, logger)
+	if err != nil {
+		t.Fatalf("Failed to create S3 spooler: %v", err)
+	}
+
+	return spooler, sm
+}
+
+func TestS3Spooler_StandInEndpoint(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 3)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	server := newS3StandIn(t, "ingest-test")
+	server.pageSize = 1
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+	server.put("megastream/mega_20250101_010000.db.zip", zipData)
+	server.put("other/mega_20250101_000000.db.zip", zipData)
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 6 {
+		t.Errorf("Expected 6 rows from 2 files, got %d", count)
+	}
+	spooler.Stop()
+
+	for _, name := range []string{"megastream/mega_20250101_000000.db.zip", "megastream/mega_20250101_010000.db.zip"} {
+		if !sm.IsProcessed(name) {
+			t.Errorf("Expected %s to be processed", name)
+		}
+	}
+
+	requests := server.received()
+	if len(requests) == 0 {
+		t.Fatal("Expected requests to reach the stand-in endpoint")
+	}
+	for _, r := range requests {
+		if !strings.HasPrefix(r.URL.Path, "/ingest-test") {
+			t.Errorf("Expected path-style request, got %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "Credential=AKIDSTANDIN/") {
+			t.Errorf("Expected request signed with static credentials, got %q", auth)
+		}
+		if payer := r.Header.Get("X-Amz-Request-Payer"); payer != "" {
+			t.Errorf("Expected no requester-pays header when disabled, got %q", payer)
+		}
+	}
+}
+
+func TestS3Spooler_StandInRequesterPays(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 1)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+
+	spooler, _ := newStandInSpooler(t, server, true)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 1 {
+		t.Errorf("Expected 1 row, got %d", count)
+	}
+	spooler.Stop()
+
+	for _, r := range server.received() {
+		if payer := r.Header.Get("X-Amz-Request-Payer"); payer != "requester" {
+			t.Errorf("Expected requester-pays header on %s, got %q", r.URL, payer)
+		}
+	}
+}
+
+func TestNewS3Spooler_RequiresSecretWithAccessKey(t *testing.T) {
+	logger := NewLogger(false)
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	_, err = NewS3Spooler(S3SpoolerConfig{
+		Bucket:      "ingest-test",
+		Prefixes:    []string{"megastream/"},
+		Region:      "us-east-1",
+		AccessKeyID: "AKIDSTANDIN",
+	}, "once", time.Second, sm, logger)
+	if err == nil {
+		t.Error("Expected an error for an access key ID without a secret")
+	}
+}
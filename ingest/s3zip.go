@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// s3ReadBlock is the minimum number of bytes fetched per ranged request while
+// reading a zip directory
+const s3ReadBlock = 64 * 1024
+
+// s3ReaderAt reads an S3 object through ranged GETs, caching the last block
+// fetched so that the small reads of the zip reader share requests. It is not
+// safe for concurrent use.
+type s3ReaderAt struct {
+	ctx context.Context
+	ss  *S3Spooler
+	obj s3Object
+
+	blockStart int64
+	block      []byte
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.obj.size {
+			return n, io.EOF
+		}
+
+		if pos < r.blockStart || pos >= r.blockStart+int64(len(r.block)) {
+			end := min(pos+max(int64(len(p)-n), s3ReadBlock), r.obj.size) - 1
+			var buf bytes.Buffer
+			if _, err := r.ss.downloadRange(r.ctx, r.obj, fmt.Sprintf("bytes=%d-%d", pos, end), &buf); err != nil {
+				return n, err
+			}
+			if int64(buf.Len()) != end-pos+1 {
+				return n, fmt.Errorf("short read of %d bytes at offset %d", buf.Len(), pos)
+			}
+			r.blockStart = pos
+			r.block = buf.Bytes()
+		}
+
+		n += copy(p[n:], r.block[pos-r.blockStart:])
+	}
+	return n, nil
+}
+
+// sniffObject detects the format of obj from its leading bytes
+func (ss *S3Spooler) sniffObject(src *s3ReaderAt) (archiveFormat, error) {
+	if src.obj.size == 0 {
+		return formatUnknown, permanent(fmt.Errorf("file is empty"))
+	}
+
+	header := make([]byte, min(int64(sniffLen), src.obj.size))
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return formatUnknown, fmt.Errorf("failed to read file header: %w", err)
+	}
+	return detectFormat(header), nil
+}
+
+// zipDatabaseEntries reads the central directory of a zip archive, which
+// sits at the end of the object, and returns its database entries without
+// downloading the rest of the archive
+func (ss *S3Spooler) zipDatabaseEntries(src *s3ReaderAt) ([]*zip.File, error) {
+	zr, err := zip.NewReader(src, src.obj.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip directory: %w", err)
+	}
+	return databaseEntries(zr)
+}
+
+// streamEntry downloads only the compressed bytes of entry and inflates them
+// straight into destPath, so the archive itself never touches the disk. The
+// result is verified against the entry's size and CRC-32. The bytes written
+// are recorded with res.
+func (ss *S3Spooler) streamEntry(ctx context.Context, obj s3Object, entry *zip.File, destPath string, res *reservation) error {
+	if entry.Method != zip.Store && entry.Method != zip.Deflate {
+		return permanent(fmt.Errorf("unsupported compression method %d", entry.Method))
+	}
+
+	offset, err := entry.DataOffset()
+	if err != nil {
+		return fmt.Errorf("failed to locate zip entry data: %w", err)
+	}
+
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	var src io.Reader = bytes.NewReader(nil)
+	if entry.CompressedSize64 > 0 {
+		body, err := ss.getRange(ctx, obj, fmt.Sprintf("bytes=%d-%d", offset, offset+int64(entry.CompressedSize64)-1))
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		src = body
+	}
+	if entry.Method == zip.Deflate {
+		inflater := flate.NewReader(src)
+		defer inflater.Close()
+		src = inflater
+	}
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(res.writer(outFile), crc), src)
+	if err != nil {
+		return fmt.Errorf("failed to extract file: %w", err)
+	}
+	if uint64(n) != entry.UncompressedSize64 {
+		return fmt.Errorf("extracted %d bytes, expected %d", n, entry.UncompressedSize64)
+	}
+	if crc.Sum32() != entry.CRC32 {
+		return fmt.Errorf("checksum mismatch: got CRC-32 %08x, expected %08x", crc.Sum32(), entry.CRC32)
+	}
+
+	ss.logger.Debug("Streamed %s from S3 to: %s", entry.Name, destPath)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3Spooler_StreamsDatabaseEntry(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 4)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	spooler.scratch, err = newScratchSpace(t.TempDir(), 0, 0, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create scratch space: %v", err)
+	}
+
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 4 {
+		t.Errorf("Expected 4 rows from streamed entry, got %d", count)
+	}
+	spooler.Stop()
+
+	if !sm.IsProcessed("megastream/mega_20250101_000000.db.zip") {
+		t.Error("Expected streamed file to be processed")
+	}
+
+	for _, r := range server.received() {
+		if r.Method == "GET" && r.URL.Query().Get("list-type") == "" && r.Header.Get("Range") == "" {
+			t.Errorf("Expected only ranged reads when streaming, got full GET of %s", r.URL.Path)
+		}
+	}
+
+	entries, err := os.ReadDir(spooler.scratch.dir)
+	if err != nil {
+		t.Fatalf("Failed to read scratch directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected scratch directory to be empty after processing, got %d entries", len(entries))
+	}
+}
+
+func TestS3Spooler_StreamedEntryChecksumMismatchFailsFile(t *testing.T) {
+	// A stored entry whose data no longer matches its CRC-32
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "test.db", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	w.Write([]byte("SQLite format 3\x00"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zip writer: %v", err)
+	}
+	zipData := buf.Bytes()
+	corrupt := bytes.Index(zipData, []byte("SQLite"))
+	zipData[corrupt] = 'X'
+
+	server := newS3StandIn(t, "ingest-test")
+	server.put("megastream/mega_20250101_000000.db.zip", zipData)
+
+	spooler, sm := newStandInSpooler(t, server, false)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 0 {
+		t.Errorf("Expected no rows from a corrupt entry, got %d", count)
+	}
+	spooler.Stop()
+
+	if !sm.IsFailed("megastream/mega_20250101_000000.db.zip") {
+		t.Error("Expected file with mismatched CRC-32 to be marked failed")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errInsufficientDisk is returned when a file would not fit on disk. The file
+// is left for a later run rather than failing partway through extraction.
+var errInsufficientDisk = errors.New("insufficient disk space")
+
+// scratchPrefix starts the name of every temporary directory the spoolers
+// create, so that leftovers can be told apart from other files
+const scratchPrefix = "ingest-"
+
+// scratchSpace is where downloaded archives and extracted databases are
+// written while a file is processed. Its budget accounts for the disk they
+// use.
+type scratchSpace struct {
+	dir    string // empty for the system temp directory
+	budget *diskBudget
+}
+
+// newScratchSpace prepares the scratch directory dir and removes directories
+// left behind by an earlier run. With an empty dir, temporary directories are
+// created in the system temp directory and nothing is cleaned up. maxBytes
+// limits the bytes reserved at once (0 for no limit) and minFree is kept free
+// on the filesystem.
+func newScratchSpace(dir string, maxBytes, minFree int64, logger *IngestLogger) (*scratchSpace, error) {
+	freeDir := dir
+	if dir == "" {
+		freeDir = os.TempDir()
+	} else {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scratch directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), scratchPrefix) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return nil, fmt.Errorf("failed to clean up scratch directory: %w", err)
+			}
+			logger.Info("Removed leftover scratch data: %s", entry.Name())
+		}
+	}
+
+	budget := newDiskBudget(maxBytes)
+	budget.minFree = minFree
+	budget.free = func() (int64, error) { return diskFree(freeDir) }
+
+	return &scratchSpace{dir: dir, budget: budget}, nil
+}
+
+// defaultScratchSpace uses the system temp directory without limits
+func defaultScratchSpace() *scratchSpace {
+	return &scratchSpace{budget: newDiskBudget(0)}
+}
+
+// mkdirTemp creates a new temporary directory in the scratch space
+func (s *scratchSpace) mkdirTemp(pattern string) (string, error) {
+	return os.MkdirTemp(s.dir, scratchPrefix+pattern)
+}
+
+// diskBudget limits the bytes reserved for files on disk. A reservation larger
+// than the whole limit is granted once nothing else is reserved, so a single
+// oversized file cannot stall the pipeline. If free is set, reservations must
+// also leave minFree bytes free on the filesystem.
+type diskBudget struct {
+	limit   int64
+	minFree int64
+	free    func() (int64, error)
+
+	mu      sync.Mutex
+	used    int64
+	written int64 // bytes of used already on disk
+	freed   chan struct{}
+}
+
+func newDiskBudget(limit int64) *diskBudget {
+	return &diskBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// acquire reserves n bytes, waiting until enough have been released. It fails
+// with errInsufficientDisk if the filesystem cannot hold n bytes even with
+// nothing else reserved.
+func (b *diskBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		err := b.checkUnsafe(n)
+		if err == nil {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		if b.used == 0 {
+			b.mu.Unlock()
+			return err
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// checkUnsafe reports why n more bytes cannot be reserved, if they cannot
+func (b *diskBudget) checkUnsafe(n int64) error {
+	if b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		return fmt.Errorf("disk budget of %d bytes exhausted", b.limit)
+	}
+	return b.checkFreeUnsafe(n)
+}
+
+// checkFreeUnsafe reports whether the filesystem can hold n more bytes
+func (b *diskBudget) checkFreeUnsafe(n int64) error {
+	if b.free == nil {
+		return nil
+	}
+	free, err := b.free()
+	if err != nil || free < 0 {
+		// Free space is unknown on this platform
+		return nil
+	}
+
+	// Free space already excludes the reserved bytes written so far, so only
+	// the rest of the reservations must still fit
+	unwritten := b.used - b.written
+	if free-unwritten-n < b.minFree {
+		return fmt.Errorf("%w: %d bytes needed, %d reserved but not yet written, %d free, %d to keep free", errInsufficientDisk, n, unwritten, free, b.minFree)
+	}
+	return nil
+}
+
+// grow reserves n more bytes for the file of r, which is already being
+// written. It never waits, since the files holding the rest of the budget may
+// be queued behind this one, but still fails with errInsufficientDisk when the
+// filesystem is full.
+func (b *diskBudget) grow(r *reservation, n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkFreeUnsafe(n); err != nil {
+		return err
+	}
+	b.used += n
+	r.held += n
+	return nil
+}
+
+// release returns n reserved bytes to the budget
+func (b *diskBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.releaseUnsafe(n, 0)
+}
+
+// releaseUnsafe returns n reserved bytes, written of which were on disk
+func (b *diskBudget) releaseUnsafe(n, written int64) {
+	b.used -= n
+	b.written -= written
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// reservation is the share of a disk budget held by one file. Data whose size
+// was not known when the file was admitted is charged with use, first against
+// the allowance admitted for it and then by growing the reservation. Writes
+// are recorded with wrote, so that free space checks do not count them twice.
+type reservation struct {
+	budget    *diskBudget
+	held      int64
+	allowance int64
+	written   int64
+}
+
+// reservationStep is the least a reservation grows by
+const reservationStep = 16 * 1024 * 1024
+
+// reserve admits a file needing known bytes plus an estimated allowance for
+// data of unknown size, waiting for space as acquire does
+func (b *diskBudget) reserve(ctx context.Context, known, allowance int64) (*reservation, error) {
+	if err := b.acquire(ctx, known+allowance); err != nil {
+		return nil, err
+	}
+	return &reservation{budget: b, held: known + allowance, allowance: allowance}, nil
+}
+
+// use charges n bytes of unknown-size data to the reservation
+func (r *reservation) use(n int64) error {
+	if n <= r.allowance {
+		r.allowance -= n
+		return nil
+	}
+
+	// Grow in large steps to keep free-space checks off the write path
+	extra := max(n-r.allowance, reservationStep)
+	if err := r.budget.grow(r, extra); err != nil {
+		return err
+	}
+	r.allowance += extra - n
+	return nil
+}
+
+// wrote records that n bytes of the reservation have reached the disk. It is
+// safe to call from concurrent writers of the same file.
+func (r *reservation) wrote(n int64) {
+	b := r.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n = min(n, r.held-r.written)
+	r.written += n
+	b.written += n
+}
+
+// free returns n written bytes of the reservation early, once the data they
+// were held for has been deleted
+func (r *reservation) free(n int64) {
+	b := r.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	written := min(n, r.written)
+	r.held -= n
+	r.written -= written
+	b.releaseUnsafe(n, written)
+}
+
+// release returns everything the reservation holds
+func (r *reservation) release() {
+	b := r.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.releaseUnsafe(r.held, r.written)
+	r.held = 0
+	r.written = 0
+}
+
+// writer returns w, recording every write to it as bytes of the reservation
+// written to disk
+func (r *reservation) writer(w io.Writer) io.Writer {
+	return writtenRecorder{w: w, res: r}
+}
+
+// writtenRecorder records the bytes written through it with its reservation
+type writtenRecorder struct {
+	w   io.Writer
+	res *reservation
+}
+
+func (wr writtenRecorder) Write(p []byte) (int, error) {
+	n, err := wr.w.Write(p)
+	wr.res.wrote(int64(n))
+	return n, err
+}
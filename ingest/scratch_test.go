@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskBudget(t *testing.T) {
+	budget := newDiskBudget(100)
+	ctx := context.Background()
+
+	if err := budget.acquire(ctx, 60); err != nil {
+		t.Fatalf("Expected first reservation to succeed: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- budget.acquire(ctx, 60) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected reservation over the limit to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.release(60)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Expected reservation to succeed after release: %v", err)
+	}
+	budget.release(60)
+
+	// A file larger than the whole budget is admitted on its own
+	if err := budget.acquire(ctx, 500); err != nil {
+		t.Fatalf("Expected oversized reservation to succeed when empty: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := budget.acquire(cancelled, 1); err == nil {
+		t.Error("Expected cancelled reservation to fail while the budget is full")
+	}
+}
+
+func TestDiskBudget_RefusesWithoutFreeSpace(t *testing.T) {
+	budget := newDiskBudget(0)
+	budget.minFree = 10
+	budget.free = func() (int64, error) { return 100, nil }
+	ctx := context.Background()
+
+	if err := budget.acquire(ctx, 90); err != nil {
+		t.Fatalf("Expected reservation leaving the minimum free to succeed: %v", err)
+	}
+	budget.release(90)
+
+	if err := budget.acquire(ctx, 91); !errors.Is(err, errInsufficientDisk) {
+		t.Errorf("Expected errInsufficientDisk, got %v", err)
+	}
+
+	// With other files reserved, the reservation waits for them instead
+	if err := budget.acquire(ctx, 50); err != nil {
+		t.Fatalf("Expected first reservation to succeed: %v", err)
+	}
+	acquired := make(chan error, 1)
+	go func() { acquired <- budget.acquire(ctx, 50) }()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("Expected reservation to wait for free space, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.release(50)
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected reservation to succeed after release: %v", err)
+	}
+}
+
+func TestDiskBudget_CountsWrittenBytesOnce(t *testing.T) {
+	// A 100 byte filesystem, from which the bytes written are taken
+	budget := newDiskBudget(0)
+	var onDisk int64
+	budget.free = func() (int64, error) { return 100 - onDisk, nil }
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := budget.reserve(ctx, 80, 0)
+	if err != nil {
+		t.Fatalf("Expected first reservation to succeed: %v", err)
+	}
+	onDisk = 60
+	res.wrote(60)
+
+	// 40 bytes are free, 20 of which the first file still needs
+	second, err := budget.reserve(ctx, 20, 0)
+	if err != nil {
+		t.Fatalf("Expected the space not yet written to be all that is held back, got %v", err)
+	}
+	second.release()
+
+	if err := budget.grow(res, 21); !errors.Is(err, errInsufficientDisk) {
+		t.Errorf("Expected growing past the free space to fail, got %v", err)
+	}
+
+	onDisk = 0
+	res.release()
+	if budget.used != 0 || budget.written != 0 {
+		t.Errorf("Expected the budget to be empty after release, got %d used and %d written", budget.used, budget.written)
+	}
+}
+
+func TestNewScratchSpace_CleansLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "ingest-s3-123")
+	if err := os.MkdirAll(leftover, 0755); err != nil {
+		t.Fatalf("Failed to create leftover directory: %v", err)
+	}
+	unrelated := filepath.Join(dir, "keep.txt")
+	if err := os.WriteFile(unrelated, []byte("keep"), 0644); err != nil {
+		t.Fatalf("Failed to create unrelated file: %v", err)
+	}
+
+	scratch, err := newScratchSpace(dir, 0, 0, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create scratch space: %v", err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("Expected leftover scratch directory to be removed")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("Expected unrelated file to be kept: %v", err)
+	}
+
+	tmp, err := scratch.mkdirTemp("local-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	if filepath.Dir(tmp) != dir {
+		t.Errorf("Expected temp directory inside %s, got %s", dir, tmp)
+	}
+}
+
+func TestLocalSpooler_RefusesFileWithoutDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	logger := NewLogger(false)
+	filename := "test_file.db.zip"
+	zipPath := filepath.Join(dir, filename)
+	createTestZip(t, zipPath, 3)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, logger)
+	spooler.scratch.budget.free = func() (int64, error) { return 0, nil }
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+
+	if count := drainAndAck(t, spooler, nil); count != 0 {
+		t.Errorf("Expected no rows without disk space, got %d", count)
+	}
+	spooler.Stop()
+
+	if sm.IsProcessed(filename) || sm.IsFailed(filename) {
+		t.Error("Expected refused file to be left for the next run")
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Errorf("Expected refused zip file to be kept: %v", err)
+	}
+}
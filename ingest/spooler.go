@@ -4,99 +4,605 @@ import (
 	"archive/zip"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 
 	_ "modernc.org/sqlite"
 )
 
-type SQLiteRow struct {
-	AtURI          string
-	DID            string
-	RawPost        string
-	Inferences     string
-	SourceFilename string
-}
-
-type Spooler interface {
-	Start(ctx context.Context) error
-	GetRowChannel() <-chan SQLiteRow
-	Stop() error
-}
-
 type baseSpooler struct {
-	rowChan      chan SQLiteRow
+	records      chan Record
+	ackChan      chan Ack
+	ackDone      chan struct{}
+	stopOnce     sync.Once
 	stateManager *StateManager
+	scratch      *scratchSpace
 	logger       *IngestLogger
 	mode         string
 	interval     time.Duration
+
+	mu        sync.Mutex
+	nextToken AckToken
+	pending   map[AckToken]*pendingFile
+	chunks    map[AckToken]*rowChunk
+
+	// stateMu is taken before mu is released by unlockAndApply, so that the
+	// state writes and callbacks following changes to pending run outside mu
+	// but in the order of those changes. It guards lastCompleted.
+	stateMu       sync.Mutex
+	lastCompleted string
+}
+
+// stateWrites are the state writes and callbacks that follow a change to the
+// pending files, collected while bs.mu is held and run once it is released
+type stateWrites []func()
+
+func (w *stateWrites) add(write func()) {
+	*w = append(*w, write)
+}
+
+// pendingFile tracks the rows of a file that have been queued but not yet
+// acknowledged. The file is finalized once it is sealed and fully acked.
+type pendingFile struct {
+	filename   string
+	queued     int
+	acked      int
+	sealed     bool
+	err        error
+	onComplete func()
+	onFailed   func()
+
+	// chunks are the rows queued beyond the checkpoint in progress, in order
+	chunks   []*rowChunk
+	progress FileProgress
+}
+
+func newBaseSpooler(mode string, interval time.Duration, stateManager *StateManager, logger *IngestLogger) *baseSpooler {
+	bs := &baseSpooler{
+		records:      make(chan Record, 1000),
+		ackChan:      make(chan Ack, 1000),
+		ackDone:      make(chan struct{}),
+		stateManager: stateManager,
+		scratch:      defaultScratchSpace(),
+		logger:       logger,
+		mode:         mode,
+		interval:     interval,
+		pending:      make(map[AckToken]*pendingFile),
+		chunks:       make(map[AckToken]*rowChunk),
+	}
+
+	go bs.runAckLoop()
+
+	return bs
+}
+
+func (bs *baseSpooler) Records() <-chan Record {
+	return bs.records
+}
+
+func (bs *baseSpooler) Ack(ack Ack) {
+	bs.ackChan <- ack
+}
+
+// Checkpoint returns the most recently completed file
+func (bs *baseSpooler) Checkpoint() string {
+	bs.stateMu.Lock()
+	defer bs.stateMu.Unlock()
+	return bs.lastCompleted
+}
+
+// unlockAndApply releases bs.mu, which the caller holds, and runs writes.
+// Writes of different calls run in the order the calls held bs.mu.
+func (bs *baseSpooler) unlockAndApply(writes stateWrites) {
+	bs.stateMu.Lock()
+	defer bs.stateMu.Unlock()
+	bs.mu.Unlock()
+
+	for _, write := range writes {
+		write()
+	}
+}
+
+// stopAcks closes the ack channel and waits until every ack already sent has
+// been applied to the state manager.
+func (bs *baseSpooler) stopAcks() {
+	bs.stopOnce.Do(func() {
+		close(bs.ackChan)
+	})
+	<-bs.ackDone
+
+	bs.mu.Lock()
+	for _, pf := range bs.pending {
+		bs.logger.Info("File %s left unacknowledged (%d/%d rows acked), will be retried on next run", pf.filename, pf.acked, pf.queued)
+	}
+	// Waits for the writes of files already finalized
+	bs.unlockAndApply(nil)
+}
+
+func (bs *baseSpooler) runAckLoop() {
+	defer close(bs.ackDone)
+
+	for ack := range bs.ackChan {
+		bs.handleAck(ack)
+	}
+}
+
+// beginFile registers a file before any of its rows are queued, picking up
+// the checkpoint of an earlier attempt. onComplete is called after the file
+// has been marked processed, onFailed after it has been quarantined; either
+// may be nil.
+func (bs *baseSpooler) beginFile(filename string, onComplete, onFailed func()) AckToken {
+	pf := &pendingFile{
+		filename:   filename,
+		onComplete: onComplete,
+		onFailed:   onFailed,
+	}
+	if progress, ok := bs.stateManager.Progress(filename); ok {
+		pf.progress = progress
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.nextToken++
+	token := bs.nextToken
+	bs.pending[token] = pf
+
+	return token
+}
+
+// sealFile records that all rows of the file have been queued.
+func (bs *baseSpooler) sealFile(token AckToken, queued int) {
+	var writes stateWrites
+	bs.mu.Lock()
+	defer func() { bs.unlockAndApply(writes) }()
+
+	pf, ok := bs.pending[token]
+	if !ok {
+		return
+	}
+
+	pf.queued = queued
+	pf.sealed = true
+	if n := len(pf.chunks); n > 0 {
+		pf.chunks[n-1].closed = true
+	}
+	bs.advanceCheckpointUnsafe(pf, &writes)
+	bs.finalizeIfDoneUnsafe(token, pf, &writes)
+}
+
+// failFile marks the file as failed or quarantined. Rows that were already
+// queued are still acknowledged but no longer affect the outcome.
+func (bs *baseSpooler) failFile(token AckToken, err error) {
+	var writes stateWrites
+	bs.mu.Lock()
+	if pf, ok := bs.pending[token]; ok {
+		delete(bs.pending, token)
+		bs.dropChunksUnsafe(pf)
+		writes.add(func() { bs.recordFailure(pf, err) })
+	}
+	bs.unlockAndApply(writes)
+}
+
+// recordFailure schedules a retry of the file, or quarantines it if err cannot
+// be fixed by retrying or it has no attempts left. onFailed runs once the file
+// is quarantined.
+func (bs *baseSpooler) recordFailure(pf *pendingFile, err error) {
+	if isRetryable(err) {
+		bs.stateManager.MarkFailed(pf.filename, err.Error())
+	} else {
+		bs.stateManager.Quarantine(pf.filename, err.Error())
+	}
+
+	if pf.onFailed != nil && bs.stateManager.IsQuarantined(pf.filename) {
+		pf.onFailed()
+	}
+}
+
+// isPending reports whether rows of the file are still being queued or
+// awaiting acknowledgement
+func (bs *baseSpooler) isPending(filename string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, pf := range bs.pending {
+		if pf.filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// abandonFile forgets the file without touching its state so that it will be
+// picked up again on the next run, from its last checkpoint, by this or
+// another replica.
+func (bs *baseSpooler) abandonFile(token AckToken) {
+	var writes stateWrites
+	bs.mu.Lock()
+	if pf, ok := bs.pending[token]; ok {
+		delete(bs.pending, token)
+		bs.dropChunksUnsafe(pf)
+		writes.add(func() { bs.stateManager.Release(pf.filename) })
+	}
+	bs.unlockAndApply(writes)
+}
+
+func (bs *baseSpooler) handleAck(ack Ack) {
+	var writes stateWrites
+	bs.mu.Lock()
+	defer func() { bs.unlockAndApply(writes) }()
+
+	token := ack.Token
+	pf, ok := bs.pending[token]
+	if !ok {
+		chunk, isChunk := bs.chunks[ack.Token]
+		if !isChunk {
+			return
+		}
+		chunk.acked += ack.Count
+		token = chunk.fileToken
+		if pf, ok = bs.pending[token]; !ok {
+			return
+		}
+	}
+
+	pf.acked += ack.Count
+	if ack.Err != nil && pf.err == nil {
+		pf.err = ack.Err
+	}
+	bs.advanceCheckpointUnsafe(pf, &writes)
+	bs.finalizeIfDoneUnsafe(token, pf, &writes)
+}
+
+// finalizeIfDoneUnsafe stops tracking the file once it is sealed and fully
+// acknowledged, and adds the writes recording its outcome
+func (bs *baseSpooler) finalizeIfDoneUnsafe(token AckToken, pf *pendingFile, writes *stateWrites) {
+	if !pf.sealed || pf.acked < pf.queued {
+		return
+	}
+
+	delete(bs.pending, token)
+	bs.dropChunksUnsafe(pf)
+
+	if pf.err != nil {
+		writes.add(func() { bs.recordFailure(pf, pf.err) })
+		return
+	}
+
+	writes.add(func() {
+		if err := bs.stateManager.MarkProcessed(pf.filename); err != nil {
+			bs.logger.Error("Failed to mark file %s as processed: %v", pf.filename, err)
+			return
+		}
+		bs.lastCompleted = pf.filename
+
+		if pf.onComplete != nil {
+			pf.onComplete()
+		}
+	})
+}
+
+func init() {
+	RegisterDataSource("local", newLocalDataSource)
+	RegisterDataSource("s3", newS3DataSource)
+}
+
+func newLocalDataSource(opts DataSourceOptions) (DataSource, error) {
+	if opts.Config.LocalSQLiteDBPath == "" {
+		return nil, fmt.Errorf("LOCAL_SQLITE_DB_PATH environment variable is required for local source")
+	}
+
+	scratch, err := newScratchSpaceFromConfig(opts.Config, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(opts.Config.SpoolIntervalSec) * time.Second
+	spooler := NewLocalSpooler(opts.Config.LocalSQLiteDBPath, opts.Mode, interval, opts.StateManager, opts.Logger)
+	spooler.scratch = scratch
+	spooler.watch = LocalWatchConfig{
+		StablePeriod:      time.Duration(opts.Config.LocalStableSec) * time.Second,
+		RequireDoneMarker: opts.Config.LocalRequireDoneMarker,
+	}
+
+	if opts.Config.LocalProcessedAction != "" {
+		spooler.postProcess.OnSuccess, err = parsePostProcessAction(opts.Config.LocalProcessedAction)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOCAL_PROCESSED_ACTION: %w", err)
+		}
+	}
+	if opts.Config.LocalFailedAction != "" {
+		spooler.postProcess.OnFailure, err = parsePostProcessAction(opts.Config.LocalFailedAction)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOCAL_FAILED_ACTION: %w", err)
+		}
+	}
+	spooler.postProcess.Compress = opts.Config.LocalArchiveCompress
+	spooler.postProcess.RetentionDays = opts.Config.LocalArchiveMaxAgeDays
+	if opts.Config.LocalArchiveDir != "" {
+		spooler.postProcess.ArchiveDir = opts.Config.LocalArchiveDir
+	}
+	if opts.Config.LocalFailedDir != "" {
+		spooler.postProcess.FailedDir = opts.Config.LocalFailedDir
+	}
+
+	// The state may be kept next to the dumps, where .processed_files.db
+	// would otherwise be picked up as one
+	spooler.exclude(
+		opts.Config.SpoolStateFile,
+		opts.Config.SpoolStateDB,
+		opts.Config.ScratchDir,
+		spooler.postProcess.ArchiveDir,
+		spooler.postProcess.FailedDir,
+	)
+	return spooler, nil
+}
+
+func newS3DataSource(opts DataSourceOptions) (DataSource, error) {
+	if opts.Config.S3SQLiteDBBucket == "" {
+		return nil, fmt.Errorf("S3_SQLITE_DB_BUCKET environment variable is required for s3 source")
+	}
+	if opts.Config.S3SQLiteDBPrefix == "" {
+		return nil, fmt.Errorf("S3_SQLITE_DB_PREFIX environment variable is required for s3 source")
+	}
+	if opts.Mode == "watch" {
+		return nil, fmt.Errorf("watch mode is only supported by the local source; use S3_SQS_QUEUE_URL for event-driven S3 ingestion")
+	}
+
+	scratch, err := newScratchSpaceFromConfig(opts.Config, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(opts.Config.SpoolIntervalSec) * time.Second
+	spooler, err := NewS3Spooler(S3SpoolerConfig{
+		Bucket:          opts.Config.S3SQLiteDBBucket,
+		Prefixes:        parsePrefixes(opts.Config.S3SQLiteDBPrefix),
+		Region:          opts.Config.AWSRegion,
+		EndpointURL:     opts.Config.AWSEndpointURL,
+		S3EndpointURL:   opts.Config.S3EndpointURL,
+		UsePathStyle:    opts.Config.S3UsePathStyle,
+		AccessKeyID:     opts.Config.S3AccessKeyID,
+		SecretAccessKey: opts.Config.S3SecretAccessKey,
+		SessionToken:    opts.Config.S3SessionToken,
+		Profile:         opts.Config.AWSProfile,
+		RequesterPays:   opts.Config.S3RequesterPays,
+		SQSQueueURL:     opts.Config.S3SQSQueueURL,
+		FullListing:     opts.Config.S3FullListingInterval,
+		Prefetch: S3PrefetchConfig{
+			Files:              opts.Config.S3PrefetchFiles,
+			StreamExtract:      opts.Config.S3StreamExtract,
+			MultipartThreshold: int64(opts.Config.S3MultipartThreshold),
+			PartSize:           int64(opts.Config.S3MultipartPartSize),
+			PartConcurrency:    opts.Config.S3MultipartConcurrency,
+		},
+	}, opts.Mode, interval, opts.StateManager, opts.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 spooler: %w", err)
+	}
+	spooler.scratch = scratch
+	return spooler, nil
+}
+
+// newScratchSpaceFromConfig prepares the scratch space shared by the files of
+// a spooler
+func newScratchSpaceFromConfig(config *Config, logger *IngestLogger) (*scratchSpace, error) {
+	scratch, err := newScratchSpace(config.ScratchDir, int64(config.ScratchMaxBytes), int64(config.ScratchMinFreeBytes), logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare scratch space: %w", err)
+	}
+	return scratch, nil
 }
 
 type LocalSpooler struct {
 	*baseSpooler
-	directory string
+	directory   string
+	watch       LocalWatchConfig
+	postProcess LocalPostProcessConfig
+	post        *postProcessor
+	hashes      *fingerprintCache
+
+	// excluded holds the absolute paths the ingester writes itself, such as
+	// the state database, which discovery must not mistake for dumps
+	excluded map[string]bool
 }
 
+// parsePrefixes splits a comma-separated list of S3 prefixes
+func parsePrefixes(value string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// s3API is the subset of the S3 client used by S3Spooler
+type s3API interface {
+	s3.ListObjectsV2APIClient
+	s3.HeadObjectAPIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3SpoolerConfig holds the settings of an S3Spooler
+type S3SpoolerConfig struct {
+	Bucket   string
+	Prefixes []string
+	Region   string
+
+	// EndpointURL overrides the AWS endpoint of S3 and SQS, for example to
+	// test against a local stand-in. S3EndpointURL overrides it for S3 only,
+	// for S3-compatible stores such as MinIO or Ceph.
+	EndpointURL   string
+	S3EndpointURL string
+
+	// UsePathStyle addresses buckets as endpoint/bucket/key instead of
+	// bucket.endpoint/key, which most S3-compatible stores require
+	UsePathStyle bool
+
+	// Static credentials. When AccessKeyID is empty, credentials come from
+	// the default chain, using the shared config Profile if one is set.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Profile         string
+
+	// RequesterPays marks requests as accepting requester-pays charges
+	RequesterPays bool
+
+	Prefetch S3PrefetchConfig
+
+	// SQSQueueURL switches discovery from listing the bucket to consuming
+	// S3 ObjectCreated notifications from this queue
+	SQSQueueURL string
+
+	// FullListing is how often polls list every key, behind the watermark
+	// too, to notice re-uploads of processed keys; 0 never does
+	FullListing time.Duration
+}
+
+// S3Spooler processes Megastream dumps under one or more prefixes of a bucket.
+//
+// By default it polls the bucket. For each prefix it stores a StartAfter
+// watermark: the last key below which every object has been processed or
+// failed. Polls list only keys after the watermark, which relies on
+// Megastream keys sorting in the order they are uploaded. Every fullListing,
+// a poll lists the keys behind the watermark too, to check their content.
+//
+// With an SQS queue configured it instead consumes S3 event notifications,
+// deleting each message only after every file it announced is processed.
 type S3Spooler struct {
 	*baseSpooler
-	bucket    string
-	prefix    string
-	s3Client  *s3.Client
-	region    string
-	awsConfig aws.Config
+	bucket        string
+	prefixes      []string
+	s3Client      s3API
+	requestPayer  s3types.RequestPayer
+	prefetch      S3PrefetchConfig
+	notifications *s3Notifications
+	region        string
+	awsConfig     aws.Config
+
+	// fullListing is how often polls list the keys behind the watermark;
+	// passed holds those found due again, such as re-uploads, which later
+	// polls keep attempting until they are done, since they are not listed
+	fullListing time.Duration
+	listedFully time.Time
+	passed      map[string]bool
 }
 
 func NewLocalSpooler(directory string, mode string, interval time.Duration, stateManager *StateManager, logger *IngestLogger) *LocalSpooler {
 	return &LocalSpooler{
-		baseSpooler: &baseSpooler{
-			rowChan:      make(chan SQLiteRow, 1000),
-			stateManager: stateManager,
-			logger:       logger,
-			mode:         mode,
-			interval:     interval,
-		},
-		directory: directory,
+		baseSpooler: newBaseSpooler(mode, interval, stateManager, logger),
+		directory:   directory,
+		watch:       DefaultLocalWatchConfig(),
+		postProcess: DefaultLocalPostProcessConfig(directory),
+		hashes:      newFingerprintCache(),
+		excluded:    make(map[string]bool),
+	}
+}
+
+// exclude keeps the given paths out of discovery. Empty paths are ignored.
+func (ls *LocalSpooler) exclude(paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			ls.excluded[abs] = true
+		}
 	}
 }
 
-func NewS3Spooler(bucket, prefix, region string, mode string, interval time.Duration, stateManager *StateManager, logger *IngestLogger) (*S3Spooler, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+// isExcluded reports whether the entry name of the directory was excluded
+func (ls *LocalSpooler) isExcluded(name string) bool {
+	abs, err := filepath.Abs(filepath.Join(ls.directory, name))
+	return err == nil && ls.excluded[abs]
+}
+
+func NewS3Spooler(cfg S3SpoolerConfig, mode string, interval time.Duration, stateManager *StateManager, logger *IngestLogger) (*S3Spooler, error) {
+	loadOptions := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	if cfg.EndpointURL != "" {
+		loadOptions = append(loadOptions, config.WithBaseEndpoint(cfg.EndpointURL))
+	}
+	if cfg.AccessKeyID != "" {
+		if cfg.SecretAccessKey == "" {
+			return nil, fmt.Errorf("S3 secret access key is required with an access key ID")
+		}
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken),
+		))
+	} else if cfg.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(cfg.Profile))
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), loadOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if cfg.S3EndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.S3EndpointURL)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+		// Downloads are verified against the ETag or zip CRC-32 instead, and
+		// ranged reads never carry a full-object checksum
+		o.DisableLogOutputChecksumValidationSkipped = true
+	})
+
+	ss := newS3SpoolerWithClient(client, cfg.Bucket, cfg.Prefixes, mode, interval, stateManager, logger)
+	ss.region = cfg.Region
+	ss.awsConfig = awsConfig
+	ss.prefetch = cfg.Prefetch
+	ss.fullListing = cfg.FullListing
+	if cfg.RequesterPays {
+		ss.requestPayer = s3types.RequestPayerRequester
+	}
+	if cfg.SQSQueueURL != "" {
+		ss.notifications = newS3Notifications(sqs.NewFromConfig(awsConfig), cfg.SQSQueueURL, logger)
+	}
+	return ss, nil
+}
 
+func newS3SpoolerWithClient(client s3API, bucket string, prefixes []string, mode string, interval time.Duration, stateManager *StateManager, logger *IngestLogger) *S3Spooler {
 	return &S3Spooler{
-		baseSpooler: &baseSpooler{
-			rowChan:      make(chan SQLiteRow, 1000),
-			stateManager: stateManager,
-			logger:       logger,
-			mode:         mode,
-			interval:     interval,
-		},
-		bucket:    bucket,
-		prefix:    prefix,
-		s3Client:  client,
-		region:    region,
-		awsConfig: cfg,
-	}, nil
+		baseSpooler: newBaseSpooler(mode, interval, stateManager, logger),
+		bucket:      bucket,
+		prefixes:    prefixes,
+		s3Client:    client,
+		prefetch:    DefaultS3PrefetchConfig(),
+		passed:      make(map[string]bool),
+	}
 }
 
 func (ls *LocalSpooler) Start(ctx context.Context) error {
 	ls.logger.Info("Starting local spooler in %s mode (directory: %s)", ls.mode, ls.directory)
+	ls.post = newPostProcessor(ls.directory, ls.postProcess, ls.stateManager, ls.logger)
+
+	if ls.mode == "watch" {
+		go func() {
+			defer close(ls.records)
+			ls.watchFiles(ctx)
+		}()
+		return nil
+	}
 
 	go func() {
-		defer close(ls.rowChan)
+		defer close(ls.records)
 
 		for {
 			files, err := ls.discoverFiles()
@@ -123,12 +629,12 @@ func (ls *LocalSpooler) Start(ctx context.Context) error {
 	return nil
 }
 
-func (ls *LocalSpooler) GetRowChannel() <-chan SQLiteRow {
-	return ls.rowChan
-}
-
 func (ls *LocalSpooler) Stop() error {
 	ls.logger.Info("Stopping local spooler")
+	ls.stopAcks()
+	if ls.post != nil {
+		ls.post.close()
+	}
 	return nil
 }
 
@@ -138,23 +644,58 @@ func (ls *LocalSpooler) discoverFiles() ([]string, error) {
 		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
 
+	// Entries can only be pruned once their file has left the directory
+	present := make(map[string]bool, len(entries))
+	paths := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.Name()] = true
+		paths[filepath.Join(ls.directory, entry.Name())] = true
+	}
+	ls.compactState(present)
+	ls.hashes.prune(paths)
+
 	var files []string
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 
-		if !strings.HasSuffix(entry.Name(), ".db.zip") {
+		if !isSourceFile(entry.Name()) || ls.isExcluded(entry.Name()) {
 			continue
 		}
 
+		// Rows of the file are still queued or awaiting acknowledgement
+		if ls.isPending(entry.Name()) {
+			ls.logger.Debug("Skipping file still being processed: %s", entry.Name())
+			continue
+		}
+
+		// Files with an entry are hashed to notice new content under an old
+		// name; the rest are hashed when they are processed
+		if state, exists := ls.stateManager.Entry(entry.Name()); exists && state.Fingerprint != "" {
+			if err := ls.observe(entry.Name()); err != nil {
+				ls.logger.Error("Failed to check content of %s: %v", entry.Name(), err)
+				continue
+			}
+		}
+
 		if ls.stateManager.IsProcessed(entry.Name()) {
 			ls.logger.Debug("Skipping already processed file: %s", entry.Name())
 			continue
 		}
 
-		if ls.stateManager.IsFailed(entry.Name()) {
-			ls.logger.Debug("Skipping previously failed file: %s", entry.Name())
+		if ls.stateManager.IsQuarantined(entry.Name()) {
+			ls.logger.Debug("Skipping quarantined file: %s", entry.Name())
+			continue
+		}
+
+		if ls.stateManager.IsChanged(entry.Name()) {
+			ls.logger.Debug("Skipping changed file until it is retried: %s", entry.Name())
+			continue
+		}
+
+		if ls.stateManager.IsFailed(entry.Name()) && !ls.stateManager.RetryDue(entry.Name()) {
+			ls.logger.Debug("Skipping failed file until its retry at %s: %s", ls.stateManager.RetryAt(entry.Name()).Format(time.RFC3339), entry.Name())
 			continue
 		}
 
@@ -175,59 +716,160 @@ func (ls *LocalSpooler) processFiles(ctx context.Context, files []string) {
 		default:
 		}
 
+		if !ls.stateManager.Claim(filename) {
+			continue
+		}
+
+		if err := ls.observe(filename); err != nil {
+			ls.logger.Error("Failed to check content of %s, leaving it for the next run: %v", filename, err)
+			ls.stateManager.Release(filename)
+			continue
+		}
+		if ls.stateManager.IsChanged(filename) {
+			ls.stateManager.Release(filename)
+			continue
+		}
+
 		filePath := filepath.Join(ls.directory, filename)
 		ls.logger.Info("Processing file: %s", filename)
 
-		if err := ls.processFile(ctx, filePath, filename); err != nil {
+		token := ls.beginFile(filename, func() {
+			ls.post.submit(filename, false)
+		}, func() {
+			ls.post.submit(filename, true)
+		})
+
+		queued, err := ls.processFile(ctx, filePath, filename, token)
+		if err != nil {
+			if ctx.Err() != nil {
+				ls.logger.Info("Context cancelled while processing %s, leaving it for the next run", filename)
+				ls.abandonFile(token)
+				return
+			}
+			if errors.Is(err, errInsufficientDisk) {
+				ls.logger.Error("Not enough disk space for %s, leaving it for the next run: %v", filename, err)
+				ls.abandonFile(token)
+				return
+			}
+			if errors.Is(err, errLeaseLost) {
+				ls.logger.Error("Lost the lease on %s, leaving it to the replica that took it over", filename)
+				ls.abandonFile(token)
+				continue
+			}
 			ls.logger.Error("Failed to process file %s: %v", filename, err)
-			ls.stateManager.MarkFailed(filename, err.Error())
+			ls.failFile(token, err)
 		} else {
-			// TODO: Move state update to after Elasticsearch indexing is confirmed.
-			// Currently marking as processed after rows are queued to channel, but should
-			// happen after ES confirms successful indexing. Need to implement acknowledgment
-			// mechanism from main thread back to spooler (e.g., via separate ack channel).
-			ls.stateManager.MarkProcessed(filename)
+			ls.sealFile(token, queued)
 		}
 	}
 }
 
-func (ls *LocalSpooler) processFile(ctx context.Context, filePath, filename string) error {
-	tmpDir, err := os.MkdirTemp("", "ingest-*")
+// observe records the SHA-256 digest of a file in the directory as its
+// content
+func (ls *LocalSpooler) observe(filename string) error {
+	fingerprint, err := ls.hashes.fingerprint(filepath.Join(ls.directory, filename))
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+		return err
 	}
-	defer os.RemoveAll(tmpDir)
+	return ls.stateManager.Observe(filename, fingerprint)
+}
 
-	dbPath, err := unzipFile(filePath, tmpDir)
+func (ls *LocalSpooler) processFile(ctx context.Context, filePath, filename string, token AckToken) (int, error) {
+	format, err := sniffFile(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to unzip file: %w", err)
+		return 0, err
 	}
 
-	if err := processDatabase(ctx, dbPath, filename, ls.rowChan, ls.logger); err != nil {
-		return fmt.Errorf("failed to process database: %w", err)
+	if format == formatSQLite {
+		return ls.processDatabases(ctx, []string{filePath}, filename, token)
 	}
 
-	if err := os.Remove(filePath); err != nil {
-		ls.logger.Error("Failed to remove zip file %s: %v", filePath, err)
-	} else {
-		ls.logger.Debug("Cleaned up zip file: %s", filePath)
+	var dbPaths []string
+	switch format {
+	case formatZip:
+		r, err := zip.OpenReader(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unzip file: %w", err)
+		}
+		defer r.Close()
+
+		entries, err := databaseEntries(&r.Reader)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unzip file: %w", err)
+		}
+
+		// Refuse the file up front if the extracted databases would not fit
+		res, err := ls.scratch.budget.reserve(ctx, uncompressedSize(entries), 0)
+		if err != nil {
+			return 0, err
+		}
+		defer res.release()
+
+		tmpDir, err := ls.scratch.mkdirTemp("local-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		if dbPaths, err = extractEntries(entries, tmpDir, res); err != nil {
+			return 0, err
+		}
+
+	case formatGzip, formatZstd, formatTar:
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat file: %w", err)
+		}
+
+		// The extracted size is unknown, so admit the file with an allowance
+		// of its own size and grow the reservation while extracting
+		res, err := ls.scratch.budget.reserve(ctx, 0, info.Size())
+		if err != nil {
+			return 0, err
+		}
+		defer res.release()
+
+		tmpDir, err := ls.scratch.mkdirTemp("local-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+
+		if dbPaths, err = extractStream(f, filename, tmpDir, res); err != nil {
+			return 0, fmt.Errorf("failed to extract %s stream: %w", format, err)
+		}
+
+	default:
+		return 0, permanent(fmt.Errorf("unrecognized file format"))
 	}
 
-	return nil
+	return ls.processDatabases(ctx, dbPaths, filename, token)
 }
 
 func (ss *S3Spooler) Start(ctx context.Context) error {
-	ss.logger.Info("Starting S3 spooler in %s mode (bucket: %s, prefix: %s)", ss.mode, ss.bucket, ss.prefix)
+	ss.logger.Info("Starting S3 spooler in %s mode (bucket: %s, prefixes: %s)", ss.mode, ss.bucket, strings.Join(ss.prefixes, ", "))
+
+	if ss.notifications != nil {
+		ss.logger.Info("Discovering files from S3 notifications on %s", ss.notifications.queueURL)
+		go ss.consumeNotifications(ctx)
+		return nil
+	}
 
 	go func() {
-		defer close(ss.rowChan)
+		defer close(ss.records)
 
 		for {
 			files, err := ss.discoverFiles(ctx)
 			if err != nil {
 				ss.logger.Error("Failed to discover files: %v", err)
 			} else {
-				ss.processFiles(ctx, files)
+				ss.processFiles(ctx, files, nil)
 			}
 
 			if ss.mode == "once" {
@@ -247,221 +889,348 @@ func (ss *S3Spooler) Start(ctx context.Context) error {
 	return nil
 }
 
-func (ss *S3Spooler) GetRowChannel() <-chan SQLiteRow {
-	return ss.rowChan
-}
-
 func (ss *S3Spooler) Stop() error {
 	ss.logger.Info("Stopping S3 spooler")
+	ss.stopAcks()
+	if ss.notifications != nil {
+		ss.notifications.close()
+	}
 	return nil
 }
 
 func (ss *S3Spooler) discoverFiles(ctx context.Context) ([]string, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket:       aws.String(ss.bucket),
-		Prefix:       aws.String(ss.prefix),
-		RequestPayer: "requester",
-	}
-
-	result, err := ss.s3Client.ListObjectsV2(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
-	}
+	full := ss.fullListing > 0 && time.Since(ss.listedFully) >= ss.fullListing
 
 	var files []string
-	for _, obj := range result.Contents {
-		key := *obj.Key
-		filename := filepath.Base(key)
-
-		if !strings.HasSuffix(filename, ".db.zip") {
-			continue
+	listed := make(map[string]bool)
+	for _, prefix := range ss.prefixes {
+		keys, err := ss.discoverPrefix(ctx, prefix, listed, full)
+		if err != nil {
+			return nil, err
 		}
-
-		if ss.stateManager.IsProcessed(filename) {
-			ss.logger.Debug("Skipping already processed file: %s", filename)
-			continue
-		}
-
-		if ss.stateManager.IsFailed(filename) {
-			ss.logger.Debug("Skipping previously failed file: %s", filename)
-			continue
-		}
-
-		files = append(files, key)
+		files = append(files, keys...)
+	}
+	if full {
+		ss.listedFully = time.Now()
 	}
 
+	// Keys at or below the watermark of their prefix are no longer listed,
+	// so only their entries can be pruned
+	ss.compactState(listed)
+
 	sort.Strings(files)
 	ss.logger.Info("Discovered %d unprocessed files in S3", len(files))
 	return files, nil
 }
 
-func (ss *S3Spooler) processFiles(ctx context.Context, keys []string) {
-	for _, key := range keys {
-		select {
-		case <-ctx.Done():
-			ss.logger.Info("Context cancelled during file processing")
-			return
-		default:
-		}
-
-		filename := filepath.Base(key)
-		ss.logger.Info("Processing S3 file: %s", key)
+// s3WatermarkName is the name under which the watermark of a prefix is stored
+func s3WatermarkName(bucket, prefix string) string {
+	return fmt.Sprintf("s3://%s/%s", bucket, prefix)
+}
 
-		if err := ss.processFile(ctx, key, filename); err != nil {
-			ss.logger.Error("Failed to process S3 file %s: %v", key, err)
-			ss.stateManager.MarkFailed(filename, err.Error())
-		} else {
-			// TODO: Move state update to after Elasticsearch indexing is confirmed.
-			// Currently marking as processed after rows are queued to channel, but should
-			// happen after ES confirms successful indexing. Need to implement acknowledgment
-			// mechanism from main thread back to spooler (e.g., via separate ack channel).
-			ss.stateManager.MarkProcessed(filename)
-		}
+// s3WatermarkPrefix returns the prefix of an S3 watermark name
+func s3WatermarkPrefix(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, "s3://")
+	if !ok {
+		return "", false
 	}
+	_, prefix, ok := strings.Cut(rest, "/")
+	return prefix, ok
 }
 
-func (ss *S3Spooler) processFile(ctx context.Context, key, filename string) error {
-	tmpDir, err := os.MkdirTemp("", "ingest-s3-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
-	}
-	defer os.RemoveAll(tmpDir)
+// discoverPrefix lists every page of keys after the prefix watermark and
+// returns the unprocessed source file keys, including failed files due for a
+// retry. The watermark is advanced over the leading run of keys that are
+// already processed, quarantined or not databases. Every listed key is added
+// to listed.
+//
+// A full listing starts from the first key instead. Keys behind the watermark
+// that still have an entry have their content checked, and those found due
+// again are attempted; keys whose entry was pruned are left alone.
+func (ss *S3Spooler) discoverPrefix(ctx context.Context, prefix string, listed map[string]bool, full bool) ([]string, error) {
+	watermarkName := s3WatermarkName(ss.bucket, prefix)
+	startAfter := ss.stateManager.Watermark(watermarkName)
 
-	zipPath := filepath.Join(tmpDir, filename)
-	if err := ss.downloadFile(ctx, key, zipPath); err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+	input := &s3.ListObjectsV2Input{
+		Bucket:       aws.String(ss.bucket),
+		Prefix:       aws.String(prefix),
+		RequestPayer: ss.requestPayer,
 	}
-
-	dbPath, err := unzipFile(zipPath, tmpDir)
-	if err != nil {
-		return fmt.Errorf("failed to unzip file: %w", err)
+	if full {
+		ss.logger.Info("Listing every key under %s to check the content of processed keys", prefix)
+	} else if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
 	}
 
-	if err := processDatabase(ctx, dbPath, filename, ss.rowChan, ss.logger); err != nil {
-		return fmt.Errorf("failed to process database: %w", err)
-	}
+	var files []string
+	watermark := startAfter
+	advancing := true
+	count := 0
+
+	paginator := s3.NewListObjectsV2Paginator(ss.s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects under %s: %w", prefix, err)
+		}
 
-	return nil
-}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			filename := filepath.Base(key)
+			listed[key] = true
+			count++
 
-func (ss *S3Spooler) downloadFile(ctx context.Context, key, destPath string) error {
-	input := &s3.GetObjectInput{
-		Bucket:       aws.String(ss.bucket),
-		Key:          aws.String(key),
-		RequestPayer: "requester",
-	}
+			if isSourceFile(filename) {
+				ss.adoptLegacyEntry(key)
+			}
 
-	result, err := ss.s3Client.GetObject(ctx, input)
-	if err != nil {
-		return fmt.Errorf("failed to get S3 object: %w", err)
+			// Rows of the file are still queued or awaiting acknowledgement;
+			// it holds the watermark until it is done
+			if isSourceFile(filename) && ss.isPending(key) {
+				ss.logger.Debug("Skipping file still being processed: %s", key)
+				if key > startAfter {
+					advancing = false
+				}
+				continue
+			}
+
+			if startAfter != "" && key <= startAfter {
+				if _, exists := ss.stateManager.Entry(key); exists && isSourceFile(filename) {
+					ss.observe(key, aws.ToString(obj.ETag), aws.ToInt64(obj.Size))
+					if ss.stateManager.RetryDue(key) {
+						ss.passed[key] = true
+					}
+				}
+				continue
+			}
+
+			if isSourceFile(filename) {
+				ss.observe(key, aws.ToString(obj.ETag), aws.ToInt64(obj.Size))
+			}
+
+			done := true
+			switch {
+			case !isSourceFile(filename):
+			case ss.stateManager.IsProcessed(key):
+				ss.logger.Debug("Skipping already processed file: %s", key)
+			case ss.stateManager.IsQuarantined(key):
+				ss.logger.Debug("Skipping quarantined file: %s", key)
+			case ss.stateManager.IsFailed(key) && !ss.stateManager.RetryDue(key):
+				// Hold the watermark until the file is retried
+				ss.logger.Debug("Skipping failed file until its retry at %s: %s", ss.stateManager.RetryAt(key).Format(time.RFC3339), key)
+				done = false
+			case ss.stateManager.IsChanged(key):
+				// Hold the watermark until the file is retried
+				ss.logger.Debug("Skipping changed file until it is retried: %s", key)
+				done = false
+			default:
+				done = false
+				files = append(files, key)
+			}
+
+			if done && advancing {
+				watermark = key
+			} else {
+				advancing = false
+			}
+		}
 	}
-	defer result.Body.Close()
 
-	outFile, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	for key := range ss.passed {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry, exists := ss.stateManager.Entry(key)
+		switch {
+		case !exists || key > startAfter:
+			// Forgotten, or listed again after the watermark
+			delete(ss.passed, key)
+		case entry.Status == FileStatusProcessed || entry.Status == FileStatusQuarantined || entry.Status == FileStatusChanged:
+			delete(ss.passed, key)
+		case entry.Status == FileStatusFailed && !ss.stateManager.RetryDue(key):
+		case ss.isPending(key):
+		default:
+			files = append(files, key)
+		}
 	}
-	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, result.Body); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	if watermark != startAfter {
+		if err := ss.stateManager.SetWatermark(watermarkName, watermark); err != nil {
+			ss.logger.Error("Failed to save watermark for %s: %v", watermarkName, err)
+		}
 	}
 
-	ss.logger.Debug("Downloaded S3 file to: %s", destPath)
-	return nil
+	ss.logger.Debug("Listed %d keys under %s after %q, watermark now %q", count, prefix, startAfter, watermark)
+	return files, nil
 }
 
-func unzipFile(zipPath, destDir string) (string, error) {
-	r, err := zip.OpenReader(zipPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open zip file: %w", err)
+// adoptLegacyEntry moves an entry earlier versions kept under the base name
+// of key to key
+func (ss *S3Spooler) adoptLegacyEntry(key string) {
+	if err := ss.stateManager.AdoptLegacyEntry(key); err != nil {
+		ss.logger.Error("%v", err)
 	}
-	defer r.Close()
+}
 
-	if len(r.File) == 0 {
-		return "", fmt.Errorf("zip file is empty")
+// observe records the ETag and size of an object as the content of its key
+func (ss *S3Spooler) observe(key, etag string, size int64) {
+	if err := ss.stateManager.Observe(key, s3Fingerprint(etag, size)); err != nil {
+		ss.logger.Error("Failed to record content of %s: %v", key, err)
 	}
+}
 
-	var dbPath string
-	for _, f := range r.File {
-		if strings.HasSuffix(f.Name, ".db") {
-			fpath := filepath.Join(destDir, filepath.Base(f.Name))
+// processFiles processes keys in order while the next files are downloaded
+// and extracted in the background. onComplete, if set, is called with the key once a file
+// has been marked processed.
+func (ss *S3Spooler) processFiles(ctx context.Context, keys []string, onComplete func(key string)) {
+	prefetcher := ss.startPrefetch(ctx, keys)
+	defer prefetcher.close()
 
-			rc, err := f.Open()
-			if err != nil {
-				return "", fmt.Errorf("failed to open file in zip: %w", err)
-			}
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			ss.logger.Info("Context cancelled during file processing")
+			return
+		default:
+		}
 
-			outFile, err := os.Create(fpath)
-			if err != nil {
-				rc.Close()
-				return "", fmt.Errorf("failed to create output file: %w", err)
-			}
+		file := prefetcher.next()
+		if file.skipped {
+			prefetcher.release(file)
+			continue
+		}
+
+		var done func()
+		if onComplete != nil {
+			done = func() { onComplete(key) }
+		}
+		token := ss.beginFile(key, done, nil)
+		ss.logger.Info("Processing S3 file: %s", key)
 
-			_, err = io.Copy(outFile, rc)
-			outFile.Close()
-			rc.Close()
+		queued, err := 0, file.err
+		if err == nil {
+			queued, err = ss.processDatabases(ctx, file.paths, key, token)
+		}
+		prefetcher.release(file)
 
-			if err != nil {
-				return "", fmt.Errorf("failed to extract file: %w", err)
+		if err != nil {
+			if ctx.Err() != nil {
+				ss.logger.Info("Context cancelled while processing %s, leaving it for the next run", key)
+				ss.abandonFile(token)
+				return
 			}
-
-			dbPath = fpath
-			break
+			if errors.Is(err, errInsufficientDisk) {
+				ss.logger.Error("Not enough disk space for %s, leaving it for the next run: %v", key, err)
+				ss.abandonFile(token)
+				return
+			}
+			if errors.Is(err, errLeaseLost) {
+				ss.logger.Error("Lost the lease on %s, leaving it to the replica that took it over", key)
+				ss.abandonFile(token)
+				continue
+			}
+			ss.logger.Error("Failed to process S3 file %s: %v", key, err)
+			ss.failFile(token, err)
+		} else {
+			ss.sealFile(token, queued)
 		}
 	}
+}
 
-	if dbPath == "" {
-		return "", fmt.Errorf("no .db file found in zip archive")
+// processDatabases queues the rows of every database extracted from one file,
+// resuming after the checkpoint of an earlier attempt if there is one
+func (bs *baseSpooler) processDatabases(ctx context.Context, dbPaths []string, filename string, token AckToken) (int, error) {
+	resume, resuming := bs.resumePoint(token)
+	if resuming {
+		bs.logger.Info("Resuming %s after row %d of database %d (%d rows already acknowledged)", filename, resume.LastRowid, resume.Database, resume.RowsAcked)
 	}
 
-	return dbPath, nil
+	total := 0
+	for i, dbPath := range dbPaths {
+		if resuming && i < resume.Database {
+			continue
+		}
+
+		var after *int64
+		if resuming && i == resume.Database {
+			after = &resume.LastRowid
+		}
+
+		queued, err := bs.processDatabase(ctx, dbPath, filename, token, i, after)
+		total += queued
+		if err != nil {
+			return total, fmt.Errorf("failed to process database: %w", err)
+		}
+	}
+	return total, nil
 }
 
-func processDatabase(ctx context.Context, dbPath, filename string, rowChan chan<- SQLiteRow, logger *IngestLogger) error {
+// processDatabase queues the rows of the database-th database of a file in
+// rowid order, starting after rowid after if it is set
+func (bs *baseSpooler) processDatabase(ctx context.Context, dbPath, filename string, token AckToken, database int, after *int64) (int, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to open SQLite database: %w", err)
+		return 0, fmt.Errorf("failed to open SQLite database: %w", err)
 	}
 	defer db.Close()
 
-	rows, err := db.QueryContext(ctx, `
-		SELECT at_uri, did, raw_post, inferences
+	query := `
+		SELECT rowid, at_uri, did, raw_post, inferences
 		FROM enriched_posts
-	`)
+		ORDER BY rowid
+	`
+	var args []any
+	if after != nil {
+		query = `
+		SELECT rowid, at_uri, did, raw_post, inferences
+		FROM enriched_posts
+		WHERE rowid > ?
+		ORDER BY rowid
+	`
+		args = append(args, *after)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to query enriched_posts: %w", err)
+		return 0, fmt.Errorf("failed to query enriched_posts: %w", err)
 	}
 	defer rows.Close()
 
 	rowCount := 0
 	for rows.Next() {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("context cancelled during database processing")
-		default:
+		// Another replica takes the file over once the lease on it is lost
+		if rowCount%checkpointRows == 0 && !bs.stateManager.HoldsLease(filename) {
+			return rowCount, fmt.Errorf("stopped reading %s: %w", filename, errLeaseLost)
 		}
 
+		var rowid int64
 		var atURI, did, rawPost, inferences string
-		if err := rows.Scan(&atURI, &did, &rawPost, &inferences); err != nil {
-			logger.Error("Failed to scan row from %s: %v", filename, err)
+		if err := rows.Scan(&rowid, &atURI, &did, &rawPost, &inferences); err != nil {
+			bs.logger.Error("Failed to scan row from %s: %v", filename, err)
 			continue
 		}
 
-		rowChan <- SQLiteRow{
-			AtURI:          atURI,
-			DID:            did,
-			RawPost:        rawPost,
-			Inferences:     inferences,
-			SourceFilename: filename,
+		row := Record{
+			AtURI:      atURI,
+			DID:        did,
+			RawPost:    rawPost,
+			Inferences: inferences,
+			Source:     filename,
+			Token:      bs.rowToken(token, database, rowid),
+		}
+
+		select {
+		case <-ctx.Done():
+			return rowCount, fmt.Errorf("context cancelled during database processing")
+		case bs.records <- row:
 		}
 		rowCount++
 	}
 
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating rows: %w", err)
+		return rowCount, fmt.Errorf("error iterating rows: %w", err)
 	}
 
-	logger.Info("Queued %d rows from %s", rowCount, filename)
-	return nil
+	bs.logger.Info("Queued %d rows from %s", rowCount, filename)
+	return rowCount, nil
 }
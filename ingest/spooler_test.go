@@ -0,0 +1,433 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// createTestDatabase writes a Megastream-style SQLite database with rowCount rows
+func createTestDatabase(t *testing.T, dbPath string, rowCount int) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE enriched_posts (at_uri TEXT, did TEXT, raw_post TEXT, inferences TEXT)`); err != nil {
+		t.Fatalf("Failed to create enriched_posts table: %v", err)
+	}
+
+	for i := range rowCount {
+		atURI := fmt.Sprintf("at://did:plc:test/app.bsky.feed.post/%d", i)
+		if _, err := db.Exec(`INSERT INTO enriched_posts VALUES (?, ?, ?, ?)`, atURI, "did:plc:test", "{}", "{}"); err != nil {
+			t.Fatalf("Failed to insert test row: %v", err)
+		}
+	}
+}
+
+// createTestZip writes a .db.zip file containing a test database with rowCount rows
+func createTestZip(t *testing.T, zipPath string, rowCount int) {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	createTestDatabase(t, dbPath, rowCount)
+
+	out, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to create zip file: %v", err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	w, err := zw.Create("test.db")
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+
+	in, err := os.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(w, in); err != nil {
+		t.Fatalf("Failed to write zip entry: %v", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zip writer: %v", err)
+	}
+}
+
+// drainAndAck reads every row from the spooler and acknowledges it with ackErr
+func drainAndAck(t *testing.T, spooler DataSource, ackErr error) int {
+	t.Helper()
+
+	count := 0
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case row, ok := <-spooler.Records():
+			if !ok {
+				return count
+			}
+			spooler.Ack(Ack{Token: row.Token, Count: 1, Err: ackErr})
+			count++
+		case <-timeout:
+			t.Fatal("Timed out waiting for spooler rows")
+		}
+	}
+}
+
+func TestLocalSpooler_MarksProcessedOnlyAfterAck(t *testing.T) {
+	dir := t.TempDir()
+	logger := NewLogger(false)
+	filename := "test_file.db.zip"
+	zipPath := filepath.Join(dir, filename)
+	createTestZip(t, zipPath, 3)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+
+	row := <-spooler.Records()
+	if sm.IsProcessed(filename) {
+		t.Error("Expected file not to be processed before rows are acknowledged")
+	}
+	spooler.Ack(Ack{Token: row.Token, Count: 1})
+
+	if count := drainAndAck(t, spooler, nil); count != 2 {
+		t.Errorf("Expected 2 remaining rows, got %d", count)
+	}
+
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	if !sm.IsProcessed(filename) {
+		t.Error("Expected file to be processed after all rows are acknowledged")
+	}
+
+	if _, err := os.Stat(zipPath); !os.IsNotExist(err) {
+		t.Error("Expected zip file to be removed after processing")
+	}
+}
+
+func TestLocalSpooler_FailedAckKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	logger := NewLogger(false)
+	filename := "test_file.db.zip"
+	zipPath := filepath.Join(dir, filename)
+	createTestZip(t, zipPath, 3)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+
+	drainAndAck(t, spooler, errors.New("bulk request failed"))
+
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	if !sm.IsFailed(filename) {
+		t.Error("Expected file to be marked as failed after a failed ack")
+	}
+
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Errorf("Expected zip file to be kept after a failed ack: %v", err)
+	}
+}
+
+func TestLocalSpooler_UnackedFileNotMarked(t *testing.T) {
+	dir := t.TempDir()
+	logger := NewLogger(false)
+	filename := "test_file.db.zip"
+	zipPath := filepath.Join(dir, filename)
+	createTestZip(t, zipPath, 2)
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+
+	for range spooler.Records() {
+	}
+
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	if sm.IsProcessed(filename) || sm.IsFailed(filename) {
+		t.Error("Expected unacknowledged file to have no state")
+	}
+
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Errorf("Expected unacknowledged zip file to be kept: %v", err)
+	}
+}
+
+// fakeS3 serves zip files from memory and pages ListObjectsV2 results
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	pageSize int
+	lists    []s3.ListObjectsV2Input
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists = append(f.lists, *params)
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.StartAfter) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, s3types.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(f.objects[key]))),
+			ETag: aws.String(f.etag(key)),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", aws.ToString(params.Key))
+	}
+	if params.Range != nil {
+		var start, end int
+		fmt.Sscanf(aws.ToString(params.Range), "bytes=%d-%d", &start, &end)
+		data = data[start : end+1]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", aws.ToString(params.Key))
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), ETag: aws.String(f.etag(aws.ToString(params.Key)))}, nil
+}
+
+// etag returns the ETag of key, the MD5 digest of its content, with f.mu held
+func (f *fakeS3) etag(key string) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(f.objects[key]))
+}
+
+func TestS3Spooler_PaginatesPrefixesWithWatermark(t *testing.T) {
+	logger := NewLogger(false)
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	fake := &fakeS3{objects: make(map[string][]byte), pageSize: 2}
+	for _, key := range []string{
+		"a/mega_20250101_000000.db.zip",
+		"a/mega_20250101_010000.db.zip",
+		"a/index.txt",
+		"a/mega_20250101_020000.db.zip",
+		"b/mega_20250102_000000.db.zip",
+	} {
+		fake.objects[key] = zipData
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	sm, err := NewStateManager(stateFile, logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/", "b/"}, "once", time.Second, sm, logger)
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 8 {
+		t.Errorf("Expected 8 rows from 4 files across pages and prefixes, got %d", count)
+	}
+	spooler.Stop()
+
+	for _, name := range []string{"a/mega_20250101_000000.db.zip", "a/mega_20250101_020000.db.zip", "b/mega_20250102_000000.db.zip"} {
+		if !sm.IsProcessed(name) {
+			t.Errorf("Expected %s to be processed", name)
+		}
+	}
+
+	// The next poll advances the watermark over the processed keys
+	fake.objects["a/mega_20250101_030000.db.zip"] = zipData
+	sm, err = NewStateManager(stateFile, logger)
+	if err != nil {
+		t.Fatalf("Failed to reload state manager: %v", err)
+	}
+
+	spooler = newS3SpoolerWithClient(fake, "bucket", []string{"a/", "b/"}, "once", time.Second, sm, logger)
+	fake.lists = nil
+	spooler.Start(context.Background())
+	if count := drainAndAck(t, spooler, nil); count != 2 {
+		t.Errorf("Expected only the new file to be processed, got %d rows", count)
+	}
+	spooler.Stop()
+
+	if got := aws.ToString(fake.lists[0].StartAfter); got != "a/index.txt" {
+		t.Errorf("Expected the first poll to have advanced over the non-database key, got StartAfter %q", got)
+	}
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_20250101_020000.db.zip" {
+		t.Errorf("Expected watermark at last fully handled key, got %q", got)
+	}
+
+	// A third poll lists only keys after the watermark and advances it over
+	// the file processed by the second poll
+	fake.lists = nil
+	spooler = newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Second, sm, logger)
+	spooler.Start(context.Background())
+	if count := drainAndAck(t, spooler, nil); count != 0 {
+		t.Errorf("Expected no rows on third poll, got %d", count)
+	}
+	spooler.Stop()
+
+	if got := aws.ToString(fake.lists[0].StartAfter); got != "a/mega_20250101_020000.db.zip" {
+		t.Errorf("Expected listing to start after the watermark, got %q", got)
+	}
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_20250101_030000.db.zip" {
+		t.Errorf("Expected watermark to advance to the newest processed key, got %q", got)
+	}
+}
+
+func TestSpoolers_DoNotQueuePendingFilesAgain(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 3)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		new  func(sm *StateManager) DataSource
+	}{
+		{"local", "mega_1.db.zip", func(sm *StateManager) DataSource {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "mega_1.db.zip"), zipData, 0644); err != nil {
+				t.Fatalf("Failed to write test zip: %v", err)
+			}
+			return NewLocalSpooler(dir, "spool", 10*time.Millisecond, sm, NewLogger(false))
+		}},
+		{"s3", "a/mega_1.db.zip", func(sm *StateManager) DataSource {
+			fake := &fakeS3{objects: map[string][]byte{"a/mega_1.db.zip": zipData}, pageSize: 10}
+			return newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "spool", 10*time.Millisecond, sm, NewLogger(false))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+			if err != nil {
+				t.Fatalf("Failed to create state manager: %v", err)
+			}
+			spooler := tc.new(sm)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := spooler.Start(ctx); err != nil {
+				t.Fatalf("Failed to start spooler: %v", err)
+			}
+			defer spooler.Stop()
+
+			// Acknowledgements are slow, so that polls run while the file
+			// is pending
+			var held []Record
+			deadline := time.After(300 * time.Millisecond)
+		collect:
+			for {
+				select {
+				case record := <-spooler.Records():
+					held = append(held, record)
+				case <-deadline:
+					break collect
+				}
+			}
+			if len(held) != 3 {
+				t.Fatalf("Expected the 3 rows to be queued once, got %d", len(held))
+			}
+
+			for _, record := range held {
+				spooler.Ack(Ack{Token: record.Token, Count: 1})
+			}
+			deadline = time.After(5 * time.Second)
+			for !sm.IsProcessed(tc.key) {
+				select {
+				case record := <-spooler.Records():
+					t.Fatalf("Expected no more rows, got %s", record.AtURI)
+				case <-deadline:
+					t.Fatal("Timed out waiting for the file to be processed")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got := parsePrefixes(" a/, ,b/ ,")
+	if len(got) != 2 || got[0] != "a/" || got[1] != "b/" {
+		t.Errorf("Unexpected prefixes: %q", got)
+	}
+}
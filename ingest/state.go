@@ -1,42 +1,111 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/elastic/go-elasticsearch/v9"
 )
 
 type FileStatus string
 
 const (
 	FileStatusProcessed FileStatus = "processed"
-	FileStatusFailed    FileStatus = "failed"
+	// FileStatusInProgress files have been partly acknowledged and resume
+	// after their checkpoint
+	FileStatusInProgress FileStatus = "in_progress"
+	// FileStatusFailed files are attempted again once NextRetry has passed
+	FileStatusFailed FileStatus = "failed"
+	// FileStatusQuarantined files are never attempted again
+	FileStatusQuarantined FileStatus = "quarantined"
+	// FileStatusChanged files were found with other content than their entry
+	// was written for, and are skipped until retried
+	FileStatusChanged FileStatus = "changed"
 )
 
+// FileStateEntry is the state of one file. S3 objects are keyed by their full
+// key and local files by their name; entries written by earlier versions
+// under the base name of S3 keys are moved to a key by AdoptLegacyEntry.
 type FileStateEntry struct {
 	Filename  string     `json:"filename"`
 	Status    FileStatus `json:"status"`
 	Timestamp time.Time  `json:"timestamp"`
 	Error     string     `json:"error,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	NextRetry time.Time  `json:"next_retry,omitzero"`
+
+	// Checkpoint of a partly acknowledged file, see FileProgress
+	Database  int   `json:"database,omitempty"`
+	LastRowid int64 `json:"last_rowid,omitempty"`
+	RowsAcked int   `json:"rows_acked,omitempty"`
+
+	// Fingerprint identifies the content the entry was written for: the
+	// ETag and size of an S3 object or the SHA-256 digest of a local file
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// FileProgress is the checkpoint of a partly acknowledged file: every row up
+// to and including LastRowid of the Database-th database extracted from it,
+// and every row of the databases before it, has been acknowledged
+type FileProgress struct {
+	Database  int
+	LastRowid int64
+	RowsAcked int
 }
 
 type StateManager struct {
-	stateFilePath string
-	mu            sync.RWMutex
-	state         map[string]FileStateEntry
-	logger        *IngestLogger
+	backend    StateBackend
+	mu         sync.RWMutex
+	state      map[string]FileStateEntry
+	watermarks map[string]string
+	summaries  map[string]DaySummary
+	retry      RetryPolicy
+	retention  RetentionPolicy
+	compacted  time.Time
+	now        func() time.Time
+	logger     *IngestLogger
+
+	// fingerprints holds the content observed for files being attempted,
+	// until their entry is written, see Observe
+	fingerprints map[string]string
+	changed      ChangedContentPolicy
+
+	// lock keeps other processes from opening a state only one process may
+	// use at a time, see OpenStateManager
+	lock *os.File
 }
 
+// NewStateManager returns a state manager that keeps its state in the JSON
+// file at stateFilePath
 func NewStateManager(stateFilePath string, logger *IngestLogger) (*StateManager, error) {
+	return NewStateManagerWithBackend(newJSONStateBackend(stateFilePath, logger), logger)
+}
+
+// NewStateManagerWithBackend returns a state manager that loads its state
+// from backend and writes every change through to it
+func NewStateManagerWithBackend(backend StateBackend, logger *IngestLogger) (*StateManager, error) {
 	sm := &StateManager{
-		stateFilePath: stateFilePath,
-		state:         make(map[string]FileStateEntry),
-		logger:        logger,
+		backend:    backend,
+		state:      make(map[string]FileStateEntry),
+		watermarks: make(map[string]string),
+		summaries:  make(map[string]DaySummary),
+		retry:      DefaultRetryPolicy(),
+		now:        time.Now,
+		logger:     logger,
+
+		fingerprints: make(map[string]string),
+		changed:      ChangedContentReprocess,
 	}
 
 	if err := sm.LoadState(); err != nil {
+		backend.Close()
 		return nil, err
 	}
 
@@ -47,82 +116,110 @@ func (sm *StateManager) LoadState() error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	if _, err := os.Stat(sm.stateFilePath); os.IsNotExist(err) {
-		sm.logger.Info("State file does not exist, starting with empty state")
-		return nil
-	}
-
-	data, err := os.ReadFile(sm.stateFilePath)
+	file, err := sm.backend.Load()
 	if err != nil {
-		return fmt.Errorf("failed to read state file: %w", err)
-	}
-
-	if len(data) == 0 {
-		sm.logger.Info("State file is empty, starting with empty state")
-		return nil
-	}
-
-	var entries []FileStateEntry
-	if err := json.Unmarshal(data, &entries); err != nil {
-		return fmt.Errorf("failed to unmarshal state file: %w", err)
+		return err
 	}
 
-	for _, entry := range entries {
+	for _, entry := range file.Files {
 		sm.state[entry.Filename] = entry
 	}
+	maps.Copy(sm.watermarks, file.Watermarks)
+	maps.Copy(sm.summaries, file.Summaries)
 
 	sm.logger.Info("Loaded state with %d entries", len(sm.state))
 	return nil
 }
 
+// SaveState writes the whole state to the backend, replacing what it holds
 func (sm *StateManager) SaveState() error {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	entries := make([]FileStateEntry, 0, len(sm.state))
+	files := make([]FileStateEntry, 0, len(sm.state))
 	for _, entry := range sm.state {
-		entries = append(entries, entry)
-	}
-
-	data, err := json.MarshalIndent(entries, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
+		files = append(files, entry)
 	}
+	return sm.backend.Replace(stateFile{
+		Files:      files,
+		Watermarks: sm.watermarks,
+		Summaries:  sm.summaries,
+	})
+}
 
-	if err := os.WriteFile(sm.stateFilePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write state file: %w", err)
+// Close releases the backend
+func (sm *StateManager) Close() error {
+	err := sm.backend.Close()
+	if sm.lock != nil {
+		sm.lock.Close()
 	}
-
-	return nil
+	return err
 }
 
 func (sm *StateManager) IsProcessed(filename string) bool {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	entry, exists := sm.state[filename]
+	entry, exists := sm.entryUnsafe(filename)
 	return exists && entry.Status == FileStatusProcessed
 }
 
+// SetRetryPolicy replaces the policy applied by later calls to MarkFailed
+func (sm *StateManager) SetRetryPolicy(policy RetryPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.retry = policy
+}
+
+// IsFailed reports whether the file has failed, whether or not it will be
+// retried
 func (sm *StateManager) IsFailed(filename string) bool {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	entry, exists := sm.state[filename]
-	return exists && entry.Status == FileStatusFailed
+	entry, exists := sm.entryUnsafe(filename)
+	return exists && (entry.Status == FileStatusFailed || entry.Status == FileStatusQuarantined)
+}
+
+// IsQuarantined reports whether the file has failed for good
+func (sm *StateManager) IsQuarantined(filename string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.entryUnsafe(filename)
+	return exists && entry.Status == FileStatusQuarantined
+}
+
+// RetryDue reports whether a failed file may be attempted again now
+func (sm *StateManager) RetryDue(filename string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.entryUnsafe(filename)
+	return exists && entry.Status == FileStatusFailed && !sm.now().Before(entry.NextRetry)
+}
+
+// RetryAt returns when a failed file will be attempted again
+func (sm *StateManager) RetryAt(filename string) time.Time {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, _ := sm.entryUnsafe(filename)
+	return entry.NextRetry
 }
 
 func (sm *StateManager) MarkProcessed(filename string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	sm.state[filename] = FileStateEntry{
-		Filename:  filename,
-		Status:    FileStatusProcessed,
-		Timestamp: time.Now().UTC(),
+	entry := FileStateEntry{
+		Filename:    filename,
+		Status:      FileStatusProcessed,
+		Timestamp:   time.Now().UTC(),
+		Fingerprint: sm.fingerprintUnsafe(filename),
 	}
-
-	if err := sm.saveStateUnsafe(); err != nil {
+	if err := sm.putUnsafe(entry); err != nil {
 		return err
 	}
 
@@ -130,39 +227,535 @@ func (sm *StateManager) MarkProcessed(filename string) error {
 	return nil
 }
 
+// SetProgress records the checkpoint of a file that is still being processed
+func (sm *StateManager) SetProgress(filename string, progress FileProgress) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	prev, _ := sm.entryUnsafe(filename)
+	entry := FileStateEntry{
+		Filename:    filename,
+		Status:      FileStatusInProgress,
+		Timestamp:   sm.now().UTC(),
+		Attempts:    prev.Attempts,
+		Database:    progress.Database,
+		LastRowid:   progress.LastRowid,
+		RowsAcked:   progress.RowsAcked,
+		Fingerprint: sm.fingerprintUnsafe(filename),
+	}
+	if err := sm.putUnsafe(entry); err != nil {
+		return err
+	}
+
+	sm.logger.Debug("Checkpointed %s at row %d of database %d (%d rows acknowledged)", filename, progress.LastRowid, progress.Database, progress.RowsAcked)
+	return nil
+}
+
+// Progress returns the checkpoint left by an earlier attempt at the file, if
+// any
+func (sm *StateManager) Progress(filename string) (FileProgress, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.entryUnsafe(filename)
+	if !exists || entry.RowsAcked == 0 {
+		return FileProgress{}, false
+	}
+	if entry.Status != FileStatusInProgress && entry.Status != FileStatusFailed {
+		return FileProgress{}, false
+	}
+
+	return FileProgress{
+		Database:  entry.Database,
+		LastRowid: entry.LastRowid,
+		RowsAcked: entry.RowsAcked,
+	}, true
+}
+
+// MarkFailed records a failed attempt at a file. The file is retried after
+// the backoff of the retry policy, or quarantined once it has used up its
+// attempts. The checkpoint of the file is kept, so that the retry resumes
+// after it.
 func (sm *StateManager) MarkFailed(filename string, errMsg string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	sm.state[filename] = FileStateEntry{
-		Filename:  filename,
-		Status:    FileStatusFailed,
-		Timestamp: time.Now().UTC(),
-		Error:     errMsg,
+	prev, exists := sm.entryUnsafe(filename)
+	attempts := 1
+	if exists && (prev.Status == FileStatusFailed || prev.Status == FileStatusInProgress) {
+		attempts = prev.Attempts + 1
+	}
+
+	now := sm.now().UTC()
+	entry := FileStateEntry{
+		Filename:    filename,
+		Status:      FileStatusFailed,
+		Timestamp:   now,
+		Error:       errMsg,
+		Attempts:    attempts,
+		Database:    prev.Database,
+		LastRowid:   prev.LastRowid,
+		RowsAcked:   prev.RowsAcked,
+		Fingerprint: sm.fingerprintUnsafe(filename),
+	}
+	if attempts >= sm.retry.MaxAttempts {
+		entry.Status = FileStatusQuarantined
+	} else {
+		entry.NextRetry = now.Add(sm.retry.delay(attempts))
+	}
+	if err := sm.putUnsafe(entry); err != nil {
+		return err
+	}
+
+	if entry.Status == FileStatusQuarantined {
+		sm.logger.Error("Quarantined file after %d attempts: %s - %s", attempts, filename, errMsg)
+	} else {
+		sm.logger.Error("Marked file as failed (attempt %d of %d, retry at %s): %s - %s", attempts, sm.retry.MaxAttempts, entry.NextRetry.Format(time.RFC3339), filename, errMsg)
+	}
+	return nil
+}
+
+// Quarantine records a failure that retrying cannot fix, so the file is never
+// attempted again
+func (sm *StateManager) Quarantine(filename string, errMsg string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	prev, _ := sm.entryUnsafe(filename)
+	entry := FileStateEntry{
+		Filename:    filename,
+		Status:      FileStatusQuarantined,
+		Timestamp:   sm.now().UTC(),
+		Error:       errMsg,
+		Attempts:    prev.Attempts + 1,
+		Fingerprint: sm.fingerprintUnsafe(filename),
+	}
+	if err := sm.putUnsafe(entry); err != nil {
+		return err
 	}
 
-	if err := sm.saveStateUnsafe(); err != nil {
+	sm.logger.Error("Quarantined file: %s - %s", filename, errMsg)
+	return nil
+}
+
+// Forget removes the entry of filename, so that the file is processed again
+// if it reappears
+func (sm *StateManager) Forget(filename string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.state[filename]; !exists {
+		return nil
+	}
+	if _, err := sm.backend.DeleteFiles(filename); err != nil {
 		return err
 	}
 
-	sm.logger.Error("Marked file as failed: %s - %s", filename, errMsg)
+	delete(sm.state, filename)
 	return nil
 }
 
-func (sm *StateManager) saveStateUnsafe() error {
+// errLeaseLost is returned by writes to the entry of a file that another
+// replica holds the lease on, such as one that took over the lease after this
+// replica failed to renew it. The file must no longer be processed here.
+var errLeaseLost = errors.New("file is leased by another replica")
+
+// errStateLocked is returned when opening a state that a running ingester or
+// state command holds
+var errStateLocked = errors.New("state is in use by a running ingester or state command")
+
+// Claim takes the lease on a file for this replica when the state is shared
+// between replicas, and always succeeds otherwise. It fails when another
+// replica holds the lease, or has handled the file since the state was
+// loaded, in which case the shared entry replaces the local one.
+func (sm *StateManager) Claim(filename string) bool {
+	leaser, ok := sm.backend.(LeasingStateBackend)
+	if !ok {
+		return true
+	}
+
+	// The lease is taken without holding sm.mu, so that other files are not
+	// held up while the backend is reached
+	shared, claimed, err := leaser.Claim(filename)
+	if err != nil {
+		sm.logger.Error("Failed to claim %s: %v", filename, err)
+		return false
+	}
+
+	sm.mu.Lock()
+	if shared != nil {
+		sm.state[filename] = *shared
+	}
+	entry, _ := sm.entryUnsafe(filename)
+	sm.mu.Unlock()
+
+	if !claimed {
+		sm.logger.Debug("Skipping file leased by another replica: %s", filename)
+		return false
+	}
+	if entry.Status == FileStatusProcessed || entry.Status == FileStatusQuarantined || entry.Status == FileStatusChanged ||
+		(entry.Status == FileStatusFailed && sm.now().Before(entry.NextRetry)) {
+		sm.logger.Debug("Skipping file handled by another replica: %s", filename)
+		if err := leaser.Release(filename); err != nil {
+			sm.logger.Error("Failed to release %s: %v", filename, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// HoldsLease reports whether this replica still holds the lease on a file it
+// claimed. It is always true when the state is not shared between replicas.
+func (sm *StateManager) HoldsLease(filename string) bool {
+	leaser, ok := sm.backend.(LeasingStateBackend)
+	if !ok {
+		return true
+	}
+	return leaser.Holds(filename)
+}
+
+// Release gives up the lease on a file that is left for a later attempt
+func (sm *StateManager) Release(filename string) {
+	leaser, ok := sm.backend.(LeasingStateBackend)
+	if !ok {
+		return
+	}
+
+	if err := leaser.Release(filename); err != nil {
+		sm.logger.Error("Failed to release %s: %v", filename, err)
+	}
+}
+
+// Entry returns the entry of a file, if it has one
+func (sm *StateManager) Entry(filename string) (FileStateEntry, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.state[filename]
+	return entry, exists
+}
+
+// Entries returns every file entry, sorted by filename
+func (sm *StateManager) Entries() []FileStateEntry {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
 	entries := make([]FileStateEntry, 0, len(sm.state))
 	for _, entry := range sm.state {
 		entries = append(entries, entry)
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Filename < entries[j].Filename
+	})
+	return entries
+}
 
-	data, err := json.MarshalIndent(entries, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
+// Watermarks returns every stored listing watermark
+func (sm *StateManager) Watermarks() map[string]string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return maps.Clone(sm.watermarks)
+}
+
+// Retry makes a failed, quarantined or changed file due for another attempt
+// now, with its attempts reset. The checkpoint of a failed or quarantined
+// file is kept; a changed file starts over with its new content. An S3 key
+// the listing watermark has passed is listed again, see relistUnsafe.
+func (sm *StateManager) Retry(filename string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	entry, exists := sm.state[filename]
+	if !exists {
+		return fmt.Errorf("no state for %s", filename)
+	}
+	if entry.Status != FileStatusFailed && entry.Status != FileStatusQuarantined && entry.Status != FileStatusChanged {
+		return fmt.Errorf("%s is %s, only failed, quarantined and changed files can be retried", filename, entry.Status)
+	}
+
+	now := sm.now().UTC()
+	if entry.Status == FileStatusChanged {
+		entry.Fingerprint = ""
+		entry.Database, entry.LastRowid, entry.RowsAcked = 0, 0, 0
+	}
+	entry.Status = FileStatusFailed
+	entry.Timestamp = now
+	entry.Attempts = 0
+	entry.NextRetry = now
+	if err := sm.putUnsafe(entry); err != nil {
+		return err
+	}
+	if err := sm.relistUnsafe(filename); err != nil {
+		return err
+	}
+
+	sm.logger.Info("Scheduled file for retry: %s", filename)
+	return nil
+}
+
+// ForgetMatching removes the entries of every file whose name matches the
+// glob pattern, as in path.Match, and returns their names. S3 keys the
+// listing watermark has passed are listed again, see relistUnsafe.
+func (sm *StateManager) ForgetMatching(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var forgotten []string
+	for filename := range sm.state {
+		if matched, _ := path.Match(pattern, filename); matched {
+			forgotten = append(forgotten, filename)
+		}
+	}
+	sort.Strings(forgotten)
+	if len(forgotten) == 0 {
+		return nil, nil
 	}
 
-	if err := os.WriteFile(sm.stateFilePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write state file: %w", err)
+	if _, err := sm.backend.DeleteFiles(forgotten...); err != nil {
+		return nil, err
+	}
+	for _, filename := range forgotten {
+		delete(sm.state, filename)
 	}
 
+	// The lowest key lowers each watermark below all the others
+	for _, filename := range forgotten {
+		if err := sm.relistUnsafe(filename); err != nil {
+			return forgotten, err
+		}
+	}
+	return forgotten, nil
+}
+
+// relistUnsafe lowers the S3 listing watermarks that have passed key, so that
+// the next poll lists the key again. A watermark is lowered to the key
+// without its last byte, since StartAfter lists only keys after it; the keys
+// in between are listed again too, and are skipped if still in the state.
+func (sm *StateManager) relistUnsafe(key string) error {
+	for name, watermark := range sm.watermarks {
+		prefix, ok := s3WatermarkPrefix(name)
+		if !ok || !strings.HasPrefix(key, prefix) || key > watermark {
+			continue
+		}
+
+		lowered := key[:len(key)-1]
+		if err := sm.backend.PutWatermark(name, lowered); err != nil {
+			return fmt.Errorf("failed to lower watermark for %s: %w", name, err)
+		}
+		sm.watermarks[name] = lowered
+		sm.logger.Info("Lowered watermark for %s to %q to list %s again", name, lowered, key)
+	}
 	return nil
 }
+
+// Watermark returns the stored listing watermark for name, or empty if none
+func (sm *StateManager) Watermark(name string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.watermarks[name]
+}
+
+// SetWatermark stores the listing watermark for name, such as the last S3 key
+// below which every object of a prefix has been handled
+func (sm *StateManager) SetWatermark(name, watermark string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.watermarks[name] == watermark {
+		return nil
+	}
+	sm.watermarks[name] = watermark
+
+	return sm.backend.PutWatermark(name, watermark)
+}
+
+// putUnsafe stores entry in the backend and in memory. An entry refused
+// because another replica holds the lease is not kept, since that replica
+// owns the entry now.
+func (sm *StateManager) putUnsafe(entry FileStateEntry) error {
+	err := sm.backend.PutFile(entry)
+	if errors.Is(err, errLeaseLost) {
+		return err
+	}
+
+	sm.state[entry.Filename] = entry
+	if entry.Status != FileStatusFailed && entry.Status != FileStatusInProgress {
+		delete(sm.fingerprints, entry.Filename)
+	}
+	return err
+}
+
+// entryUnsafe returns the entry of key
+func (sm *StateManager) entryUnsafe(key string) (FileStateEntry, bool) {
+	entry, exists := sm.state[key]
+	return entry, exists
+}
+
+// AdoptLegacyEntry moves the entry an earlier version wrote under the base
+// name of an S3 key to the key, unless the key has an entry of its own. Since
+// the base name does not tell which prefix the entry was written for, it goes
+// to the first key found with that name, and no longer applies to the same
+// name under other prefixes.
+func (sm *StateManager) AdoptLegacyEntry(key string) error {
+	base := path.Base(key)
+	if base == key {
+		return nil
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.state[key]; exists {
+		return nil
+	}
+	entry, exists := sm.state[base]
+	if !exists {
+		return nil
+	}
+
+	entry.Filename = key
+	if err := sm.putUnsafe(entry); err != nil {
+		return fmt.Errorf("failed to adopt the entry of %s: %w", base, err)
+	}
+	if _, err := sm.backend.DeleteFiles(base); err != nil {
+		return fmt.Errorf("failed to adopt the entry of %s: %w", base, err)
+	}
+	delete(sm.state, base)
+
+	sm.logger.Info("Moved the entry of %s to %s", base, key)
+	return nil
+}
+
+// fingerprintUnsafe returns the fingerprint to write the entry of key with:
+// the observed one, or else the one of its current entry
+func (sm *StateManager) fingerprintUnsafe(key string) string {
+	if fingerprint, ok := sm.fingerprints[key]; ok {
+		return fingerprint
+	}
+	entry, _ := sm.entryUnsafe(key)
+	return entry.Fingerprint
+}
+
+// StateBackendOptions selects and configures the backend of a StateManager
+type StateBackendOptions struct {
+	// Kind is json, sqlite or elasticsearch
+	Kind string
+
+	// JSONPath is the JSON state file, which the SQLite backend imports on
+	// first use
+	JSONPath string
+
+	// DBPath is the SQLite state database
+	DBPath string
+
+	// Elasticsearch holds the state shared between replicas
+	Elasticsearch      *elasticsearch.Client
+	ElasticsearchState ElasticsearchStateConfig
+}
+
+// NewStateBackend returns the state backend selected by opts
+func NewStateBackend(opts StateBackendOptions, logger *IngestLogger) (StateBackend, error) {
+	switch opts.Kind {
+	case "", "json":
+		return newJSONStateBackend(opts.JSONPath, logger), nil
+	case "sqlite":
+		return newSQLiteStateBackend(opts.DBPath, opts.JSONPath, logger)
+	case "elasticsearch":
+		return NewElasticsearchStateBackend(opts.Elasticsearch, opts.ElasticsearchState, logger)
+	}
+	return nil, fmt.Errorf("unknown state backend %q (must be json, sqlite or elasticsearch)", opts.Kind)
+}
+
+// StateAccess is how OpenStateManager opens the state
+type StateAccess int
+
+const (
+	// StateShared opens the state for ingestion. The elasticsearch state is
+	// shared by every replica opening it so.
+	StateShared StateAccess = iota
+
+	// StateExclusive opens the state for the edits of the state command,
+	// excluding every replica
+	StateExclusive
+
+	// StateReadOnly loads a snapshot of the state without locking or holding
+	// it, so that it can be inspected while ingestion runs. Nothing may be
+	// written through a state opened so.
+	StateReadOnly
+)
+
+// OpenStateManager opens the state backend selected by the configuration and
+// loads its state. esClient is only used by the elasticsearch backend.
+//
+// Since the state is kept in memory, a process would overwrite the edits of
+// another one using the same state. The JSON and SQLite states are locked by
+// the process opening them, and fail to open with errStateLocked while
+// another process holds them. The elasticsearch state is shared by replicas,
+// unless opened with StateExclusive, as by the state command: it then fails
+// to open while a replica is running, and replicas fail to start until it is
+// closed. StateReadOnly takes no lock and never fails with errStateLocked.
+func OpenStateManager(config *Config, esClient *elasticsearch.Client, access StateAccess, logger *IngestLogger) (*StateManager, error) {
+	changed, err := parseChangedContentPolicy(config.ChangedFilePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CHANGED_FILE_POLICY: %w", err)
+	}
+
+	var lock *os.File
+	switch {
+	case access == StateReadOnly:
+	case config.SpoolStateBackend == "" || config.SpoolStateBackend == "json":
+		lock, err = lockStateFile(config.SpoolStateFile + ".lock")
+	case config.SpoolStateBackend == "sqlite":
+		lock, err = lockStateFile(config.SpoolStateDB + ".lock")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := NewStateBackend(StateBackendOptions{
+		Kind:          config.SpoolStateBackend,
+		JSONPath:      config.SpoolStateFile,
+		DBPath:        config.SpoolStateDB,
+		Elasticsearch: esClient,
+		ElasticsearchState: ElasticsearchStateConfig{
+			Index:     config.SpoolStateESIndex,
+			Owner:     config.SpoolReplicaID,
+			LeaseTTL:  config.SpoolLeaseTTL,
+			Exclusive: access == StateExclusive,
+			ReadOnly:  access == StateReadOnly,
+		},
+	}, logger)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, fmt.Errorf("failed to open state backend: %w", err)
+	}
+
+	sm, err := NewStateManagerWithBackend(backend, logger)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, fmt.Errorf("failed to initialize state manager: %w", err)
+	}
+	sm.lock = lock
+
+	sm.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: config.FileRetryMaxAttempts,
+		BaseDelay:   config.FileRetryBaseDelay,
+		MaxDelay:    config.FileRetryMaxDelay,
+	})
+	sm.SetRetentionPolicy(RetentionPolicy{
+		MaxAge: time.Duration(config.StateRetentionDays) * 24 * time.Hour,
+	})
+	sm.SetChangedContentPolicy(changed)
+	return sm, nil
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v9"
+	"github.com/elastic/go-elasticsearch/v9/esapi"
+)
+
+// esStateMapping maps the fields used to page through, filter and lease state
+// documents; the rest of each file entry is only stored
+const esStateMapping = `{
+	"mappings": {
+		"dynamic": false,
+		"properties": {
+			"key": {"type": "keyword"},
+			"owner": {"type": "keyword"},
+			"lease_expires": {"type": "date"},
+			"file": {
+				"properties": {
+					"status": {"type": "keyword"},
+					"timestamp": {"type": "date"}
+				}
+			}
+		}
+	}
+}`
+
+// esStatePageSize is the number of documents read per search when loading
+const esStatePageSize = 1000
+
+// esStateDoc is a document of the state index: the entry of a file, with the
+// lease of the replica processing it, a listing watermark, the summary of a
+// day's pruned entries, or a holder of the state
+type esStateDoc struct {
+	Key          string          `json:"key"`
+	File         *FileStateEntry `json:"file,omitempty"`
+	Owner        string          `json:"owner,omitempty"`
+	LeaseExpires time.Time       `json:"lease_expires,omitzero"`
+	Watermark    string          `json:"watermark,omitempty"`
+	Summary      *DaySummary     `json:"summary,omitempty"`
+	Exclusive    bool            `json:"exclusive,omitempty"`
+}
+
+// esLease is a file leased by this replica, with the entry last written for
+// it so that the lease can be renewed or released without losing it. Every
+// write is conditional on the version of the document this replica wrote
+// last, so that a lease taken over by another replica is never overwritten.
+type esLease struct {
+	// mu serializes the writes to the document of the file, since each
+	// is conditional on the version the one before it wrote
+	mu      sync.Mutex
+	entry   *FileStateEntry
+	expiry  time.Time
+	version esVersion
+
+	// ended is set once the lease is released or lost
+	ended bool
+}
+
+// ElasticsearchStateConfig configures the shared state backend
+type ElasticsearchStateConfig struct {
+	// Index holds one document per file, per watermark and per summarised day
+	Index string
+
+	// Owner identifies this replica in the leases it takes
+	Owner string
+
+	// LeaseTTL is how long a lease lasts without a heartbeat; leases are
+	// renewed every third of it, so a file whose owner died is picked up
+	// by another replica after at most LeaseTTL
+	LeaseTTL time.Duration
+
+	// Exclusive opens the state for the state command, which fails while
+	// a replica holds the state, and keeps replicas from opening it
+	Exclusive bool
+
+	// ReadOnly opens the state without holding it, for commands that only
+	// read it; no holder document is written and no lease is renewed
+	ReadOnly bool
+}
+
+// esStateBackend keeps the state in an Elasticsearch index shared by every
+// replica. A replica leases each file before processing it, so replicas split
+// the files between them, and a file whose owner died is picked up again once
+// its lease expires. Leases are taken with optimistic concurrency control on
+// the sequence number of the file's document.
+type esStateBackend struct {
+	client *elasticsearch.Client
+	config ElasticsearchStateConfig
+	logger *IngestLogger
+	now    func() time.Time
+
+	// mu guards the leases map only; it is never held across a request,
+	// so that writes of one file do not wait on those of another
+	mu     sync.Mutex
+	leases map[string]*esLease
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewElasticsearchStateBackend creates the state index if needed and starts
+// renewing the leases of this replica
+func NewElasticsearchStateBackend(client *elasticsearch.Client, config ElasticsearchStateConfig, logger *IngestLogger) (*esStateBackend, error) {
+	if config.Owner == "" {
+		return nil, fmt.Errorf("replica ID is required for the elasticsearch state backend")
+	}
+	if config.LeaseTTL <= 0 {
+		return nil, fmt.Errorf("lease TTL must be positive, got %v", config.LeaseTTL)
+	}
+
+	b := &esStateBackend{
+		client: client,
+		config: config,
+		logger: logger,
+		now:    time.Now,
+		leases: make(map[string]*esLease),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := b.createIndex(); err != nil {
+		return nil, err
+	}
+	if config.ReadOnly {
+		close(b.done)
+		return b, nil
+	}
+	if err := b.hold(); err != nil {
+		return nil, err
+	}
+
+	go b.heartbeat()
+
+	return b, nil
+}
+
+func (b *esStateBackend) createIndex() error {
+	res, err := b.client.Indices.Create(
+		b.config.Index,
+		b.client.Indices.Create.WithBody(bytes.NewReader([]byte(esStateMapping))),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create state index: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode == http.StatusBadRequest && bytes.Contains(body, []byte("resource_already_exists_exception")) {
+			return nil
+		}
+		return fmt.Errorf("failed to create state index: [%d] %s", res.StatusCode, body)
+	}
+
+	b.logger.Info("Created state index %s", b.config.Index)
+	return nil
+}
+
+// docID is the ID of the document for key, encoded so that keys holding
+// slashes, such as watermarks of S3 prefixes, are safe in URLs
+func docID(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func fileKey(filename string) string {
+	return "file:" + filename
+}
+
+func watermarkKey(name string) string {
+	return "watermark:" + name
+}
+
+func summaryKey(day string) string {
+	return "summary:" + day
+}
+
+func holderKey(owner string) string {
+	return "holder:" + owner
+}
+
+// hold records this replica as a holder of the state, then fails with
+// errStateLocked if another holder excludes it: an exclusive holder excludes
+// every other one, and is excluded by any. Every holder waits for its document
+// to become visible to searches before it looks, so of two holders opening at
+// once, at least the later one to look finds the other.
+func (b *esStateBackend) hold() error {
+	if err := b.putHolder(b.client.Index.WithRefresh("wait_for")); err != nil {
+		return err
+	}
+
+	holders, err := b.holders()
+	if err != nil {
+		b.deleteHolder()
+		return err
+	}
+	for _, holder := range holders {
+		if holder.Owner != b.config.Owner && (holder.Exclusive || b.config.Exclusive) {
+			b.deleteHolder()
+			return fmt.Errorf("%w: %s holds %s until %s", errStateLocked, holder.Owner, b.config.Index, holder.LeaseExpires.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// putHolder writes or renews the holder document of this replica, which
+// expires like a lease if the replica dies
+func (b *esStateBackend) putHolder(opts ...func(*esapi.IndexRequest)) error {
+	_, _, err := b.index(esStateDoc{
+		Key:          holderKey(b.config.Owner),
+		Owner:        b.config.Owner,
+		LeaseExpires: b.now().Add(b.config.LeaseTTL).UTC(),
+		Exclusive:    b.config.Exclusive,
+	}, nil, opts...)
+	return err
+}
+
+func (b *esStateBackend) deleteHolder() {
+	res, err := b.client.Delete(b.config.Index, docID(holderKey(b.config.Owner)))
+	if err != nil {
+		b.logger.Error("Failed to remove state holder %s: %v", b.config.Owner, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// holders returns the unexpired holders of the state
+func (b *esStateBackend) holders() ([]esStateDoc, error) {
+	now := b.now()
+	body, err := json.Marshal(map[string]any{
+		"query": map[string]any{"bool": map[string]any{"filter": []any{
+			map[string]any{"prefix": map[string]any{"key": holderKey("")}},
+			map[string]any{"range": map[string]any{"lease_expires": map[string]any{"gt": now.UTC().Format(time.RFC3339Nano)}}},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal holder query: %w", err)
+	}
+
+	res, err := b.client.Search(
+		b.client.Search.WithIndex(b.config.Index),
+		b.client.Search.WithBody(bytes.NewReader(body)),
+		b.client.Search.WithSize(esStatePageSize),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search state holders: %w", err)
+	}
+
+	var page struct {
+		Hits struct {
+			Hits []struct {
+				Source esStateDoc `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := decodeResponse(res, &page); err != nil {
+		return nil, fmt.Errorf("failed to search state holders: %w", err)
+	}
+
+	var holders []esStateDoc
+	for _, hit := range page.Hits.Hits {
+		if strings.HasPrefix(hit.Source.Key, holderKey("")) && now.Before(hit.Source.LeaseExpires) {
+			holders = append(holders, hit.Source)
+		}
+	}
+	return holders, nil
+}
+
+func (b *esStateBackend) Load() (stateFile, error) {
+	file := stateFile{
+		Watermarks: make(map[string]string),
+		Summaries:  make(map[string]DaySummary),
+	}
+
+	var searchAfter []any
+	for {
+		query := map[string]any{
+			"query": map[string]any{"match_all": map[string]any{}},
+			"sort":  []any{map[string]any{"key": "asc"}},
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+		body, err := json.Marshal(query)
+		if err != nil {
+			return file, fmt.Errorf("failed to marshal state query: %w", err)
+		}
+
+		res, err := b.client.Search(
+			b.client.Search.WithIndex(b.config.Index),
+			b.client.Search.WithBody(bytes.NewReader(body)),
+			b.client.Search.WithSize(esStatePageSize),
+		)
+		if err != nil {
+			return file, fmt.Errorf("failed to search state index: %w", err)
+		}
+
+		var page struct {
+			Hits struct {
+				Hits []struct {
+					Source esStateDoc `json:"_source"`
+					Sort   []any      `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err := decodeResponse(res, &page); err != nil {
+			return file, fmt.Errorf("failed to search state index: %w", err)
+		}
+
+		for _, hit := range page.Hits.Hits {
+			doc := hit.Source
+			if doc.File != nil {
+				file.Files = append(file.Files, *doc.File)
+			} else if name, ok := strings.CutPrefix(doc.Key, watermarkKey("")); ok {
+				file.Watermarks[name] = doc.Watermark
+			} else if day, ok := strings.CutPrefix(doc.Key, summaryKey("")); ok && doc.Summary != nil {
+				file.Summaries[day] = *doc.Summary
+			}
+		}
+
+		if len(page.Hits.Hits) < esStatePageSize {
+			return file, nil
+		}
+		searchAfter = page.Hits.Hits[len(page.Hits.Hits)-1].Sort
+	}
+}
+
+// PutFile writes the entry of a file. A file that is still in progress keeps
+// the lease of this replica; any other status ends it. It fails with
+// errLeaseLost if another replica holds the lease, or took it over since this
+// replica last wrote the entry.
+func (b *esStateBackend) PutFile(entry FileStateEntry) error {
+	doc := esStateDoc{Key: fileKey(entry.Filename), File: &entry}
+	lease := b.lease(entry.Filename)
+	if lease == nil {
+		return b.putUnleased(doc)
+	}
+
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	if lease.ended {
+		return b.putUnleased(doc)
+	}
+
+	if entry.Status == FileStatusInProgress {
+		doc.Owner = b.config.Owner
+		doc.LeaseExpires = lease.expiry
+	}
+	version, written, err := b.index(doc, &lease.version)
+	if err != nil {
+		return err
+	}
+	if !written {
+		b.endLeaseUnsafe(entry.Filename, lease)
+		return fmt.Errorf("failed to write state entry of %s: %w", entry.Filename, errLeaseLost)
+	}
+
+	if entry.Status == FileStatusInProgress {
+		lease.entry = &entry
+		lease.version = version
+	} else {
+		b.endLeaseUnsafe(entry.Filename, lease)
+	}
+	return nil
+}
+
+// lease returns the lease this replica holds on a file, or nil
+func (b *esStateBackend) lease(filename string) *esLease {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.leases[filename]
+}
+
+// endLeaseUnsafe marks a lease released or lost and forgets it, unless it has
+// been replaced in the meantime. The caller holds lease.mu.
+func (b *esStateBackend) endLeaseUnsafe(filename string, lease *esLease) {
+	lease.ended = true
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.leases[filename] == lease {
+		delete(b.leases, filename)
+	}
+}
+
+// putUnleased writes the entry of a file this replica holds no lease
+// on, such as one edited with the state command, unless another replica holds
+// an unexpired lease on it
+func (b *esStateBackend) putUnleased(doc esStateDoc) error {
+	current, version, err := b.get(doc.Key)
+	if err != nil {
+		return err
+	}
+	if current.leasedByOther(b.config.Owner, b.now()) {
+		return fmt.Errorf("failed to write state entry of %s: %w", doc.File.Filename, errLeaseLost)
+	}
+
+	_, written, err := b.index(doc, &version)
+	if err != nil {
+		return err
+	}
+	if !written {
+		return fmt.Errorf("failed to write state entry of %s: %w", doc.File.Filename, errLeaseLost)
+	}
+	return nil
+}
+
+// leasedByOther reports whether a replica other than owner holds an
+// unexpired lease on the file of the document
+func (d esStateDoc) leasedByOther(owner string, now time.Time) bool {
+	return d.Owner != "" && d.Owner != owner && now.Before(d.LeaseExpires)
+}
+
+// DeleteFiles removes the entries of files, returning those it found. When
+// replicas prune the same entries at the same time, each entry is only
+// returned to the replica that removed it.
+func (b *esStateBackend) DeleteFiles(filenames ...string) ([]string, error) {
+	var deleted []string
+	for _, filename := range filenames {
+		found, err := b.deleteFile(filename)
+		if err != nil {
+			return deleted, err
+		}
+		if found {
+			deleted = append(deleted, filename)
+		}
+	}
+	return deleted, nil
+}
+
+func (b *esStateBackend) deleteFile(filename string) (bool, error) {
+	if lease := b.lease(filename); lease != nil {
+		lease.mu.Lock()
+		b.endLeaseUnsafe(filename, lease)
+		lease.mu.Unlock()
+	}
+
+	res, err := b.client.Delete(b.config.Index, docID(fileKey(filename)))
+	if err != nil {
+		return false, fmt.Errorf("failed to delete state entry: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, fmt.Errorf("failed to delete state entry: %s", res.String())
+	}
+	return true, nil
+}
+
+func (b *esStateBackend) PutWatermark(name, watermark string) error {
+	_, _, err := b.index(esStateDoc{Key: watermarkKey(name), Watermark: watermark}, nil)
+	return err
+}
+
+// AddSummary adds to the summary of a day. The summary is rewritten on the
+// version it was read at, and read again if another replica compacting at the
+// same time wrote it in between, so that no replica's count is lost.
+func (b *esStateBackend) AddSummary(day string, delta DaySummary) (DaySummary, error) {
+	for {
+		current, version, err := b.get(summaryKey(day))
+		if err != nil {
+			return DaySummary{}, err
+		}
+		var summary DaySummary
+		if current.Summary != nil {
+			summary = *current.Summary
+		}
+		summary = summary.add(delta)
+
+		_, written, err := b.index(esStateDoc{Key: summaryKey(day), Summary: &summary}, &version)
+		if err != nil {
+			return DaySummary{}, err
+		}
+		if written {
+			return summary, nil
+		}
+	}
+}
+
+// Replace writes the given entries, watermarks and summaries. Documents of
+// files that are not given are left alone, since other replicas may be
+// writing them.
+func (b *esStateBackend) Replace(state stateFile) error {
+	for _, entry := range state.Files {
+		if err := b.PutFile(entry); err != nil {
+			return err
+		}
+	}
+	for name, watermark := range state.Watermarks {
+		if err := b.PutWatermark(name, watermark); err != nil {
+			return err
+		}
+	}
+	for day, summary := range state.Summaries {
+		if _, _, err := b.index(esStateDoc{Key: summaryKey(day), Summary: &summary}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim takes the lease on a file for this replica, or renews it, unless
+// another replica holds an unexpired lease. It returns the shared entry of
+// the file, if there is one, whether or not the lease was taken.
+func (b *esStateBackend) Claim(filename string) (*FileStateEntry, bool, error) {
+	// A lease already held is replaced by the new one, once no write to
+	// the file is in flight
+	held := b.lease(filename)
+	if held != nil {
+		held.mu.Lock()
+		defer held.mu.Unlock()
+	}
+
+	current, version, err := b.get(fileKey(filename))
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := b.now()
+	if current.leasedByOther(b.config.Owner, now) {
+		if held != nil {
+			b.endLeaseUnsafe(filename, held)
+		}
+		return current.File, false, nil
+	}
+
+	doc := esStateDoc{
+		Key:          fileKey(filename),
+		File:         current.File,
+		Owner:        b.config.Owner,
+		LeaseExpires: now.Add(b.config.LeaseTTL).UTC(),
+	}
+	version, claimed, err := b.index(doc, &version)
+	if held != nil {
+		b.endLeaseUnsafe(filename, held)
+	}
+	if err != nil || !claimed {
+		return current.File, false, err
+	}
+
+	b.mu.Lock()
+	b.leases[filename] = &esLease{entry: current.File, expiry: doc.LeaseExpires, version: version}
+	b.mu.Unlock()
+	return current.File, true, nil
+}
+
+// Release gives up the lease on a file, keeping its entry. A lease another
+// replica has taken over in the meantime is left to it.
+func (b *esStateBackend) Release(filename string) error {
+	lease := b.lease(filename)
+	if lease == nil {
+		return nil
+	}
+
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	if lease.ended {
+		return nil
+	}
+	b.endLeaseUnsafe(filename, lease)
+
+	_, released, err := b.index(esStateDoc{Key: fileKey(filename), File: lease.entry}, &lease.version)
+	if err != nil {
+		return err
+	}
+	if !released {
+		b.logger.Debug("Lease on %s was already taken over by another replica", filename)
+	}
+	return nil
+}
+
+// Holds reports whether this replica holds an unexpired lease on a file
+func (b *esStateBackend) Holds(filename string) bool {
+	lease := b.lease(filename)
+	if lease == nil {
+		return false
+	}
+
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	return !lease.ended && b.now().Before(lease.expiry)
+}
+
+// Close stops renewing leases and gives up holding the state. Leases still
+// held expire on their own.
+func (b *esStateBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		<-b.done
+		if !b.config.ReadOnly {
+			b.deleteHolder()
+		}
+	})
+	<-b.done
+	return nil
+}
+
+// heartbeat renews the leases of this replica every third of the lease TTL
+func (b *esStateBackend) heartbeat() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.config.LeaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.putHolder(); err != nil {
+				b.logger.Error("Failed to renew state holder %s: %v", b.config.Owner, err)
+			}
+			b.renewLeases()
+		}
+	}
+}
+
+// renewLeases renews each lease of this replica in turn, holding only the
+// lease being renewed while its request is in flight
+func (b *esStateBackend) renewLeases() {
+	b.mu.Lock()
+	leases := maps.Clone(b.leases)
+	b.mu.Unlock()
+
+	for filename, lease := range leases {
+		b.renewLease(filename, lease)
+	}
+}
+
+func (b *esStateBackend) renewLease(filename string, lease *esLease) {
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	if lease.ended {
+		return
+	}
+
+	doc := esStateDoc{
+		Key:          fileKey(filename),
+		File:         lease.entry,
+		Owner:        b.config.Owner,
+		LeaseExpires: b.now().Add(b.config.LeaseTTL).UTC(),
+	}
+	version, renewed, err := b.index(doc, &lease.version)
+	if err != nil {
+		b.logger.Error("Failed to renew lease on %s: %v", filename, err)
+		return
+	}
+	if !renewed {
+		b.endLeaseUnsafe(filename, lease)
+		b.logger.Error("Lost lease on %s to another replica", filename)
+		return
+	}
+	lease.expiry = doc.LeaseExpires
+	lease.version = version
+}
+
+// esVersion is the sequence number and primary term a document was read at
+type esVersion struct {
+	seqNo       int
+	primaryTerm int
+	found       bool
+}
+
+// get reads a state document, returning a zero document if there is none
+func (b *esStateBackend) get(key string) (esStateDoc, esVersion, error) {
+	res, err := b.client.Get(b.config.Index, docID(key))
+	if err != nil {
+		return esStateDoc{}, esVersion{}, fmt.Errorf("failed to read state entry: %w", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return esStateDoc{}, esVersion{}, nil
+	}
+
+	var got struct {
+		SeqNo       int        `json:"_seq_no"`
+		PrimaryTerm int        `json:"_primary_term"`
+		Found       bool       `json:"found"`
+		Source      esStateDoc `json:"_source"`
+	}
+	if err := decodeResponse(res, &got); err != nil {
+		return esStateDoc{}, esVersion{}, fmt.Errorf("failed to read state entry: %w", err)
+	}
+	if !got.Found {
+		return esStateDoc{}, esVersion{}, nil
+	}
+
+	return got.Source, esVersion{seqNo: got.SeqNo, primaryTerm: got.PrimaryTerm, found: true}, nil
+}
+
+// index writes a state document and returns the version it was written at.
+// With a version, the write only succeeds if the document has not changed
+// since it was read or written at that version, or still does not exist;
+// false is returned if it has. Extra options are added to the request.
+func (b *esStateBackend) index(doc esStateDoc, version *esVersion, extra ...func(*esapi.IndexRequest)) (esVersion, bool, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return esVersion{}, false, fmt.Errorf("failed to marshal state entry: %w", err)
+	}
+
+	opts := append([]func(*esapi.IndexRequest){b.client.Index.WithDocumentID(docID(doc.Key))}, extra...)
+	if version != nil {
+		if version.found {
+			opts = append(opts,
+				b.client.Index.WithIfSeqNo(version.seqNo),
+				b.client.Index.WithIfPrimaryTerm(version.primaryTerm),
+			)
+		} else {
+			opts = append(opts, b.client.Index.WithOpType("create"))
+		}
+	}
+
+	res, err := b.client.Index(b.config.Index, bytes.NewReader(body), opts...)
+	if err != nil {
+		return esVersion{}, false, fmt.Errorf("failed to write state entry: %w", err)
+	}
+
+	if version != nil && res.StatusCode == http.StatusConflict {
+		res.Body.Close()
+		return esVersion{}, false, nil
+	}
+	var written struct {
+		SeqNo       int `json:"_seq_no"`
+		PrimaryTerm int `json:"_primary_term"`
+	}
+	if err := decodeResponse(res, &written); err != nil {
+		return esVersion{}, false, fmt.Errorf("failed to write state entry: %w", err)
+	}
+	return esVersion{seqNo: written.SeqNo, primaryTerm: written.PrimaryTerm, found: true}, true, nil
+}
+
+// decodeResponse decodes a successful JSON response and closes its body
+func decodeResponse(res *esapi.Response, v any) error {
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("request returned error: %s", res.String())
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v9"
+)
+
+// stateTestServer is a fake Elasticsearch holding a single state index, with
+// the optimistic concurrency control that leases rely on
+type stateTestServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	seq  int
+	docs map[string]stateTestDoc
+
+	// stalled holds writes of the document with ID stalledID until it is
+	// closed, signalling each one on arrived
+	stalledID string
+	stalled   chan struct{}
+	arrived   chan struct{}
+
+	// searchable, if not nil, holds the documents as of the last refresh,
+	// which is all that searches see, as in Elasticsearch. Writes with a
+	// refresh parameter refresh the index.
+	searchable map[string]stateTestDoc
+}
+
+type stateTestDoc struct {
+	seqNo  int
+	source json.RawMessage
+}
+
+func newStateTestServer(t *testing.T) (*stateTestServer, *elasticsearch.Client) {
+	t.Helper()
+
+	s := &stateTestServer{docs: make(map[string]stateTestDoc)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{s.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create Elasticsearch client: %v", err)
+	}
+	return s, client
+}
+
+// stallWrites holds writes of the document with the given ID until the
+// returned function is called, and returns a channel signalled as each arrives
+func (s *stateTestServer) stallWrites(id string) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stalledID = id
+	s.stalled = make(chan struct{})
+	s.arrived = make(chan struct{}, 10)
+	return s.arrived, func() { close(s.stalled) }
+}
+
+func (s *stateTestServer) stall(r *http.Request) {
+	s.mu.Lock()
+	stalled, arrived := s.stalled, s.arrived
+	match := r.Method == http.MethodPut && s.stalledID != "" && strings.HasSuffix(r.URL.Path, "/_doc/"+s.stalledID)
+	s.mu.Unlock()
+
+	if match {
+		arrived <- struct{}{}
+		<-stalled
+	}
+}
+
+func (s *stateTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.stall(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		w.Write([]byte(`{"acknowledged":true}`))
+
+	case len(parts) == 2 && parts[1] == "_search":
+		s.search(w, r)
+
+	case len(parts) == 3 && parts[1] == "_doc":
+		id := parts[2]
+		doc, exists := s.docs[id]
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"found":false}`))
+				return
+			}
+			fmt.Fprintf(w, `{"found":true,"_seq_no":%d,"_primary_term":1,"_source":%s}`, doc.seqNo, doc.source)
+
+		case http.MethodPut:
+			query := r.URL.Query()
+			conflict := (query.Get("op_type") == "create" && exists) ||
+				(query.Has("if_seq_no") && (!exists || query.Get("if_seq_no") != fmt.Sprint(doc.seqNo)))
+			if conflict {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":{"type":"version_conflict_engine_exception"}}`))
+				return
+			}
+			var source json.RawMessage
+			json.NewDecoder(r.Body).Decode(&source)
+			s.seq++
+			s.docs[id] = stateTestDoc{seqNo: s.seq, source: source}
+			if s.searchable != nil && query.Has("refresh") {
+				s.searchable = maps.Clone(s.docs)
+			}
+			fmt.Fprintf(w, `{"result":"updated","_seq_no":%d,"_primary_term":1}`, s.seq)
+
+		case http.MethodDelete:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			delete(s.docs, id)
+			w.Write([]byte(`{}`))
+		}
+
+	default:
+		w.Write([]byte(`{"version":{"number":"9.0.0"}}`))
+	}
+}
+
+func (s *stateTestServer) search(w http.ResponseWriter, r *http.Request) {
+	var query struct {
+		SearchAfter []string `json:"search_after"`
+	}
+	json.NewDecoder(r.Body).Decode(&query)
+	size := 10
+	fmt.Sscan(r.URL.Query().Get("size"), &size)
+
+	type hit struct {
+		Source json.RawMessage `json:"_source"`
+		Sort   []string        `json:"sort"`
+	}
+	docs := s.docs
+	if s.searchable != nil {
+		docs = s.searchable
+	}
+
+	var hits []hit
+	for _, doc := range docs {
+		var keyed struct {
+			Key string `json:"key"`
+		}
+		json.Unmarshal(doc.source, &keyed)
+		if len(query.SearchAfter) > 0 && keyed.Key <= query.SearchAfter[0] {
+			continue
+		}
+		hits = append(hits, hit{Source: doc.source, Sort: []string{keyed.Key}})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Sort[0] < hits[j].Sort[0] })
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"hits": map[string]any{"hits": hits}})
+}
+
+func newReplicaStateManager(t *testing.T, client *elasticsearch.Client, owner string, now func() time.Time) *StateManager {
+	t.Helper()
+
+	backend, err := NewElasticsearchStateBackend(client, ElasticsearchStateConfig{
+		Index:    "ingest-state",
+		Owner:    owner,
+		LeaseTTL: time.Minute,
+	}, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state backend: %v", err)
+	}
+	if now != nil {
+		backend.now = now
+	}
+
+	sm, err := NewStateManagerWithBackend(backend, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	t.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func TestElasticsearchState_LeasesFilesToOneReplica(t *testing.T) {
+	_, client := newStateTestServer(t)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := newReplicaStateManager(t, client, "replica-a", clock)
+	b := newReplicaStateManager(t, client, "replica-b", clock)
+
+	filename := "mega_1.db.zip"
+	if !a.Claim(filename) {
+		t.Fatal("Expected replica a to claim the file")
+	}
+	if b.Claim(filename) {
+		t.Fatal("Expected replica b not to claim a leased file")
+	}
+
+	// A checkpoint keeps the lease, marking the file processed ends it
+	if err := a.SetProgress(filename, FileProgress{LastRowid: 1000, RowsAcked: 1000}); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+	if b.Claim(filename) {
+		t.Fatal("Expected the lease to survive a checkpoint")
+	}
+	if err := a.MarkProcessed(filename); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if b.Claim(filename) {
+		t.Error("Expected replica b not to claim a processed file")
+	}
+	if !b.IsProcessed(filename) {
+		t.Error("Expected replica b to learn that the file was processed")
+	}
+
+	// A released file can be claimed at once
+	if !a.Claim("mega_2.db.zip") {
+		t.Fatal("Expected replica a to claim the second file")
+	}
+	a.Release("mega_2.db.zip")
+	if !b.Claim("mega_2.db.zip") {
+		t.Error("Expected replica b to claim a released file")
+	}
+}
+
+func TestElasticsearchState_ExpiredLeaseIsTakenOver(t *testing.T) {
+	_, client := newStateTestServer(t)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := newReplicaStateManager(t, client, "replica-a", clock)
+	b := newReplicaStateManager(t, client, "replica-b", clock)
+
+	filename := "mega_1.db.zip"
+	progress := FileProgress{LastRowid: 1000, RowsAcked: 1000}
+	if !a.Claim(filename) {
+		t.Fatal("Expected replica a to claim the file")
+	}
+	if err := a.SetProgress(filename, progress); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+
+	// Replica a dies without releasing its lease
+	now = now.Add(59 * time.Second)
+	if b.Claim(filename) {
+		t.Fatal("Expected the lease to hold until it expires")
+	}
+	now = now.Add(2 * time.Second)
+	if !b.Claim(filename) {
+		t.Fatal("Expected replica b to take over the expired lease")
+	}
+	if got, ok := b.Progress(filename); !ok || got != progress {
+		t.Errorf("Expected replica b to resume at %+v, got %+v (%v)", progress, got, ok)
+	}
+}
+
+func TestElasticsearchState_LostLeaseIsNotOverwritten(t *testing.T) {
+	_, client := newStateTestServer(t)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := newReplicaStateManager(t, client, "replica-a", clock)
+	b := newReplicaStateManager(t, client, "replica-b", clock)
+
+	filename := "mega_1.db.zip"
+	if !a.Claim(filename) {
+		t.Fatal("Expected replica a to claim the file")
+	}
+
+	// Replica a stalls past its lease, which replica b takes over
+	now = now.Add(2 * time.Minute)
+	if a.HoldsLease(filename) {
+		t.Error("Expected an expired lease not to be held")
+	}
+	if !b.Claim(filename) {
+		t.Fatal("Expected replica b to take over the expired lease")
+	}
+	progress := FileProgress{LastRowid: 500, RowsAcked: 500}
+	if err := b.SetProgress(filename, progress); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+
+	if err := a.SetProgress(filename, FileProgress{LastRowid: 1000, RowsAcked: 1000}); !errors.Is(err, errLeaseLost) {
+		t.Errorf("Expected the checkpoint of replica a to be refused, got %v", err)
+	}
+	if err := a.MarkProcessed(filename); !errors.Is(err, errLeaseLost) {
+		t.Errorf("Expected replica a not to mark a file it lost as processed, got %v", err)
+	}
+	if a.IsProcessed(filename) {
+		t.Error("Expected a refused entry not to be kept")
+	}
+	a.Release(filename)
+
+	c := newReplicaStateManager(t, client, "replica-c", clock)
+	if c.Claim(filename) {
+		t.Error("Expected replica b to keep its lease")
+	}
+	if got, ok := c.Progress(filename); !ok || got != progress {
+		t.Errorf("Expected the checkpoint of replica b to survive, got %+v (%v)", got, ok)
+	}
+}
+
+func TestElasticsearchState_SlowRenewalDoesNotHoldUpOtherFiles(t *testing.T) {
+	server, client := newStateTestServer(t)
+	sm := newReplicaStateManager(t, client, "replica-a", nil)
+	backend := sm.backend.(*esStateBackend)
+
+	for _, filename := range []string{"slow.db.zip", "fast.db.zip"} {
+		if !sm.Claim(filename) {
+			t.Fatalf("Expected to claim %s", filename)
+		}
+	}
+
+	arrived, release := server.stallWrites(docID(fileKey("slow.db.zip")))
+	renewed := make(chan struct{})
+	go func() {
+		backend.renewLeases()
+		close(renewed)
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the renewal of slow.db.zip")
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		if err := sm.SetProgress("fast.db.zip", FileProgress{LastRowid: 10, RowsAcked: 10}); err != nil {
+			written <- err
+			return
+		}
+		if !sm.Claim("other.db.zip") {
+			written <- fmt.Errorf("failed to claim other.db.zip")
+			return
+		}
+		written <- nil
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Errorf("Expected other files to be written while a renewal is stalled: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected other files not to wait on a stalled renewal")
+	}
+
+	release()
+	<-renewed
+	if !sm.HoldsLease("slow.db.zip") || !sm.HoldsLease("fast.db.zip") {
+		t.Error("Expected both leases to be kept")
+	}
+}
+
+func TestElasticsearchState_ReplicasCompactingTogetherKeepEveryCount(t *testing.T) {
+	_, client := newStateTestServer(t)
+	a := newReplicaStateManager(t, client, "replica-a", nil)
+	agedStateManager(t, a, "mega_1.db.zip", "mega_2.db.zip")
+	day := time.Now().UTC().Format(time.DateOnly)
+
+	// Replicas that loaded the same entries prune them once between them
+	b := newReplicaStateManager(t, client, "replica-b", nil)
+	agedStateManager(t, b)
+	for _, sm := range []*StateManager{a, b} {
+		if _, err := sm.Compact(func(string) bool { return true }); err != nil {
+			t.Fatalf("Failed to compact state: %v", err)
+		}
+	}
+	if got := a.Summaries()[day].Processed; got != 2 {
+		t.Errorf("Expected entries pruned by both replicas to be counted once, got %d", got)
+	}
+
+	// Counts added at the same time are all kept
+	backend := a.backend.(*esStateBackend)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := backend.AddSummary(day, DaySummary{Processed: 1}); err != nil {
+					t.Errorf("Failed to add to summary: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := newReplicaStateManager(t, client, "replica-c", nil)
+	if got := c.Summaries()[day].Processed; got != 22 {
+		t.Errorf("Expected every added count to be kept, got %d", got)
+	}
+}
+
+func TestElasticsearchState_StateCommandExcludesReplicas(t *testing.T) {
+	_, client := newStateTestServer(t)
+	open := func(owner string, exclusive bool) (*esStateBackend, error) {
+		return NewElasticsearchStateBackend(client, ElasticsearchStateConfig{
+			Index:     "ingest-state",
+			Owner:     owner,
+			LeaseTTL:  time.Minute,
+			Exclusive: exclusive,
+		}, NewLogger(false))
+	}
+
+	a, err := open("replica-a", false)
+	if err != nil {
+		t.Fatalf("Failed to open state: %v", err)
+	}
+	b, err := open("replica-b", false)
+	if err != nil {
+		t.Fatalf("Expected replicas to share the state: %v", err)
+	}
+	if _, err := open("replica-a-state-command", true); !errors.Is(err, errStateLocked) {
+		t.Fatalf("Expected the state command to be refused while replicas run, got %v", err)
+	}
+
+	// A replica that died stops holding the state once its holder expires
+	dead := esStateDoc{Key: holderKey("replica-dead"), Owner: "replica-dead", LeaseExpires: time.Now().Add(-time.Second)}
+	if _, _, err := a.index(dead, nil); err != nil {
+		t.Fatalf("Failed to write holder: %v", err)
+	}
+	a.Close()
+	b.Close()
+
+	command, err := open("replica-a-state-command", true)
+	if err != nil {
+		t.Fatalf("Expected the state command to open the state once replicas stopped: %v", err)
+	}
+	if _, err := open("replica-c", false); !errors.Is(err, errStateLocked) {
+		t.Errorf("Expected replicas to be refused while the state command runs, got %v", err)
+	}
+
+	command.Close()
+	c, err := open("replica-c", false)
+	if err != nil {
+		t.Fatalf("Expected replicas to start once the state command is done: %v", err)
+	}
+	c.Close()
+}
+
+func TestElasticsearchState_ReadOnlyDoesNotHoldState(t *testing.T) {
+	_, client := newStateTestServer(t)
+	open := func(owner string, exclusive, readOnly bool) (*esStateBackend, error) {
+		return NewElasticsearchStateBackend(client, ElasticsearchStateConfig{
+			Index:     "ingest-state",
+			Owner:     owner,
+			LeaseTTL:  time.Minute,
+			Exclusive: exclusive,
+			ReadOnly:  readOnly,
+		}, NewLogger(false))
+	}
+
+	replica, err := open("replica-a", false, false)
+	if err != nil {
+		t.Fatalf("Failed to open state: %v", err)
+	}
+	snapshot, err := open("replica-a-state-command", false, true)
+	if err != nil {
+		t.Fatalf("Expected the state to be readable while a replica runs: %v", err)
+	}
+	replica.Close()
+
+	command, err := open("replica-b-state-command", true, false)
+	if err != nil {
+		t.Fatalf("Expected a read-only snapshot not to exclude the state command: %v", err)
+	}
+	command.Close()
+	snapshot.Close()
+}
+
+func TestElasticsearchState_OverlappingHoldersFindEachOther(t *testing.T) {
+	server, client := newStateTestServer(t)
+	server.searchable = make(map[string]stateTestDoc)
+	open := func(owner string, exclusive bool) (*esStateBackend, error) {
+		return NewElasticsearchStateBackend(client, ElasticsearchStateConfig{
+			Index:     "ingest-state",
+			Owner:     owner,
+			LeaseTTL:  time.Minute,
+			Exclusive: exclusive,
+		}, NewLogger(false))
+	}
+
+	// The state command starts first, but writes its holder only after a
+	// replica has opened the state, which it has not been refreshed into yet
+	arrived, release := server.stallWrites(docID(holderKey("state-command")))
+	commandErr := make(chan error, 1)
+	go func() {
+		command, err := open("state-command", true)
+		if err == nil {
+			command.Close()
+		}
+		commandErr <- err
+	}()
+	<-arrived
+
+	replica, err := open("replica-a", false)
+	if err != nil {
+		t.Fatalf("Expected the replica to open the state before the state command holds it: %v", err)
+	}
+	defer replica.Close()
+
+	release()
+	if err := <-commandErr; !errors.Is(err, errStateLocked) {
+		t.Errorf("Expected the state command to find the replica, got %v", err)
+	}
+}
+
+func TestElasticsearchState_LoadsSharedState(t *testing.T) {
+	_, client := newStateTestServer(t)
+	a := newReplicaStateManager(t, client, "replica-a", nil)
+
+	for i := range 25 {
+		if err := a.MarkProcessed(fmt.Sprintf("mega_%02d.db.zip", i)); err != nil {
+			t.Fatalf("Failed to mark file as processed: %v", err)
+		}
+	}
+	if err := a.SetWatermark("s3://bucket/a/", "a/mega_24.db.zip"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+	if err := a.Forget("mega_00.db.zip"); err != nil {
+		t.Fatalf("Failed to forget file: %v", err)
+	}
+
+	b := newReplicaStateManager(t, client, "replica-b", nil)
+	if len(b.state) != 24 || !b.IsProcessed("mega_24.db.zip") {
+		t.Errorf("Expected 24 processed files, got %d", len(b.state))
+	}
+	if got := b.Watermark("s3://bucket/a/"); got != "a/mega_24.db.zip" {
+		t.Errorf("Expected the shared watermark, got %q", got)
+	}
+}
+
+func TestLocalSpooler_SkipsFilesLeasedByAnotherReplica(t *testing.T) {
+	_, client := newStateTestServer(t)
+	dir := t.TempDir()
+	createTestZip(t, filepath.Join(dir, "mega_1.db.zip"), 2)
+	createTestZip(t, filepath.Join(dir, "mega_2.db.zip"), 3)
+
+	other := newReplicaStateManager(t, client, "replica-b", nil)
+	if !other.Claim("mega_1.db.zip") {
+		t.Fatal("Expected the other replica to claim the file")
+	}
+
+	sm := newReplicaStateManager(t, client, "replica-a", nil)
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 3 {
+		t.Errorf("Expected only the 3 rows of the unleased file, got %d", count)
+	}
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop spooler: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "mega_1.db.zip")); err != nil {
+		t.Errorf("Expected the leased file to be left alone: %v", err)
+	}
+	if !sm.IsProcessed("mega_2.db.zip") {
+		t.Error("Expected the unleased file to be processed")
+	}
+}
+
+func TestS3Spooler_SkipsFilesLeasedByAnotherReplica(t *testing.T) {
+	_, client := newStateTestServer(t)
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	fake := &fakeS3{objects: map[string][]byte{"a/mega_1.db.zip": zipData, "a/mega_2.db.zip": zipData}, pageSize: 10}
+
+	other := newReplicaStateManager(t, client, "replica-b", nil)
+	if !other.Claim("a/mega_1.db.zip") {
+		t.Fatal("Expected the other replica to claim the file")
+	}
+
+	sm := newReplicaStateManager(t, client, "replica-a", nil)
+	spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Second, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	if count := drainAndAck(t, spooler, nil); count != 2 {
+		t.Errorf("Expected only the rows of the unleased file, got %d", count)
+	}
+	spooler.Stop()
+
+	if !sm.IsProcessed("a/mega_2.db.zip") || sm.IsProcessed("a/mega_1.db.zip") {
+		t.Error("Expected only the unleased file to be processed")
+	}
+	if got := sm.Watermark("s3://bucket/a/"); got != "" {
+		t.Errorf("Expected the watermark to wait for the leased file, got %q", got)
+	}
+}
+
+func TestLocalSpooler_StopsReadingFileWhenLeaseIsLost(t *testing.T) {
+	_, client := newStateTestServer(t)
+	dir := t.TempDir()
+	filename := "mega_1.db.zip"
+	createTestZip(t, filepath.Join(dir, filename), 3*checkpointRows)
+
+	start := time.Now()
+	var elapsed atomic.Int64
+	clock := func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+	sm := newReplicaStateManager(t, client, "replica-a", clock)
+
+	spooler := NewLocalSpooler(dir, "once", time.Second, sm, NewLogger(false))
+	if err := spooler.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	first := receiveRow(t, spooler)
+	spooler.Ack(Ack{Token: first.Token, Count: 1})
+
+	// The lease expires while the file is being read
+	elapsed.Store(int64(2 * time.Minute))
+	count := 1 + drainAndAck(t, spooler, nil)
+	spooler.Stop()
+
+	if count >= 3*checkpointRows {
+		t.Errorf("Expected reading to stop once the lease was lost, got all %d rows", count)
+	}
+	if sm.IsProcessed(filename) || sm.IsFailed(filename) {
+		t.Error("Expected a file whose lease was lost to be left to the replica that takes it over")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// stateFile is the on-disk layout of the state file. Older versions wrote a
+// bare array of file entries, which the JSON backend still accepts.
+type stateFile struct {
+	Files      []FileStateEntry      `json:"files"`
+	Watermarks map[string]string     `json:"watermarks,omitempty"`
+	Summaries  map[string]DaySummary `json:"summaries,omitempty"`
+}
+
+// jsonStateBackend keeps the state in a single JSON file. Every change
+// rewrites the whole file, so it suits small deployments; the file is written
+// to a temporary file and renamed over the old one, so a crash never leaves
+// it half written.
+type jsonStateBackend struct {
+	path       string
+	files      map[string]FileStateEntry
+	watermarks map[string]string
+	summaries  map[string]DaySummary
+	logger     *IngestLogger
+}
+
+func newJSONStateBackend(path string, logger *IngestLogger) *jsonStateBackend {
+	return &jsonStateBackend{
+		path:       path,
+		files:      make(map[string]FileStateEntry),
+		watermarks: make(map[string]string),
+		summaries:  make(map[string]DaySummary),
+		logger:     logger,
+	}
+}
+
+func (b *jsonStateBackend) Load() (stateFile, error) {
+	file, err := readStateFile(b.path, b.logger)
+	if err != nil {
+		return stateFile{}, err
+	}
+
+	for _, entry := range file.Files {
+		b.files[entry.Filename] = entry
+	}
+	maps.Copy(b.watermarks, file.Watermarks)
+	maps.Copy(b.summaries, file.Summaries)
+
+	return file, nil
+}
+
+func (b *jsonStateBackend) PutFile(entry FileStateEntry) error {
+	b.files[entry.Filename] = entry
+	return b.write()
+}
+
+func (b *jsonStateBackend) DeleteFiles(filenames ...string) ([]string, error) {
+	var deleted []string
+	for _, filename := range filenames {
+		if _, exists := b.files[filename]; exists {
+			delete(b.files, filename)
+			deleted = append(deleted, filename)
+		}
+	}
+	return deleted, b.write()
+}
+
+func (b *jsonStateBackend) PutWatermark(name, watermark string) error {
+	b.watermarks[name] = watermark
+	return b.write()
+}
+
+func (b *jsonStateBackend) AddSummary(day string, delta DaySummary) (DaySummary, error) {
+	summary := b.summaries[day].add(delta)
+	b.summaries[day] = summary
+	return summary, b.write()
+}
+
+func (b *jsonStateBackend) Replace(state stateFile) error {
+	b.files = make(map[string]FileStateEntry, len(state.Files))
+	for _, entry := range state.Files {
+		b.files[entry.Filename] = entry
+	}
+	b.watermarks = maps.Clone(state.Watermarks)
+	if b.watermarks == nil {
+		b.watermarks = make(map[string]string)
+	}
+	b.summaries = maps.Clone(state.Summaries)
+	if b.summaries == nil {
+		b.summaries = make(map[string]DaySummary)
+	}
+	return b.write()
+}
+
+func (b *jsonStateBackend) Close() error {
+	return nil
+}
+
+func (b *jsonStateBackend) write() error {
+	file := stateFile{
+		Files:      make([]FileStateEntry, 0, len(b.files)),
+		Watermarks: b.watermarks,
+		Summaries:  b.summaries,
+	}
+	for _, entry := range b.files {
+		file.Files = append(file.Files, entry)
+	}
+	sort.Slice(file.Files, func(i, j int) bool {
+		return file.Files[i].Filename < file.Files[j].Filename
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if err := writeFileAtomic(b.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
+
+// readStateFile reads a JSON state file in either the current or the legacy
+// layout. A missing or empty file is an empty state.
+func readStateFile(path string, logger *IngestLogger) (stateFile, error) {
+	var file stateFile
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Info("State file does not exist, starting with empty state")
+		return file, nil
+	}
+	if err != nil {
+		return file, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if len(data) == 0 {
+		logger.Info("State file is empty, starting with empty state")
+		return file, nil
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &file.Files)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return file, fmt.Errorf("failed to unmarshal state file: %w", err)
+	}
+
+	return file, nil
+}
+
+// writeFileAtomic replaces the file at path with data by writing a temporary
+// file next to it and renaming it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
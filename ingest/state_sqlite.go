@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// sqliteStateSchema keeps each file entry as its JSON encoding, with the
+// columns needed to query it alongside, so that new entry fields need no
+// schema change
+const sqliteStateSchema = `
+	CREATE TABLE IF NOT EXISTS files (
+		filename   TEXT PRIMARY KEY,
+		status     TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		entry      TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS files_status ON files (status, updated_at);
+	CREATE TABLE IF NOT EXISTS watermarks (
+		name      TEXT PRIMARY KEY,
+		watermark TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS summaries (
+		day     TEXT PRIMARY KEY,
+		summary TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+`
+
+// jsonImportedKey is set in the meta table once the JSON state file has been
+// imported, so that the import happens only once
+const jsonImportedKey = "json_imported"
+
+// sqliteStateBackend keeps the state in a SQLite database, writing each change
+// as a single upsert instead of rewriting the whole state
+type sqliteStateBackend struct {
+	db     *sql.DB
+	logger *IngestLogger
+}
+
+// newSQLiteStateBackend opens the state database at path, creating it if
+// needed. The first time, the entries of the JSON state file at jsonPath are
+// imported, if it exists.
+func newSQLiteStateBackend(path, jsonPath string, logger *IngestLogger) (*sqliteStateBackend, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids lock errors
+	db.SetMaxOpenConns(1)
+
+	b := &sqliteStateBackend{db: db, logger: logger}
+	if err := b.init(jsonPath); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *sqliteStateBackend) init(jsonPath string) error {
+	if _, err := b.db.Exec(`PRAGMA journal_mode=WAL`); err != nil {
+		return fmt.Errorf("failed to enable write-ahead logging: %w", err)
+	}
+	if _, err := b.db.Exec(sqliteStateSchema); err != nil {
+		return fmt.Errorf("failed to create state tables: %w", err)
+	}
+
+	var imported string
+	err := b.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, jsonImportedKey).Scan(&imported)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read state metadata: %w", err)
+	}
+
+	var file stateFile
+	if _, statErr := os.Stat(jsonPath); jsonPath != "" && statErr == nil {
+		if file, err = readStateFile(jsonPath, b.logger); err != nil {
+			return fmt.Errorf("failed to import JSON state: %w", err)
+		}
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := putState(tx, file); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, jsonImportedKey, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("failed to write state metadata: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit JSON import: %w", err)
+	}
+
+	if len(file.Files) > 0 || len(file.Watermarks) > 0 {
+		b.logger.Info("Imported %d entries and %d watermarks from %s", len(file.Files), len(file.Watermarks), jsonPath)
+	}
+	return nil
+}
+
+func (b *sqliteStateBackend) Load() (stateFile, error) {
+	var file stateFile
+
+	rows, err := b.db.Query(`SELECT entry FROM files`)
+	if err != nil {
+		return file, fmt.Errorf("failed to query state: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return file, fmt.Errorf("failed to scan state entry: %w", err)
+		}
+		var entry FileStateEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return file, fmt.Errorf("failed to unmarshal state entry: %w", err)
+		}
+		file.Files = append(file.Files, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return file, fmt.Errorf("error iterating state: %w", err)
+	}
+
+	file.Watermarks = make(map[string]string)
+	wrows, err := b.db.Query(`SELECT name, watermark FROM watermarks`)
+	if err != nil {
+		return file, fmt.Errorf("failed to query watermarks: %w", err)
+	}
+	defer wrows.Close()
+
+	for wrows.Next() {
+		var name, watermark string
+		if err := wrows.Scan(&name, &watermark); err != nil {
+			return file, fmt.Errorf("failed to scan watermark: %w", err)
+		}
+		file.Watermarks[name] = watermark
+	}
+	if err := wrows.Err(); err != nil {
+		return file, fmt.Errorf("error iterating watermarks: %w", err)
+	}
+
+	file.Summaries = make(map[string]DaySummary)
+	srows, err := b.db.Query(`SELECT day, summary FROM summaries`)
+	if err != nil {
+		return file, fmt.Errorf("failed to query summaries: %w", err)
+	}
+	defer srows.Close()
+
+	for srows.Next() {
+		var day, data string
+		if err := srows.Scan(&day, &data); err != nil {
+			return file, fmt.Errorf("failed to scan summary: %w", err)
+		}
+		var summary DaySummary
+		if err := json.Unmarshal([]byte(data), &summary); err != nil {
+			return file, fmt.Errorf("failed to unmarshal summary: %w", err)
+		}
+		file.Summaries[day] = summary
+	}
+	if err := srows.Err(); err != nil {
+		return file, fmt.Errorf("error iterating summaries: %w", err)
+	}
+
+	return file, nil
+}
+
+func (b *sqliteStateBackend) PutFile(entry FileStateEntry) error {
+	return putFile(b.db, entry)
+}
+
+func (b *sqliteStateBackend) DeleteFiles(filenames ...string) ([]string, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var deleted []string
+	for _, filename := range filenames {
+		res, err := tx.Exec(`DELETE FROM files WHERE filename = ?`, filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete state entry: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			deleted = append(deleted, filename)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit state: %w", err)
+	}
+	return deleted, nil
+}
+
+func (b *sqliteStateBackend) PutWatermark(name, watermark string) error {
+	return putWatermark(b.db, name, watermark)
+}
+
+func (b *sqliteStateBackend) AddSummary(day string, delta DaySummary) (DaySummary, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return DaySummary{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var summary DaySummary
+	var data string
+	err = tx.QueryRow(`SELECT summary FROM summaries WHERE day = ?`, day).Scan(&data)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return DaySummary{}, fmt.Errorf("failed to read summary: %w", err)
+	default:
+		if err := json.Unmarshal([]byte(data), &summary); err != nil {
+			return DaySummary{}, fmt.Errorf("failed to unmarshal summary: %w", err)
+		}
+	}
+
+	summary = summary.add(delta)
+	if err := putSummary(tx, day, summary); err != nil {
+		return DaySummary{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return DaySummary{}, fmt.Errorf("failed to commit state: %w", err)
+	}
+	return summary, nil
+}
+
+func (b *sqliteStateBackend) Replace(state stateFile) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM files`); err != nil {
+		return fmt.Errorf("failed to clear state: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM watermarks`); err != nil {
+		return fmt.Errorf("failed to clear watermarks: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM summaries`); err != nil {
+		return fmt.Errorf("failed to clear summaries: %w", err)
+	}
+	if err := putState(tx, state); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit state: %w", err)
+	}
+	return nil
+}
+
+func (b *sqliteStateBackend) Close() error {
+	return b.db.Close()
+}
+
+// sqlExecer is implemented by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func putState(db sqlExecer, state stateFile) error {
+	for _, entry := range state.Files {
+		if err := putFile(db, entry); err != nil {
+			return err
+		}
+	}
+	for name, watermark := range state.Watermarks {
+		if err := putWatermark(db, name, watermark); err != nil {
+			return err
+		}
+	}
+	for day, summary := range state.Summaries {
+		if err := putSummary(db, day, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putFile(db sqlExecer, entry FileStateEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state entry: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO files (filename, status, updated_at, entry) VALUES (?, ?, ?, ?)
+		ON CONFLICT (filename) DO UPDATE SET
+			status = excluded.status,
+			updated_at = excluded.updated_at,
+			entry = excluded.entry
+	`, entry.Filename, string(entry.Status), entry.Timestamp.UTC().Format(time.RFC3339Nano), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to write state entry: %w", err)
+	}
+	return nil
+}
+
+func putWatermark(db sqlExecer, name, watermark string) error {
+	_, err := db.Exec(`
+		INSERT INTO watermarks (name, watermark) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET watermark = excluded.watermark
+	`, name, watermark)
+	if err != nil {
+		return fmt.Errorf("failed to write watermark: %w", err)
+	}
+	return nil
+}
+
+func putSummary(db sqlExecer, day string, summary DaySummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO summaries (day, summary) VALUES (?, ?)
+		ON CONFLICT (day) DO UPDATE SET summary = excluded.summary
+	`, day, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newSQLiteStateManager(t *testing.T, dbPath, jsonPath string) *StateManager {
+	t.Helper()
+
+	backend, err := NewStateBackend(StateBackendOptions{Kind: "sqlite", JSONPath: jsonPath, DBPath: dbPath}, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite state: %v", err)
+	}
+	sm, err := NewStateManagerWithBackend(backend, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	t.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func TestSQLiteStateBackend_ImportsJSONStateOnce(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "state.json")
+	dbPath := filepath.Join(dir, "state.db")
+
+	legacy, err := NewStateManager(jsonPath, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create JSON state manager: %v", err)
+	}
+	if err := legacy.MarkProcessed("file1.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if err := legacy.MarkFailed("file2.db.zip", "timeout"); err != nil {
+		t.Fatalf("Failed to mark file as failed: %v", err)
+	}
+	if err := legacy.SetWatermark("prefix", "file2.db.zip"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+
+	sm := newSQLiteStateManager(t, dbPath, jsonPath)
+	if !sm.IsProcessed("file1.db.zip") || !sm.IsFailed("file2.db.zip") || sm.Watermark("prefix") != "file2.db.zip" {
+		t.Fatalf("Expected the JSON state to be imported, got %+v and %v", sm.state, sm.watermarks)
+	}
+	if err := sm.MarkProcessed("file3.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	sm.Close()
+
+	// Later changes to the JSON file are not imported again
+	if err := legacy.MarkProcessed("file4.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	sm = newSQLiteStateManager(t, dbPath, jsonPath)
+	if len(sm.state) != 3 || !sm.IsProcessed("file3.db.zip") {
+		t.Errorf("Expected the 3 entries of the database, got %+v", sm.state)
+	}
+}
+
+func TestSQLiteStateBackend_PersistsChanges(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	sm := newSQLiteStateManager(t, dbPath, "")
+	progress := FileProgress{Database: 1, LastRowid: 42, RowsAcked: 1042}
+	if err := sm.SetProgress("file1.db.zip", progress); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+	if err := sm.MarkProcessed("file2.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if err := sm.Forget("file2.db.zip"); err != nil {
+		t.Fatalf("Failed to forget file: %v", err)
+	}
+	if err := sm.SetWatermark("prefix", "a"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+	if err := sm.SetWatermark("prefix", "b"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+	sm.Close()
+
+	sm = newSQLiteStateManager(t, dbPath, "")
+	if got, ok := sm.Progress("file1.db.zip"); !ok || got != progress {
+		t.Errorf("Expected progress %+v, got %+v (%v)", progress, got, ok)
+	}
+	if _, exists := sm.state["file2.db.zip"]; exists {
+		t.Error("Expected forgotten file to stay forgotten")
+	}
+	if watermark := sm.Watermark("prefix"); watermark != "b" {
+		t.Errorf("Expected watermark b, got %q", watermark)
+	}
+
+	if err := sm.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	sm.Close()
+	sm = newSQLiteStateManager(t, dbPath, "")
+	if len(sm.state) != 1 || sm.Watermark("prefix") != "b" {
+		t.Errorf("Expected SaveState to keep the state, got %+v and %v", sm.state, sm.watermarks)
+	}
+}
+
+func TestNewStateBackend_RejectsUnknownKind(t *testing.T) {
+	if _, err := NewStateBackend(StateBackendOptions{Kind: "redis"}, NewLogger(false)); err == nil {
+		t.Error("Expected an unknown state backend to be rejected")
+	}
+}
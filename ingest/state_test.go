@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestStateManager_LoadState(t *testing.T) {
@@ -132,3 +133,180 @@ func TestStateManager_EmptyStateFile(t *testing.T) {
 		t.Errorf("Expected empty state, got %d entries", len(sm.state))
 	}
 }
+
+func TestStateManager_WatermarksAndLegacyFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	stateFile := filepath.Join(tmpDir, "state.json")
+	logger := NewLogger(false)
+
+	legacy := `[{"filename":"old.db.zip","status":"processed","timestamp":"2025-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(stateFile, []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write legacy state file: %v", err)
+	}
+
+	sm1, err := NewStateManager(stateFile, logger)
+	if err != nil {
+		t.Fatalf("Failed to load legacy state file: %v", err)
+	}
+
+	if !sm1.IsProcessed("old.db.zip") {
+		t.Error("Expected legacy entry to be loaded")
+	}
+
+	if err := sm1.SetWatermark("s3://bucket/prefix/", "prefix/b.db.zip"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+
+	sm2, err := NewStateManager(stateFile, logger)
+	if err != nil {
+		t.Fatalf("Failed to reload state manager: %v", err)
+	}
+
+	if got := sm2.Watermark("s3://bucket/prefix/"); got != "prefix/b.db.zip" {
+		t.Errorf("Expected watermark after reload, got %q", got)
+	}
+
+	if !sm2.IsProcessed("old.db.zip") {
+		t.Error("Expected legacy entry to survive rewrite in the new format")
+	}
+}
+
+func TestStateManager_RetriesWithBackoff(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	sm, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sm.now = func() time.Time { return now }
+	sm.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour})
+
+	filename := "test_file.db.zip"
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if err := sm.MarkFailed(filename, "timeout"); err != nil {
+			t.Fatalf("Failed to mark file as failed: %v", err)
+		}
+		if sm.RetryDue(filename) || sm.IsQuarantined(filename) {
+			t.Fatalf("Expected attempt %d to wait for its retry", attempt+1)
+		}
+		if got := sm.RetryAt(filename); !got.Equal(now.Add(delay)) {
+			t.Fatalf("Expected retry %v after attempt %d, got %v", delay, attempt+1, got.Sub(now))
+		}
+		now = now.Add(delay)
+		if !sm.RetryDue(filename) {
+			t.Fatalf("Expected retry to be due after %v", delay)
+		}
+	}
+
+	// The state survives a restart
+	sm2, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to reload state: %v", err)
+	}
+	if entry := sm2.state[filename]; entry.Attempts != 2 || entry.NextRetry.IsZero() {
+		t.Errorf("Expected 2 attempts and a retry time to be persisted, got %+v", entry)
+	}
+
+	if err := sm.MarkFailed(filename, "timeout"); err != nil {
+		t.Fatalf("Failed to mark file as failed: %v", err)
+	}
+	if !sm.IsQuarantined(filename) || !sm.IsFailed(filename) || sm.RetryDue(filename) {
+		t.Error("Expected file to be quarantined after its last attempt")
+	}
+}
+
+func TestStateManager_Quarantine(t *testing.T) {
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	if err := sm.Quarantine("corrupt.db.zip", "zip: not a valid zip file"); err != nil {
+		t.Fatalf("Failed to quarantine file: %v", err)
+	}
+	if !sm.IsQuarantined("corrupt.db.zip") || sm.RetryDue("corrupt.db.zip") {
+		t.Error("Expected file to be quarantined without a retry")
+	}
+
+	if err := sm.MarkProcessed("corrupt.db.zip"); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if sm.IsFailed("corrupt.db.zip") {
+		t.Error("Expected a processed file no longer to count as failed")
+	}
+}
+
+func TestStateManager_Progress(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	sm, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	filename := "test_file.db.zip"
+	if _, ok := sm.Progress(filename); ok {
+		t.Fatal("Expected no progress for an unknown file")
+	}
+
+	want := FileProgress{Database: 1, LastRowid: 2000, RowsAcked: 3500}
+	if err := sm.SetProgress(filename, want); err != nil {
+		t.Fatalf("Failed to set progress: %v", err)
+	}
+	if sm.IsProcessed(filename) || sm.IsFailed(filename) {
+		t.Error("Expected file in progress to be neither processed nor failed")
+	}
+
+	// The checkpoint survives a restart and a failed attempt
+	sm2, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to reload state: %v", err)
+	}
+	if entry := sm2.state[filename]; entry.Status != FileStatusInProgress {
+		t.Errorf("Expected status %s, got %s", FileStatusInProgress, entry.Status)
+	}
+	if err := sm2.MarkFailed(filename, "timeout"); err != nil {
+		t.Fatalf("Failed to mark file as failed: %v", err)
+	}
+	if got, ok := sm2.Progress(filename); !ok || got != want {
+		t.Errorf("Expected progress %+v after failure, got %+v (%v)", want, got, ok)
+	}
+
+	if err := sm2.MarkProcessed(filename); err != nil {
+		t.Fatalf("Failed to mark file as processed: %v", err)
+	}
+	if _, ok := sm2.Progress(filename); ok {
+		t.Error("Expected processed file to have no progress")
+	}
+}
+
+func TestStateManager_WritesStateFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+	sm, err := NewStateManager(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	for _, filename := range []string{"b.db.zip", "a.db.zip"} {
+		if err := sm.MarkProcessed(filename); err != nil {
+			t.Fatalf("Failed to mark file as processed: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Errorf("Expected only the state file to be left behind, got %v", entries)
+	}
+
+	file, err := readStateFile(stateFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	if len(file.Files) != 2 || file.Files[0].Filename != "a.db.zip" {
+		t.Errorf("Expected entries sorted by filename, got %+v", file.Files)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v9"
+)
+
+const stateUsage = `Usage: ingest state [-skip-tls-verify] <command> [flags]
+
+Commands:
+  list [-status failed,quarantined] [-since 24h] [-until 2025-01-02T00:00:00Z] [-error text]
+                             List file entries
+  show <file>                Print the entry of a file as JSON
+  retry <file>... | -all-failed
+                             Make failed, quarantined or changed files due for another attempt now
+  forget <glob>...           Remove the entries of matching files, so they are processed again
+  summaries                  List the per-day counts of pruned processed entries
+  export [-o file]           Write the whole state as JSON, in the layout of the JSON state file
+`
+
+// runStateCommand implements the state subcommand, which inspects and edits
+// the processing state of the configured state backend
+func runStateCommand(args []string) {
+	config := LoadConfig()
+
+	// Logs go to stderr so that listings and exports can be piped
+	logger := NewLogger(config.LoggingEnabled)
+	logger.SetOutput(os.Stderr)
+
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, stateUsage) }
+	skipTLSVerify := flags.Bool("skip-tls-verify", false, "Skip TLS certificate verification (use for local development only)")
+	flags.Parse(args)
+	args = flags.Args()
+
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var esClient *elasticsearch.Client
+	if config.SpoolStateBackend == "elasticsearch" {
+		var err error
+		esClient, err = NewElasticsearchClient(ElasticsearchConfig{
+			URL:           config.ElasticsearchURL,
+			APIKey:        config.ElasticsearchAPIKey,
+			SkipTLSVerify: *skipTLSVerify,
+		}, logger)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// The command holds the state under a name of its own, so that it is not
+	// taken for a replica running on the same host
+	config.SpoolReplicaID += "-state-command"
+	sm, err := OpenStateManager(config, esClient, stateCommandAccess(args[0]), logger)
+	if errors.Is(err, errStateLocked) {
+		logger.Error("%v; stop ingestion before editing the state", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+
+	err = runStateSubcommand(sm, args, os.Stdout)
+	sm.Close()
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+}
+
+// stateCommandAccess returns how a state command opens the state. Commands
+// that only read it work on a snapshot while ingestion runs; those that edit
+// it need the state to themselves.
+func stateCommandAccess(command string) StateAccess {
+	switch command {
+	case "retry", "forget":
+		return StateExclusive
+	}
+	return StateReadOnly
+}
+
+// runStateSubcommand runs one state command against sm, writing its output
+// to out
+func runStateSubcommand(sm *StateManager, args []string, out io.Writer) error {
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		return stateList(sm, args, out)
+	case "show":
+		return stateShow(sm, args, out)
+	case "retry":
+		return stateRetry(sm, args, out)
+	case "forget":
+		return stateForget(sm, args, out)
+	case "summaries":
+		return stateSummaries(sm, args, out)
+	case "export":
+		return stateExport(sm, args, out)
+	}
+	return fmt.Errorf("unknown state command %q\n\n%s", command, stateUsage)
+}
+
+// stateFilter selects the entries listed by the list command
+type stateFilter struct {
+	statuses map[FileStatus]bool
+	since    time.Time
+	until    time.Time
+	errText  string
+}
+
+func (f stateFilter) matches(entry FileStateEntry) bool {
+	if len(f.statuses) > 0 && !f.statuses[entry.Status] {
+		return false
+	}
+	if !f.since.IsZero() && entry.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !entry.Timestamp.Before(f.until) {
+		return false
+	}
+	if f.errText != "" && !strings.Contains(strings.ToLower(entry.Error), strings.ToLower(f.errText)) {
+		return false
+	}
+	return true
+}
+
+// parseStatuses validates a comma-separated list of statuses
+func parseStatuses(value string) (map[FileStatus]bool, error) {
+	statuses := make(map[FileStatus]bool)
+	for _, name := range strings.Split(value, ",") {
+		status := FileStatus(strings.TrimSpace(name))
+		switch status {
+		case "":
+			continue
+		case FileStatusProcessed, FileStatusInProgress, FileStatusFailed, FileStatusQuarantined, FileStatusChanged:
+			statuses[status] = true
+		default:
+			return nil, fmt.Errorf("invalid status %q (must be processed, in_progress, failed, quarantined or changed)", name)
+		}
+	}
+	return statuses, nil
+}
+
+// parseStateTime accepts an RFC 3339 time, a date, or a duration before now
+func parseStateTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use RFC 3339, YYYY-MM-DD or a duration such as 24h)", value)
+}
+
+func stateList(sm *StateManager, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("state list", flag.ContinueOnError)
+	status := flags.String("status", "", "Comma-separated statuses to list: processed, in_progress, failed, quarantined, changed")
+	since := flags.String("since", "", "Only entries updated at or after this time, or this long ago")
+	until := flags.String("until", "", "Only entries updated before this time, or this long ago")
+	errText := flags.String("error", "", "Only entries whose error contains this text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var filter stateFilter
+	var err error
+	if filter.statuses, err = parseStatuses(*status); err != nil {
+		return err
+	}
+	now := sm.now()
+	if filter.since, err = parseStateTime(*since, now); err != nil {
+		return err
+	}
+	if filter.until, err = parseStateTime(*until, now); err != nil {
+		return err
+	}
+	filter.errText = *errText
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tUPDATED\tATTEMPTS\tERROR")
+	for _, entry := range sm.Entries() {
+		if !filter.matches(entry) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", entry.Filename, entry.Status, entry.Timestamp.Format(time.RFC3339), entry.Attempts, entry.Error)
+	}
+	return w.Flush()
+}
+
+func stateShow(sm *StateManager, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: ingest state show <file>")
+	}
+
+	entry, exists := sm.Entry(args[0])
+	if !exists {
+		return fmt.Errorf("no state for %s", args[0])
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entry)
+}
+
+func stateRetry(sm *StateManager, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("state retry", flag.ContinueOnError)
+	allFailed := flags.Bool("all-failed", false, "Retry every failed and quarantined file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filenames := flags.Args()
+	if *allFailed {
+		if len(filenames) > 0 {
+			return fmt.Errorf("give either files or -all-failed, not both")
+		}
+		for _, entry := range sm.Entries() {
+			if entry.Status == FileStatusFailed || entry.Status == FileStatusQuarantined {
+				filenames = append(filenames, entry.Filename)
+			}
+		}
+	} else if len(filenames) == 0 {
+		return fmt.Errorf("usage: ingest state retry <file>... | -all-failed")
+	}
+
+	for _, filename := range filenames {
+		if err := sm.Retry(filename); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Scheduled %s for retry\n", filename)
+	}
+	fmt.Fprintf(out, "%d files scheduled for retry\n", len(filenames))
+	return nil
+}
+
+func stateForget(sm *StateManager, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ingest state forget <glob>...")
+	}
+
+	total := 0
+	for _, pattern := range args {
+		forgotten, err := sm.ForgetMatching(pattern)
+		for _, filename := range forgotten {
+			fmt.Fprintf(out, "Forgot %s\n", filename)
+		}
+		total += len(forgotten)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "%d entries forgotten\n", total)
+	return nil
+}
+
+func stateSummaries(sm *StateManager, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: ingest state summaries")
+	}
+
+	summaries := sm.Summaries()
+	days := make([]string, 0, len(summaries))
+	for day := range summaries {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DAY\tPROCESSED")
+	for _, day := range days {
+		fmt.Fprintf(w, "%s\t%d\n", day, summaries[day].Processed)
+	}
+	return w.Flush()
+}
+
+func stateExport(sm *StateManager, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("state export", flag.ContinueOnError)
+	output := flags.String("o", "", "Write to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(stateFile{
+		Files:      sm.Entries(),
+		Watermarks: sm.Watermarks(),
+		Summaries:  sm.Summaries(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if *output != "" {
+		if err := writeFileAtomic(*output, data, 0644); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+		return nil
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
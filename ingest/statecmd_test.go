@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCommandStateManager(t *testing.T) *StateManager {
+	t.Helper()
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	sm.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour})
+
+	now := time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+	sm.now = func() time.Time { return now }
+
+	for _, filename := range []string{"2025-01-08_a.db.zip", "2025-01-09_b.db.zip"} {
+		if err := sm.MarkProcessed(filename); err != nil {
+			t.Fatalf("Failed to mark file as processed: %v", err)
+		}
+	}
+	if err := sm.MarkFailed("2025-01-09_c.db.zip", "bulk request failed: timeout"); err != nil {
+		t.Fatalf("Failed to mark file as failed: %v", err)
+	}
+	if err := sm.Quarantine("2025-01-10_d.db.zip", "zip: not a valid zip file"); err != nil {
+		t.Fatalf("Failed to quarantine file: %v", err)
+	}
+	if err := sm.SetWatermark("s3://bucket/a/", "a/2025-01-09_b.db.zip"); err != nil {
+		t.Fatalf("Failed to set watermark: %v", err)
+	}
+	return sm
+}
+
+func runState(t *testing.T, sm *StateManager, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	err := runStateSubcommand(sm, args, &out)
+	return out.String(), err
+}
+
+func TestStateCommand_List(t *testing.T) {
+	sm := newCommandStateManager(t)
+
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"2025-01-08_a.db.zip", "2025-01-09_b.db.zip", "2025-01-09_c.db.zip", "2025-01-10_d.db.zip"}},
+		{[]string{"-status", "failed,quarantined"}, []string{"2025-01-09_c.db.zip", "2025-01-10_d.db.zip"}},
+		{[]string{"-error", "ZIP"}, []string{"2025-01-10_d.db.zip"}},
+	} {
+		out, err := runState(t, sm, append([]string{"list"}, tc.args...)...)
+		if err != nil {
+			t.Fatalf("list %v failed: %v", tc.args, err)
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")[1:]
+		if len(lines) != len(tc.want) {
+			t.Errorf("list %v: expected %d entries, got %q", tc.args, len(tc.want), out)
+			continue
+		}
+		for i, name := range tc.want {
+			if !strings.HasPrefix(lines[i], name+" ") {
+				t.Errorf("list %v: expected line %d to be %s, got %q", tc.args, i, name, lines[i])
+			}
+		}
+	}
+
+	if _, err := runState(t, sm, "list", "-status", "done"); err == nil {
+		t.Error("Expected an unknown status to be rejected")
+	}
+}
+
+func TestStateCommand_ListByTime(t *testing.T) {
+	dir := t.TempDir()
+	sm, err := NewStateManager(filepath.Join(dir, "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	now := time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i, filename := range []string{"old.db.zip", "recent.db.zip"} {
+		sm.now = func() time.Time { return now.Add(time.Duration(i-1) * 48 * time.Hour) }
+		if err := sm.Quarantine(filename, "corrupt"); err != nil {
+			t.Fatalf("Failed to quarantine file: %v", err)
+		}
+	}
+	sm.now = func() time.Time { return now }
+
+	out, err := runState(t, sm, "list", "-since", "24h")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if !strings.Contains(out, "recent.db.zip") || strings.Contains(out, "old.db.zip") {
+		t.Errorf("Expected only the recent entry since 24h ago, got %q", out)
+	}
+
+	out, err = runState(t, sm, "list", "-until", "2025-01-09")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if strings.Contains(out, "recent.db.zip") || !strings.Contains(out, "old.db.zip") {
+		t.Errorf("Expected only the old entry until 2025-01-09, got %q", out)
+	}
+}
+
+func TestStateCommand_ShowAndRetry(t *testing.T) {
+	sm := newCommandStateManager(t)
+
+	out, err := runState(t, sm, "show", "2025-01-10_d.db.zip")
+	if err != nil {
+		t.Fatalf("show failed: %v", err)
+	}
+	var entry FileStateEntry
+	if err := json.Unmarshal([]byte(out), &entry); err != nil || entry.Status != FileStatusQuarantined {
+		t.Errorf("Expected the quarantined entry as JSON, got %q (%v)", out, err)
+	}
+	if _, err := runState(t, sm, "show", "missing.db.zip"); err == nil {
+		t.Error("Expected showing an unknown file to fail")
+	}
+
+	if _, err := runState(t, sm, "retry", "2025-01-08_a.db.zip"); err == nil {
+		t.Error("Expected retrying a processed file to be rejected")
+	}
+	if _, err := runState(t, sm, "retry", "-all-failed"); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	for _, filename := range []string{"2025-01-09_c.db.zip", "2025-01-10_d.db.zip"} {
+		if !sm.RetryDue(filename) {
+			t.Errorf("Expected %s to be due for a retry", filename)
+		}
+		if entry, _ := sm.Entry(filename); entry.Attempts != 0 {
+			t.Errorf("Expected the attempts of %s to be reset, got %d", filename, entry.Attempts)
+		}
+	}
+}
+
+func TestStateCommand_ForgetAndExport(t *testing.T) {
+	sm := newCommandStateManager(t)
+
+	out, err := runState(t, sm, "forget", "2025-01-09_*")
+	if err != nil {
+		t.Fatalf("forget failed: %v", err)
+	}
+	if !strings.Contains(out, "2 entries forgotten") {
+		t.Errorf("Expected 2 entries to be forgotten, got %q", out)
+	}
+	if _, err := runState(t, sm, "forget", "[unclosed"); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+
+	exportPath := filepath.Join(t.TempDir(), "export.json")
+	if _, err := runState(t, sm, "export", "-o", exportPath); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	// The export is a valid JSON state file
+	imported, err := NewStateManager(exportPath, NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to load export: %v", err)
+	}
+	if len(imported.Entries()) != 2 || !imported.IsProcessed("2025-01-08_a.db.zip") {
+		t.Errorf("Expected the 2 remaining entries in the export, got %+v", imported.Entries())
+	}
+	if got := imported.Watermark("s3://bucket/a/"); got != "a/2025-01-09_b.db.zip" {
+		t.Errorf("Expected the watermark in the export, got %q", got)
+	}
+}
+
+func TestStateCommand_Summaries(t *testing.T) {
+	sm := newCommandStateManager(t)
+	sm.SetRetentionPolicy(RetentionPolicy{MaxAge: time.Nanosecond})
+	sm.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := sm.Compact(func(string) bool { return true }); err != nil {
+		t.Fatalf("Failed to compact state: %v", err)
+	}
+
+	out, err := runState(t, sm, "summaries")
+	if err != nil {
+		t.Fatalf("summaries failed: %v", err)
+	}
+	day := time.Now().UTC().Format(time.DateOnly)
+	if fields := strings.Fields(out); len(fields) != 4 || fields[2] != day || fields[3] != "2" {
+		t.Errorf("Expected 2 processed files on %s, got %q", day, out)
+	}
+}
+
+func TestStateCommand_RejectsUnknownCommand(t *testing.T) {
+	sm := newCommandStateManager(t)
+	if _, err := runState(t, sm, "purge"); err == nil {
+		t.Error("Expected an unknown command to be rejected")
+	}
+}
+
+func TestOpenStateManager_LocksStateAgainstOtherProcesses(t *testing.T) {
+	dir := t.TempDir()
+	for _, config := range []*Config{
+		{SpoolStateBackend: "json", SpoolStateFile: filepath.Join(dir, "state.json")},
+		{SpoolStateBackend: "sqlite", SpoolStateDB: filepath.Join(dir, "state.db")},
+	} {
+		t.Run(config.SpoolStateBackend, func(t *testing.T) {
+			ingester, err := OpenStateManager(config, nil, StateShared, NewLogger(false))
+			if err != nil {
+				t.Fatalf("Failed to open state: %v", err)
+			}
+			if err := ingester.MarkProcessed("mega_1.db.zip"); err != nil {
+				t.Fatalf("Failed to mark file as processed: %v", err)
+			}
+
+			if _, err := OpenStateManager(config, nil, StateExclusive, NewLogger(false)); !errors.Is(err, errStateLocked) {
+				t.Fatalf("Expected the state command to be refused while ingesting, got %v", err)
+			}
+
+			// Inspecting the state works while ingesting
+			snapshot, err := OpenStateManager(config, nil, StateReadOnly, NewLogger(false))
+			if err != nil {
+				t.Fatalf("Expected the state to be readable while ingesting: %v", err)
+			}
+			if !snapshot.IsProcessed("mega_1.db.zip") {
+				t.Error("Expected the snapshot to hold the state written while ingesting")
+			}
+			snapshot.Close()
+
+			ingester.Close()
+			command, err := OpenStateManager(config, nil, StateExclusive, NewLogger(false))
+			if err != nil {
+				t.Fatalf("Expected the state command to open the state once ingestion stopped: %v", err)
+			}
+			defer command.Close()
+			if !command.IsProcessed("mega_1.db.zip") {
+				t.Error("Expected the state written while ingesting to be loaded")
+			}
+		})
+	}
+}
+
+func TestStateCommand_ForgetAndRetryListS3KeysAgain(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 2)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+	fake := &fakeS3{objects: map[string][]byte{
+		"a/mega_20250101_000000.db.zip": zipData,
+		"a/mega_20250102_000000.db.zip": zipData,
+		"a/mega_20250103_000000.db.zip": zipData,
+	}, pageSize: 10}
+
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), NewLogger(false))
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+	poll := func() int {
+		spooler := newS3SpoolerWithClient(fake, "bucket", []string{"a/"}, "once", time.Millisecond, sm, NewLogger(false))
+		if err := spooler.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start spooler: %v", err)
+		}
+		count := drainAndAck(t, spooler, nil)
+		spooler.Stop()
+		return count
+	}
+
+	if count := poll(); count != 6 {
+		t.Fatalf("Expected 6 rows, got %d", count)
+	}
+	if count := poll(); count != 0 {
+		t.Fatalf("Expected processed keys to be skipped, got %d rows", count)
+	}
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_20250103_000000.db.zip" {
+		t.Fatalf("Expected the watermark to pass every key, got %q", got)
+	}
+
+	if _, err := runState(t, sm, "forget", "a/mega_20250102_*"); err != nil {
+		t.Fatalf("forget failed: %v", err)
+	}
+	if count := poll(); count != 2 {
+		t.Errorf("Expected the forgotten key to be processed again, got %d rows", count)
+	}
+
+	// A quarantined key does not hold the watermark, so a retry lists it again
+	if err := sm.Quarantine("a/mega_20250101_000000.db.zip", "zip: not a valid zip file"); err != nil {
+		t.Fatalf("Failed to quarantine file: %v", err)
+	}
+	if _, err := runState(t, sm, "retry", "a/mega_20250101_000000.db.zip"); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if count := poll(); count != 2 {
+		t.Errorf("Expected the retried key to be processed again, got %d rows", count)
+	}
+	poll()
+	if got := sm.Watermark("s3://bucket/a/"); got != "a/mega_20250103_000000.db.zip" {
+		t.Errorf("Expected the watermark to pass every key again, got %q", got)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockStateFile only opens the file at path where file locks are not
+// supported, which leaves the state unlocked
+func lockStateFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockStateFile takes an exclusive lock on the file at path, creating it if
+// needed, and fails with errStateLocked if another process holds it. The lock
+// is released when the returned file is closed or the process exits.
+func lockStateFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is held by another process", errStateLocked, path)
+		}
+		return nil, fmt.Errorf("failed to lock state: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// doneSuffix names the marker a producer may create next to a file once it
+// has been written completely, e.g. mega.db.zip.done for mega.db.zip
+const doneSuffix = ".done"
+
+// LocalWatchConfig controls when watch mode considers a file completely
+// written
+type LocalWatchConfig struct {
+	// StablePeriod is how long a file's size and modification time must stay
+	// unchanged before it is processed without a marker
+	StablePeriod time.Duration
+
+	// RequireDoneMarker only processes files whose .done marker exists
+	RequireDoneMarker bool
+}
+
+// DefaultLocalWatchConfig returns the watch settings used when none are given
+func DefaultLocalWatchConfig() LocalWatchConfig {
+	return LocalWatchConfig{StablePeriod: 5 * time.Second}
+}
+
+// fileSnapshot is the size and modification time a file had when first seen
+// with them
+type fileSnapshot struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// stabilityTracker decides whether files in the spool directory have stopped
+// changing, so that files still being copied in are not read half-written
+type stabilityTracker struct {
+	period time.Duration
+	now    func() time.Time
+	seen   map[string]fileSnapshot
+}
+
+func newStabilityTracker(period time.Duration) *stabilityTracker {
+	return &stabilityTracker{period: period, now: time.Now, seen: make(map[string]fileSnapshot)}
+}
+
+// check reports whether the file has kept its size and modification time for
+// the stable period, and otherwise how long to wait before checking again. A
+// file last modified longer ago than the period is stable on first sight.
+func (t *stabilityTracker) check(name string, info os.FileInfo) (bool, time.Duration) {
+	now := t.now()
+	snap, ok := t.seen[name]
+	if !ok || snap.size != info.Size() || !snap.modTime.Equal(info.ModTime()) {
+		snap = fileSnapshot{size: info.Size(), modTime: info.ModTime(), since: now}
+		t.seen[name] = snap
+		if now.Sub(info.ModTime()) >= t.period {
+			return true, 0
+		}
+	}
+
+	if waited := now.Sub(snap.since); waited < t.period {
+		return false, t.period - waited
+	}
+	return true, 0
+}
+
+// prune forgets files that are no longer listed
+func (t *stabilityTracker) prune(listed []string) {
+	keep := make(map[string]bool, len(listed))
+	for _, name := range listed {
+		keep[name] = true
+	}
+	for name := range t.seen {
+		if !keep[name] {
+			delete(t.seen, name)
+		}
+	}
+}
+
+// watchFiles processes files as they appear in the directory. Changes are
+// picked up from filesystem notifications, with a rescan every interval in
+// case one was missed or notifications are unavailable.
+func (ls *LocalSpooler) watchFiles(ctx context.Context) {
+	changes, err := watchDirectory(ctx, ls.directory)
+	if err != nil {
+		ls.logger.Error("Failed to watch %s, polling every %s instead: %v", ls.directory, ls.interval, err)
+	}
+
+	tracker := newStabilityTracker(ls.watch.StablePeriod)
+	for {
+		wait := ls.interval
+
+		files, err := ls.discoverFiles()
+		if err != nil {
+			ls.logger.Error("Failed to discover files: %v", err)
+		} else {
+			tracker.prune(files)
+			ready, recheck := ls.readyFiles(files, tracker)
+			ls.processFiles(ctx, ready)
+			if recheck > 0 && recheck < wait {
+				wait = recheck
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			ls.logger.Info("Context cancelled, stopping spooler")
+			return
+		case <-changes:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// readyFiles returns the files that are completely written and not already
+// being processed, and the time until the next unstable file should be
+// checked again
+func (ls *LocalSpooler) readyFiles(files []string, tracker *stabilityTracker) ([]string, time.Duration) {
+	var ready []string
+	var recheck time.Duration
+	for _, filename := range files {
+		if ls.isPending(filename) {
+			continue
+		}
+
+		filePath := filepath.Join(ls.directory, filename)
+		if _, err := os.Stat(filePath + doneSuffix); err == nil {
+			ready = append(ready, filename)
+			continue
+		}
+		if ls.watch.RequireDoneMarker {
+			ls.logger.Debug("Waiting for %s%s before processing %s", filename, doneSuffix, filename)
+			continue
+		}
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			// Removed or renamed since the directory was read
+			continue
+		}
+		stable, wait := tracker.check(filename, info)
+		if !stable {
+			ls.logger.Debug("Waiting for %s to stop changing", filename)
+			if recheck == 0 || wait < recheck {
+				recheck = wait
+			}
+			continue
+		}
+		ready = append(ready, filename)
+	}
+	return ready, recheck
+}
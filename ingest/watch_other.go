@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDirectory is not supported on this platform; the watcher falls back to
+// polling
+func watchDirectory(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return nil, errors.New("filesystem notifications are not supported on this platform")
+}
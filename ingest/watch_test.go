@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeFileInfo reports a fixed size and modification time
+type fakeFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+
+func TestStabilityTracker(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracker := newStabilityTracker(5 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	if stable, wait := tracker.check("a.db.zip", fakeFileInfo{size: 10, modTime: start}); stable || wait != 5*time.Second {
+		t.Fatalf("Expected a just-modified file to wait 5s, got %v and %v", stable, wait)
+	}
+
+	now = start.Add(3 * time.Second)
+	if stable, _ := tracker.check("a.db.zip", fakeFileInfo{size: 20, modTime: now}); stable {
+		t.Fatal("Expected a growing file not to be stable")
+	}
+
+	now = start.Add(6 * time.Second)
+	if stable, wait := tracker.check("a.db.zip", fakeFileInfo{size: 20, modTime: start.Add(3 * time.Second)}); stable || wait != 2*time.Second {
+		t.Fatalf("Expected the wait to restart after the file grew, got %v and %v", stable, wait)
+	}
+
+	now = start.Add(8 * time.Second)
+	if stable, _ := tracker.check("a.db.zip", fakeFileInfo{size: 20, modTime: start.Add(3 * time.Second)}); !stable {
+		t.Fatal("Expected the file to be stable once unchanged for the period")
+	}
+
+	if stable, _ := tracker.check("old.db.zip", fakeFileInfo{size: 10, modTime: start}); !stable {
+		t.Error("Expected a file untouched for longer than the period to be stable on first sight")
+	}
+
+	tracker.prune([]string{"old.db.zip"})
+	if _, ok := tracker.seen["a.db.zip"]; ok {
+		t.Error("Expected files no longer listed to be forgotten")
+	}
+}
+
+func startWatchSpooler(t *testing.T, dir string, watch LocalWatchConfig) (*LocalSpooler, *StateManager) {
+	t.Helper()
+
+	logger := NewLogger(false)
+	sm, err := NewStateManager(filepath.Join(t.TempDir(), "state.json"), logger)
+	if err != nil {
+		t.Fatalf("Failed to create state manager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spooler := NewLocalSpooler(dir, "watch", time.Minute, sm, logger)
+	spooler.watch = watch
+	if err := spooler.Start(ctx); err != nil {
+		t.Fatalf("Failed to start spooler: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		spooler.Stop()
+	})
+	return spooler, sm
+}
+
+// expectNoRows fails if the spooler emits a row within d
+func expectNoRows(t *testing.T, spooler DataSource, d time.Duration, why string) {
+	t.Helper()
+
+	select {
+	case <-spooler.Records():
+		t.Fatalf("Expected no rows %s", why)
+	case <-time.After(d):
+	}
+}
+
+func TestLocalSpooler_WatchWaitsForStableFile(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.db.zip")
+	createTestZip(t, zipPath, 3)
+	zipData, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to read test zip: %v", err)
+	}
+
+	dir := t.TempDir()
+	spooler, sm := startWatchSpooler(t, dir, LocalWatchConfig{StablePeriod: 300 * time.Millisecond})
+
+	// Copy the file in two steps, as a slow transfer would
+	filename := "mega_1.db.zip"
+	half := len(zipData) / 2
+	if err := os.WriteFile(filepath.Join(dir, filename), zipData[:half], 0644); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+	expectNoRows(t, spooler, 150*time.Millisecond, "while the file is being written")
+
+	f, err := os.OpenFile(filepath.Join(dir, filename), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to reopen file: %v", err)
+	}
+	if _, err := f.Write(zipData[half:]); err != nil {
+		t.Fatalf("Failed to finish file: %v", err)
+	}
+	f.Close()
+
+	for i := 0; i < 3; i++ {
+		row := receiveRow(t, spooler)
+		spooler.Ack(Ack{Token: row.Token, Count: 1})
+	}
+
+	waitFor(t, func() bool { return sm.IsProcessed(filename) }, "the file to be processed")
+	if sm.IsFailed(filename) {
+		t.Error("Expected the file not to have been read half-written")
+	}
+}
+
+func TestLocalSpooler_WatchRequiresDoneMarker(t *testing.T) {
+	dir := t.TempDir()
+	spooler, sm := startWatchSpooler(t, dir, LocalWatchConfig{RequireDoneMarker: true})
+
+	filename := "mega_1.db.zip"
+	filePath := filepath.Join(dir, filename)
+	createTestZip(t, filePath, 2)
+	expectNoRows(t, spooler, 150*time.Millisecond, "before the marker exists")
+
+	if err := os.WriteFile(filePath+doneSuffix, nil, 0644); err != nil {
+		t.Fatalf("Failed to write marker: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		row := receiveRow(t, spooler)
+		spooler.Ack(Ack{Token: row.Token, Count: 1})
+	}
+
+	waitFor(t, func() bool { return sm.IsProcessed(filename) }, "the file to be processed")
+	waitFor(t, func() bool {
+		_, err := os.Stat(filePath + doneSuffix)
+		return os.IsNotExist(err)
+	}, "the marker to be removed with the file")
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected processed file to be removed, got %v", err)
+	}
+}
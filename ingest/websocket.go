@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// jetstreamPostCollection is the only collection requested from the stream
+	jetstreamPostCollection = "app.bsky.feed.post"
+
+	// websocketSourceName is the Source of every record read from the stream
+	websocketSourceName = "websocket"
+)
+
+func init() {
+	RegisterDataSource("websocket", newWebSocketDataSource)
+}
+
+func newWebSocketDataSource(opts DataSourceOptions) (DataSource, error) {
+	if opts.Config.TurboStreamURL == "" {
+		return nil, fmt.Errorf("TURBOSTREAM_URL environment variable is required for websocket source")
+	}
+	if opts.Mode != "spool" {
+		return nil, fmt.Errorf("%s mode is not supported by the websocket source, which streams until stopped; use -mode spool", opts.Mode)
+	}
+	return NewWebSocketSpooler(opts.Config.TurboStreamURL, opts.Logger), nil
+}
+
+// gorillaWebSocketClient implements WebSocketClient using gorilla/websocket
+type gorillaWebSocketClient struct {
+	dialer *websocket.Dialer
+	conn   *websocket.Conn
+}
+
+// NewWebSocketClient creates a WebSocketClient backed by gorilla/websocket
+func NewWebSocketClient() WebSocketClient {
+	return &gorillaWebSocketClient{
+		dialer: websocket.DefaultDialer,
+	}
+}
+
+// Connect establishes a WebSocket connection to the given URL
+func (c *gorillaWebSocketClient) Connect(ctx context.Context, url string) error {
+	conn, _, err := c.dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", url, err)
+	}
+	c.conn = conn
+	return nil
+}
+
+// ReadMessage reads the next message, unblocking when ctx is cancelled
+func (c *gorillaWebSocketClient) ReadMessage(ctx context.Context) ([]byte, error) {
+	conn := c.conn
+	if conn == nil {
+		return nil, fmt.Errorf("websocket is not connected")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the WebSocket connection
+func (c *gorillaWebSocketClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// jetstreamEvent is the subset of a Jetstream event needed to build a row
+type jetstreamEvent struct {
+	DID    string `json:"did"`
+	TimeUS int64  `json:"time_us"`
+	Kind   string `json:"kind"`
+	Commit *struct {
+		Operation  string `json:"operation"`
+		Collection string `json:"collection"`
+		RKey       string `json:"rkey"`
+	} `json:"commit"`
+}
+
+// WebSocketSpooler streams commit events from a Jetstream-compatible endpoint.
+// Each record's Token is the event's time_us, and acknowledged events advance
+// the cursor used when reconnecting. An event that fails to index holds the
+// cursor below it, so that it is streamed again after the next reconnect.
+type WebSocketSpooler struct {
+	streamURL  string
+	newClient  func() WebSocketClient
+	records    chan Record
+	ackChan    chan Ack
+	ackDone    chan struct{}
+	stopOnce   sync.Once
+	logger     *IngestLogger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu       sync.Mutex
+	inflight []int64
+	pending  map[int64]int
+	cursor   int64
+	failed   map[int64]bool
+}
+
+func NewWebSocketSpooler(streamURL string, logger *IngestLogger) *WebSocketSpooler {
+	ws := &WebSocketSpooler{
+		streamURL:  streamURL,
+		newClient:  NewWebSocketClient,
+		records:    make(chan Record, 1000),
+		ackChan:    make(chan Ack, 1000),
+		ackDone:    make(chan struct{}),
+		logger:     logger,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		pending:    make(map[int64]int),
+		failed:     make(map[int64]bool),
+	}
+
+	go ws.runAckLoop()
+
+	return ws
+}
+
+func (ws *WebSocketSpooler) Start(ctx context.Context) error {
+	if _, err := url.Parse(ws.streamURL); err != nil {
+		return fmt.Errorf("invalid stream URL: %w", err)
+	}
+
+	ws.logger.Info("Starting websocket spooler (url: %s)", ws.streamURL)
+
+	go func() {
+		defer close(ws.records)
+
+		backoff := ws.minBackoff
+		for {
+			streamed, err := ws.stream(ctx)
+			if ctx.Err() != nil {
+				ws.logger.Info("Context cancelled, stopping websocket spooler")
+				return
+			}
+
+			if streamed {
+				backoff = ws.minBackoff
+			}
+			ws.logger.Error("Websocket stream interrupted: %v (reconnecting in %v)", err, backoff)
+
+			select {
+			case <-ctx.Done():
+				ws.logger.Info("Context cancelled, stopping websocket spooler")
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > ws.maxBackoff {
+				backoff = ws.maxBackoff
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ws *WebSocketSpooler) Records() <-chan Record {
+	return ws.records
+}
+
+func (ws *WebSocketSpooler) Ack(ack Ack) {
+	ws.ackChan <- ack
+}
+
+// Checkpoint returns the acknowledged time_us cursor
+func (ws *WebSocketSpooler) Checkpoint() string {
+	return strconv.FormatInt(ws.Cursor(), 10)
+}
+
+func (ws *WebSocketSpooler) Stop() error {
+	ws.logger.Info("Stopping websocket spooler")
+	ws.stopOnce.Do(func() {
+		close(ws.ackChan)
+	})
+	<-ws.ackDone
+	ws.logger.Info("Websocket cursor at shutdown: %d", ws.Cursor())
+	return nil
+}
+
+// Cursor returns the time_us of the newest event whose predecessors have all
+// been acknowledged, stopping short of the oldest event that failed to index
+func (ws *WebSocketSpooler) Cursor() int64 {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.cursor
+}
+
+// stream connects once and forwards events until the connection fails. It
+// reports whether any event was received so the caller can reset its backoff.
+func (ws *WebSocketSpooler) stream(ctx context.Context) (bool, error) {
+	streamURL, err := ws.connectURL()
+	if err != nil {
+		return false, err
+	}
+
+	client := ws.newClient()
+	if err := client.Connect(ctx, streamURL); err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	ws.logger.Info("Connected to websocket stream: %s", streamURL)
+
+	streamed := false
+	for {
+		data, err := client.ReadMessage(ctx)
+		if err != nil {
+			return streamed, err
+		}
+		streamed = true
+
+		row, ok := ws.parseEvent(data)
+		if !ok {
+			continue
+		}
+
+		ws.track(row)
+
+		select {
+		case <-ctx.Done():
+			return streamed, ctx.Err()
+		case ws.records <- row:
+		}
+	}
+}
+
+// connectURL adds the collection filter and, once events have been
+// acknowledged, the cursor to resume from
+func (ws *WebSocketSpooler) connectURL() (string, error) {
+	u, err := url.Parse(ws.streamURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream URL: %w", err)
+	}
+
+	query := u.Query()
+	query.Set("wantedCollections", jetstreamPostCollection)
+	if cursor := ws.Cursor(); cursor > 0 {
+		query.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// parseEvent converts a post commit event into a row in the raw_post shape
+// that megaStreamMessage.parseRawPost expects
+func (ws *WebSocketSpooler) parseEvent(data []byte) (Record, bool) {
+	var event jetstreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		ws.logger.Error("Failed to parse websocket event: %v", err)
+		return Record{}, false
+	}
+
+	if event.Kind != "commit" || event.Commit == nil || event.Commit.Collection != jetstreamPostCollection {
+		return Record{}, false
+	}
+
+	rawPost, err := json.Marshal(map[string]json.RawMessage{"message": data})
+	if err != nil {
+		ws.logger.Error("Failed to wrap websocket event for %s: %v", event.DID, err)
+		return Record{}, false
+	}
+
+	return Record{
+		AtURI:      fmt.Sprintf("at://%s/%s/%s", event.DID, event.Commit.Collection, event.Commit.RKey),
+		DID:        event.DID,
+		RawPost:    string(rawPost),
+		Inferences: "{}",
+		Source:     websocketSourceName,
+		Token:      AckToken(event.TimeUS),
+	}, true
+}
+
+func (ws *WebSocketSpooler) track(row Record) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	// Events replayed after a reconnect can be older than those still in
+	// flight, so inflight is kept in time_us order
+	timeUS := int64(row.Token)
+	if ws.pending[timeUS] == 0 {
+		i, _ := slices.BinarySearch(ws.inflight, timeUS)
+		ws.inflight = slices.Insert(ws.inflight, i, timeUS)
+	}
+	ws.pending[timeUS]++
+}
+
+func (ws *WebSocketSpooler) runAckLoop() {
+	defer close(ws.ackDone)
+
+	for ack := range ws.ackChan {
+		ws.handleAck(ack)
+	}
+}
+
+func (ws *WebSocketSpooler) handleAck(ack Ack) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	timeUS := int64(ack.Token)
+	if ws.pending[timeUS] <= 0 {
+		ws.logger.Error("Ignoring acknowledgment of websocket event %d, which is not in flight", timeUS)
+		return
+	}
+	if ack.Err != nil {
+		ws.logger.Error("Websocket event %d failed to index: %v", timeUS, ack.Err)
+		ws.failed[timeUS] = true
+	} else {
+		// The event was replayed after a reconnect and has now been indexed
+		delete(ws.failed, timeUS)
+	}
+
+	ws.pending[timeUS] = max(ws.pending[timeUS]-ack.Count, 0)
+
+	oldestFailed := ws.oldestFailedUnsafe()
+	for len(ws.inflight) > 0 && ws.pending[ws.inflight[0]] == 0 {
+		done := ws.inflight[0]
+		delete(ws.pending, done)
+		ws.inflight = ws.inflight[1:]
+		if done > ws.cursor && (oldestFailed == 0 || done < oldestFailed) {
+			ws.cursor = done
+		}
+	}
+}
+
+// oldestFailedUnsafe returns the time_us of the oldest event that failed to
+// index and has not since been indexed, or 0 if there is none. Failed events
+// hold the cursor until they are replayed successfully, so that events still
+// in flight from before a reconnect cannot move it past them.
+func (ws *WebSocketSpooler) oldestFailedUnsafe() int64 {
+	var oldest int64
+	for timeUS := range ws.failed {
+		if oldest == 0 || timeUS < oldest {
+			oldest = timeUS
+		}
+	}
+	return oldest
+}
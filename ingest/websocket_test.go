@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jetstreamTestServer serves a fixed set of events per connection and records
+// the query string of every connection attempt
+type jetstreamTestServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	queries []string
+	events  [][]string
+}
+
+func newJetstreamTestServer(t *testing.T, events ...[]string) *jetstreamTestServer {
+	t.Helper()
+
+	js := &jetstreamTestServer{events: events}
+	upgrader := websocket.Upgrader{}
+
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.mu.Lock()
+		attempt := len(js.queries)
+		js.queries = append(js.queries, r.URL.RawQuery)
+		js.mu.Unlock()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if attempt >= len(js.events) {
+			// Hold the last connection open until the client goes away
+			conn.ReadMessage()
+			return
+		}
+
+		for _, event := range js.events[attempt] {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(event)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(js.Close)
+
+	return js
+}
+
+func (js *jetstreamTestServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(js.URL, "http")
+}
+
+func (js *jetstreamTestServer) query(i int) string {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if i >= len(js.queries) {
+		return ""
+	}
+	return js.queries[i]
+}
+
+func postEvent(timeUS int64, operation, rkey string) string {
+	return fmt.Sprintf(`{"did":"did:plc:test","time_us":%d,"kind":"commit","commit":{"rev":"r","operation":%q,"collection":"app.bsky.feed.post","rkey":%q,"record":{"text":"hello %s","createdAt":"2025-01-01T00:00:00Z"}}}`, timeUS, operation, rkey, rkey)
+}
+
+func receiveRow(t *testing.T, spooler DataSource) Record {
+	t.Helper()
+
+	select {
+	case row := <-spooler.Records():
+		return row
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for websocket row")
+	}
+	return Record{}
+}
+
+func TestWebSocketSpooler_ParsesCommitEvents(t *testing.T) {
+	server := newJetstreamTestServer(t, []string{
+		`{"did":"did:plc:test","time_us":5,"kind":"identity"}`,
+		postEvent(10, "create", "abc"),
+	})
+
+	logger := NewLogger(false)
+	spooler := NewWebSocketSpooler(server.wsURL(), logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := spooler.Start(ctx); err != nil {
+		t.Fatalf("Failed to start websocket spooler: %v", err)
+	}
+
+	row := receiveRow(t, spooler)
+	if row.AtURI != "at://did:plc:test/app.bsky.feed.post/abc" {
+		t.Errorf("Unexpected at_uri: %s", row.AtURI)
+	}
+
+	msg := NewMegaStreamMessage(row.AtURI, row.DID, row.RawPost, row.Inferences, DefaultEmbeddingModelRegistry(), nil, logger)
+	if msg.GetContent() != "hello abc" {
+		t.Errorf("Expected content to be parsed from commit record, got %q", msg.GetContent())
+	}
+
+	if !strings.Contains(server.query(0), "wantedCollections=app.bsky.feed.post") {
+		t.Errorf("Expected collection filter in query, got %q", server.query(0))
+	}
+}
+
+func TestWebSocketSpooler_ReconnectsFromAckedCursor(t *testing.T) {
+	server := newJetstreamTestServer(t,
+		[]string{postEvent(100, "create", "a"), postEvent(200, "create", "b")},
+		[]string{postEvent(300, "create", "c")},
+	)
+
+	logger := NewLogger(false)
+	spooler := NewWebSocketSpooler(server.wsURL(), logger)
+	spooler.minBackoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := spooler.Start(ctx); err != nil {
+		t.Fatalf("Failed to start websocket spooler: %v", err)
+	}
+
+	first := receiveRow(t, spooler)
+	spooler.Ack(Ack{Token: first.Token, Count: 1})
+	receiveRow(t, spooler)
+
+	third := receiveRow(t, spooler)
+	if third.AtURI != "at://did:plc:test/app.bsky.feed.post/c" {
+		t.Errorf("Expected row from second connection, got %s", third.AtURI)
+	}
+
+	if !strings.Contains(server.query(1), "cursor=100") {
+		t.Errorf("Expected reconnect to resume from acked cursor 100, got %q", server.query(1))
+	}
+
+	cancel()
+	for range spooler.Records() {
+	}
+
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop websocket spooler: %v", err)
+	}
+}
+
+func TestWebSocketSpooler_CursorWaitsForEarlierAcks(t *testing.T) {
+	spooler := NewWebSocketSpooler("ws://unused", NewLogger(false))
+	defer spooler.Stop()
+
+	spooler.track(Record{Token: 1})
+	spooler.track(Record{Token: 2})
+
+	spooler.handleAck(Ack{Token: 2, Count: 1})
+	if cursor := spooler.Cursor(); cursor != 0 {
+		t.Errorf("Expected cursor to wait for event 1, got %d", cursor)
+	}
+
+	spooler.handleAck(Ack{Token: 1, Count: 1})
+	if cursor := spooler.Cursor(); cursor != 2 {
+		t.Errorf("Expected cursor to advance to 2, got %d", cursor)
+	}
+}
+
+func TestWebSocketSpooler_IgnoresUnknownAcks(t *testing.T) {
+	spooler := NewWebSocketSpooler("ws://unused", NewLogger(false))
+	defer spooler.Stop()
+
+	spooler.track(Record{Token: 1})
+	spooler.handleAck(Ack{Token: 7, Count: 1})
+	spooler.handleAck(Ack{Token: 1, Count: 2})
+	spooler.handleAck(Ack{Token: 1, Count: 1})
+
+	spooler.track(Record{Token: 2})
+	if cursor := spooler.Cursor(); cursor != 1 {
+		t.Errorf("Expected cursor at 1, got %d", cursor)
+	}
+	if pending := spooler.pending[2]; pending != 1 {
+		t.Errorf("Expected event 2 to be pending once, got %d", pending)
+	}
+}
+
+func TestWebSocketSpooler_CursorHoldsBeforeFailedEvent(t *testing.T) {
+	spooler := NewWebSocketSpooler("ws://unused", NewLogger(false))
+	defer spooler.Stop()
+
+	for _, timeUS := range []int64{1, 2, 3} {
+		spooler.track(Record{Token: AckToken(timeUS)})
+	}
+	spooler.handleAck(Ack{Token: 1, Count: 1})
+	spooler.handleAck(Ack{Token: 2, Count: 1, Err: fmt.Errorf("bulk request failed")})
+	spooler.handleAck(Ack{Token: 3, Count: 1})
+	if cursor := spooler.Cursor(); cursor != 1 {
+		t.Fatalf("Expected cursor to hold before failed event 2, got %d", cursor)
+	}
+
+	// After a reconnect, the replayed events advance the cursor again once
+	// the failed event has been indexed
+	spooler.track(Record{Token: 4})
+	spooler.track(Record{Token: 2})
+	if spooler.inflight[0] != 2 {
+		t.Errorf("Expected replayed event to be tracked in time order, got %v", spooler.inflight)
+	}
+	spooler.handleAck(Ack{Token: 2, Count: 1})
+	if cursor := spooler.Cursor(); cursor != 2 {
+		t.Errorf("Expected cursor to advance to replayed event 2, got %d", cursor)
+	}
+}
+
+func TestWebSocketSpooler_CursorHoldsAcrossReconnectUntilFailedEventReplays(t *testing.T) {
+	server := newJetstreamTestServer(t, []string{
+		postEvent(1, "create", "a"),
+		postEvent(2, "create", "b"),
+		postEvent(3, "create", "c"),
+	})
+
+	spooler := NewWebSocketSpooler(server.wsURL(), NewLogger(false))
+	spooler.minBackoff = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := spooler.Start(ctx); err != nil {
+		t.Fatalf("Failed to start websocket spooler: %v", err)
+	}
+
+	rows := []Record{receiveRow(t, spooler), receiveRow(t, spooler), receiveRow(t, spooler)}
+	spooler.Ack(Ack{Token: rows[0].Token, Count: 1})
+	spooler.Ack(Ack{Token: rows[1].Token, Count: 1, Err: fmt.Errorf("bulk request failed")})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.query(1) == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(server.query(1), "cursor=1") {
+		t.Errorf("Expected reconnect to resume before failed event 2, got %q", server.query(1))
+	}
+
+	// Event 3 was in flight before the reconnect; acknowledging it must not
+	// move the cursor past event 2, which has not been replayed yet
+	spooler.Ack(Ack{Token: rows[2].Token, Count: 1})
+
+	cancel()
+	for range spooler.Records() {
+	}
+	if err := spooler.Stop(); err != nil {
+		t.Fatalf("Failed to stop websocket spooler: %v", err)
+	}
+
+	if cursor := spooler.Cursor(); cursor != 1 {
+		t.Errorf("Expected cursor to hold before failed event 2, got %d", cursor)
+	}
+}
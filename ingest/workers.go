@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IndexerPoolConfig holds the settings of an IndexerPool. A worker's batch is
+// flushed as soon as it reaches BatchSize actions or BatchBytes of serialized
+// documents, or has been open for FlushInterval, whichever comes first.
+type IndexerPoolConfig struct {
+	Workers       int
+	QueueSize     int // full batches each worker may queue before Add blocks
+	BatchSize     int
+	BatchBytes    int
+	FlushInterval time.Duration
+}
+
+// indexBatch is a batch of actions owned by one worker, together with the
+// number of records each data source token contributed to it
+type indexBatch struct {
+	actions []BulkAction
+	acks    map[AckToken]int
+	bytes   int
+	opened  time.Time
+}
+
+// indexWorker sends batches from its queue to Elasticsearch one at a time
+type indexWorker struct {
+	id      int
+	queue   chan indexBatch
+	current indexBatch
+}
+
+// IndexerPool distributes bulk actions over a fixed number of workers. Every
+// action for the same at_uri is routed to the same worker, and each worker
+// sends its batches sequentially, so operations on a document are applied in
+// the order they were added. Each worker has a bounded queue: when it is full,
+// Add blocks, which stops the ingestion loop from reading further records and
+// applies backpressure to the data source.
+type IndexerPool struct {
+	indexer   *BulkIndexer
+	ack       func(Ack)
+	config    IndexerPoolConfig
+	dryRun    bool
+	workers   []*indexWorker
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	metrics   *Metrics
+	logger    *IngestLogger
+
+	processed atomic.Int64
+	failed    atomic.Int64
+}
+
+// NewIndexerPool creates a pool of workers sending batches through indexer.
+// ack is called for every data source token once a batch containing its
+// records has been handled.
+func NewIndexerPool(indexer *BulkIndexer, config IndexerPoolConfig, ack func(Ack), metrics *Metrics, logger *IngestLogger) *IndexerPool {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = 1
+	}
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+
+	p := &IndexerPool{
+		indexer: indexer,
+		ack:     ack,
+		config:  config,
+		dryRun:  indexer.config.DryRun,
+		metrics: metrics,
+		logger:  logger,
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		p.workers = append(p.workers, &indexWorker{
+			id:      i,
+			queue:   make(chan indexBatch, config.QueueSize),
+			current: newIndexBatch(),
+		})
+	}
+
+	return p
+}
+
+func newIndexBatch() indexBatch {
+	return indexBatch{acks: make(map[AckToken]int)}
+}
+
+// Start launches the workers. Queued batches are always sent, even after ctx
+// is cancelled, so that shutdown does not lose records that were already
+// read from the data source.
+func (p *IndexerPool) Start(ctx context.Context) {
+	sendCtx := context.WithoutCancel(ctx)
+	for _, w := range p.workers {
+		p.wg.Add(1)
+		go p.run(sendCtx, w)
+	}
+	p.logger.Info("Started %d Elasticsearch bulk workers", len(p.workers))
+}
+
+// Add routes action to the worker owning its at_uri and counts the record
+// towards token. It blocks while that worker's queue is full. Add, Flush and
+// FlushExpired must not be called concurrently or after Close.
+func (p *IndexerPool) Add(action BulkAction, token AckToken) {
+	w := p.workers[p.workerFor(action.ID)]
+	size := action.encodedSize()
+
+	// Keep the bulk body under the byte limit; an action larger than the
+	// limit on its own is sent in a batch by itself
+	if p.config.BatchBytes > 0 && len(w.current.actions) > 0 && w.current.bytes+size > p.config.BatchBytes {
+		p.dispatch(w, "bytes")
+	}
+
+	if len(w.current.actions) == 0 {
+		w.current.opened = time.Now()
+	}
+	w.current.actions = append(w.current.actions, action)
+	w.current.acks[token]++
+	w.current.bytes += size
+
+	if len(w.current.actions) >= p.config.BatchSize {
+		p.dispatch(w, "count")
+	}
+}
+
+// FlushExpired hands every batch that has been open for at least the flush
+// interval to its worker, so that a trickle of records is not held back
+func (p *IndexerPool) FlushExpired() {
+	if p.config.FlushInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, w := range p.workers {
+		if len(w.current.actions) > 0 && now.Sub(w.current.opened) >= p.config.FlushInterval {
+			p.dispatch(w, "interval")
+		}
+	}
+}
+
+// Flush hands every partial batch to its worker
+func (p *IndexerPool) Flush() {
+	for _, w := range p.workers {
+		if len(w.current.actions) > 0 {
+			p.dispatch(w, "final")
+		}
+	}
+}
+
+// Close flushes partial batches and waits until every queued batch has been
+// sent and acknowledged
+func (p *IndexerPool) Close() {
+	p.closeOnce.Do(func() {
+		p.Flush()
+		for _, w := range p.workers {
+			close(w.queue)
+		}
+		p.wg.Wait()
+	})
+}
+
+// Processed returns the number of actions sent successfully
+func (p *IndexerPool) Processed() int64 {
+	return p.processed.Load()
+}
+
+// Failed returns the number of actions in batches that could not be indexed
+func (p *IndexerPool) Failed() int64 {
+	return p.failed.Load()
+}
+
+func (p *IndexerPool) workerFor(atURI string) int {
+	h := fnv.New32a()
+	h.Write([]byte(atURI))
+	return int(h.Sum32() % uint32(len(p.workers)))
+}
+
+// dispatch queues the worker's current batch, recording why it was flushed
+func (p *IndexerPool) dispatch(w *indexWorker, reason string) {
+	p.metrics.Inc("bulk.flush." + reason)
+	w.queue <- w.current
+	w.current = newIndexBatch()
+}
+
+func (p *IndexerPool) run(ctx context.Context, w *indexWorker) {
+	defer p.wg.Done()
+
+	for batch := range w.queue {
+		err := p.indexer.Index(ctx, batch.actions)
+		if err != nil {
+			p.failed.Add(int64(len(batch.actions)))
+			p.logger.Error("Worker %d failed to bulk index batch of %d actions: %v", w.id, len(batch.actions), err)
+		} else if len(batch.actions) > 0 {
+			total := p.processed.Add(int64(len(batch.actions)))
+			if p.dryRun {
+				p.logger.Info("Dry-run: Worker %d would send batch: %d actions (total: %d)", w.id, len(batch.actions), total)
+			} else {
+				p.logger.Info("Worker %d sent batch: %d actions (total: %d)", w.id, len(batch.actions), total)
+			}
+		}
+
+		for token, count := range batch.acks {
+			p.ack(Ack{Token: token, Count: count, Err: err})
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ackRecorder collects acknowledgments sent by an IndexerPool
+type ackRecorder struct {
+	mu    sync.Mutex
+	acked map[AckToken]int
+	errs  int
+}
+
+func newAckRecorder() *ackRecorder {
+	return &ackRecorder{acked: make(map[AckToken]int)}
+}
+
+func (r *ackRecorder) Ack(ack Ack) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acked[ack.Token] += ack.Count
+	if ack.Err != nil {
+		r.errs++
+	}
+}
+
+func TestIndexerPool_PreservesOrderPerDocument(t *testing.T) {
+	var mu sync.Mutex
+	ops := make(map[string][]string)
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ops[id] = append(ops[id], op)
+		return http.StatusOK, ""
+	})
+
+	acks := newAckRecorder()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false))
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{Workers: 4, QueueSize: 1, BatchSize: 3}, acks.Ack, nil, NewLogger(false))
+	pool.Start(context.Background())
+
+	const docs = 20
+	for round := 0; round < 3; round++ {
+		for i := 0; i < docs; i++ {
+			id := fmt.Sprintf("at://doc/%d", i)
+			if round == 1 {
+				pool.Add(NewDeleteAction(id, 0), AckToken(1))
+			} else {
+				pool.Add(NewIndexAction(ElasticsearchDoc{AtURI: id}, 0), AckToken(round+1))
+			}
+		}
+	}
+	pool.Close()
+
+	for i := 0; i < docs; i++ {
+		id := fmt.Sprintf("at://doc/%d", i)
+		got := fmt.Sprint(ops[id])
+		if got != "[index delete index]" {
+			t.Errorf("Expected %s to be indexed, deleted and re-indexed in order, got %s", id, got)
+		}
+	}
+
+	if acks.acked[1] != 2*docs || acks.acked[3] != docs {
+		t.Errorf("Expected every record to be acknowledged, got %v", acks.acked)
+	}
+
+	if pool.Processed() != 3*docs {
+		t.Errorf("Expected %d processed actions, got %d", 3*docs, pool.Processed())
+	}
+}
+
+func TestIndexerPool_BackpressureWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		<-release
+		return http.StatusCreated, ""
+	})
+
+	acks := newAckRecorder()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false))
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{Workers: 1, QueueSize: 1, BatchSize: 1}, acks.Ack, nil, NewLogger(false))
+	pool.Start(context.Background())
+
+	added := make(chan int, 10)
+	go func() {
+		for i := 0; i < 4; i++ {
+			pool.Add(NewIndexAction(ElasticsearchDoc{AtURI: fmt.Sprintf("at://%d", i)}, 0), AckToken(1))
+			added <- i
+		}
+	}()
+
+	// One batch is in flight and one is queued; the third Add must block
+	timeout := time.After(200 * time.Millisecond)
+	count := 0
+wait:
+	for {
+		select {
+		case <-added:
+			count++
+		case <-timeout:
+			break wait
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected Add to block after filling the queue, %d adds returned", count)
+	}
+
+	close(release)
+	for count < 4 {
+		<-added
+		count++
+	}
+	pool.Close()
+
+	if acks.acked[1] != 4 {
+		t.Errorf("Expected 4 acknowledged records, got %d", acks.acked[1])
+	}
+}
+
+func TestIndexerPool_AcknowledgesFailures(t *testing.T) {
+	_, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusBadRequest, "mapper_parsing_exception"
+	})
+
+	acks := newAckRecorder()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false))
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{Workers: 2, QueueSize: 1, BatchSize: 10}, acks.Ack, nil, NewLogger(false))
+	pool.Start(context.Background())
+
+	for i := 0; i < 5; i++ {
+		pool.Add(NewIndexAction(ElasticsearchDoc{AtURI: fmt.Sprintf("at://%d", i)}, 0), AckToken(7))
+	}
+	pool.Close()
+
+	if acks.acked[7] != 5 || acks.errs == 0 {
+		t.Errorf("Expected failed records to be acknowledged with an error, got %v (errors: %d)", acks.acked, acks.errs)
+	}
+
+	if pool.Failed() != 5 || pool.Processed() != 0 {
+		t.Errorf("Expected 5 failed and 0 processed actions, got %d and %d", pool.Failed(), pool.Processed())
+	}
+}
+
+func TestIndexerPool_FlushesByBytes(t *testing.T) {
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusCreated, ""
+	})
+
+	acks := newAckRecorder()
+	metrics := NewMetrics()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false))
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{Workers: 1, QueueSize: 4, BatchSize: 100, BatchBytes: 4096}, acks.Ack, metrics, NewLogger(false))
+	pool.Start(context.Background())
+
+	content := strings.Repeat("x", 1500)
+	for i := 0; i < 5; i++ {
+		pool.Add(NewIndexAction(ElasticsearchDoc{AtURI: fmt.Sprintf("at://%d", i), Content: content}, 0), AckToken(1))
+	}
+	pool.Close()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for i, lines := range server.requests {
+		if len(lines) > 4 {
+			t.Errorf("Expected request %d to hold at most 2 documents under the byte limit, got %d lines", i, len(lines))
+		}
+	}
+
+	if metrics.Get("bulk.flush.bytes") != 2 || metrics.Get("bulk.flush.final") != 1 {
+		t.Errorf("Expected 2 byte-limited flushes and 1 final flush, got %s", metrics)
+	}
+
+	if acks.acked[1] != 5 {
+		t.Errorf("Expected 5 acknowledged records, got %d", acks.acked[1])
+	}
+}
+
+func TestIndexerPool_FlushExpired(t *testing.T) {
+	server, client := newBulkTestServer(t, func(op, id string) (int, string) {
+		return http.StatusCreated, ""
+	})
+
+	acks := newAckRecorder()
+	metrics := NewMetrics()
+	indexer := NewBulkIndexer(client, BulkIndexerConfig{}, nil, NewLogger(false))
+	pool := NewIndexerPool(indexer, IndexerPoolConfig{Workers: 2, QueueSize: 1, BatchSize: 100, FlushInterval: 50 * time.Millisecond}, acks.Ack, metrics, NewLogger(false))
+	pool.Start(context.Background())
+	defer pool.Close()
+
+	pool.Add(NewIndexAction(ElasticsearchDoc{AtURI: "at://trickle"}, 0), AckToken(1))
+
+	pool.FlushExpired()
+	if metrics.Get("bulk.flush.interval") != 0 {
+		t.Fatal("Expected a fresh batch not to be flushed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	pool.FlushExpired()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.lastRequest() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if server.lastRequest() == nil {
+		t.Fatal("Expected expired batch to be sent before Close")
+	}
+	if metrics.Get("bulk.flush.interval") != 1 {
+		t.Errorf("Expected 1 interval flush, got %d", metrics.Get("bulk.flush.interval"))
+	}
+}